@@ -4,31 +4,46 @@ import (
 	"bytes"
 	"compress/flate"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"math"
+	"slices"
 	"sort"
 )
 
 const (
 	archiveMagic   = "OPAR"
-	archiveVersion = uint16(2)
+	archiveVersion = FormatVersion2 // Written by default
 
 	stageCompressedData   = "compressed_data"
 	stageStringBoundaries = "string_boundaries"
 	stageDictionary       = "dictionary"
 	stageTokenBoundaries  = "token_boundaries"
+	stageTombstones       = "tombstones"
+	stageMetadata         = "metadata"
+	stagePassthrough      = "passthrough"
 
 	stageCompressedDataParamWidth16              = uint8(2)  // raw legacy 16-bit (2-byte) token IDs
 	stageCompressedDataParamWidth16Flate         = uint8(3)  // flate(raw 16-bit payload)
 	stageCompressedDataParamWidth16Codebook      = uint8(4)  // byte codebook + escape stream (16-bit token IDs)
 	stageCompressedDataParamWidth16CodebookFlate = uint8(5)  // flate(codebook stream for 16-bit token IDs)
+	stageCompressedDataParamWidth16Huffman       = uint8(6)  // canonical Huffman stream (16-bit token IDs)
 	stageCompressedDataParamWidth12              = uint8(12) // raw packed 12-bit token IDs
 	stageCompressedDataParamWidth12Flate         = uint8(13) // flate(raw 12-bit payload)
 	stageCompressedDataParamWidth12Codebook      = uint8(14) // byte codebook + escape stream (12-bit token IDs)
 	stageCompressedDataParamWidth12CodebookFlate = uint8(15) // flate(codebook stream for 12-bit token IDs)
+	stageCompressedDataParamWidth12Huffman       = uint8(16) // canonical Huffman stream (12-bit token IDs)
 	stageStringBoundariesParamDelta              = uint8(1)
 	stageTokenBoundariesParamWidth               = uint8(4) // raw uint32 boundaries
 	stageTokenBoundariesParamDelta               = uint8(5) // first boundary + varint deltas
+	stageTombstonesParamBitmap                   = uint8(1) // row count + little-endian deletion bitmap
+	stageMetadataParamEntries                    = uint8(1) // entry count + uvarint-prefixed key/value pairs
+	stageDictionaryParamParents                  = uint8(1) // tokens coded as parent references (version 3)
+	stagePassthroughParamRaw                     = uint8(1) // row bytes as is (version 3)
+	stagePassthroughParamFlate                   = uint8(2) // flate(row bytes) (version 3)
 
 	maxArchiveStages       = 64
 	maxStagePayloadBytes   = 1 << 30 // 1 GiB
@@ -41,6 +56,58 @@ const (
 	compressedDataCodebookMaxEntries = int(compressedDataCodebookEscapeByte)
 )
 
+// compressed_data encodings. Widths 12 and 16 use the single-byte legacy
+// params above; every other width uses two-byte params {encoding, bitWidth}.
+const (
+	compressedDataEncodingRaw = uint8(iota)
+	compressedDataEncodingFlate
+	compressedDataEncodingCodebook
+	compressedDataEncodingCodebookFlate
+	compressedDataEncodingHuffman
+)
+
+var legacyCompressedDataParams = [...]struct {
+	param    uint8
+	encoding uint8
+	bitWidth uint8
+}{
+	{stageCompressedDataParamWidth16, compressedDataEncodingRaw, tokenBitWidth16},
+	{stageCompressedDataParamWidth16Flate, compressedDataEncodingFlate, tokenBitWidth16},
+	{stageCompressedDataParamWidth16Codebook, compressedDataEncodingCodebook, tokenBitWidth16},
+	{stageCompressedDataParamWidth16CodebookFlate, compressedDataEncodingCodebookFlate, tokenBitWidth16},
+	{stageCompressedDataParamWidth16Huffman, compressedDataEncodingHuffman, tokenBitWidth16},
+	{stageCompressedDataParamWidth12, compressedDataEncodingRaw, tokenBitWidth12},
+	{stageCompressedDataParamWidth12Flate, compressedDataEncodingFlate, tokenBitWidth12},
+	{stageCompressedDataParamWidth12Codebook, compressedDataEncodingCodebook, tokenBitWidth12},
+	{stageCompressedDataParamWidth12CodebookFlate, compressedDataEncodingCodebookFlate, tokenBitWidth12},
+	{stageCompressedDataParamWidth12Huffman, compressedDataEncodingHuffman, tokenBitWidth12},
+}
+
+func compressedDataParams(encoding, bitWidth uint8) []byte {
+	for _, legacy := range legacyCompressedDataParams {
+		if legacy.encoding == encoding && legacy.bitWidth == bitWidth {
+			return []byte{legacy.param}
+		}
+	}
+	return []byte{encoding, bitWidth}
+}
+
+func parseCompressedDataParams(params []byte) (uint8, uint8, error) {
+	switch len(params) {
+	case 1:
+		for _, legacy := range legacyCompressedDataParams {
+			if legacy.param == params[0] {
+				return legacy.encoding, legacy.bitWidth, nil
+			}
+		}
+	case 2:
+		if params[0] <= compressedDataEncodingHuffman && validTokenBitWidth(params[1]) {
+			return params[0], params[1], nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid compressed_data params: %v", params)
+}
+
 // Wire format (version 2):
 //
 //	magic[4] = "OPAR"
@@ -54,11 +121,30 @@ const (
 //	  params   = paramLen bytes
 //	  payload  = dataLen bytes
 //
+// Version 3 inserts an archive header between version and stageCnt and may
+// append a checksum after the last stage:
+//
+//	headerLen = uint16 little-endian (>= 14; extra bytes are ignored)
+//	features  = uint32 little-endian (bit 0: tombstones stage present,
+//	            bit 1: parent-coded dictionary stage, bit 2: passthrough
+//	            stage in place of the token and dictionary stages)
+//	rows      = uint64 little-endian
+//	bitWidth  = uint8 (token bit width of compressed_data)
+//	checksum  = uint8 (0: none, 1: CRC-32C)
+//	...stageCnt and stages as in version 2...
+//	crc32c    = uint32 little-endian over all preceding bytes (checksum 1)
+//
 // Required stage names:
 //
 //	compressed_data, string_boundaries, dictionary, token_boundaries
 //
-// Unknown stages are skipped via dataLen framing.
+// Optional stage names:
+//
+//	tombstones (written only when at least one row is deleted)
+//	metadata   (written only when the archive has metadata)
+//
+// Stages with a codec registered by RegisterStageCodec are decoded by it;
+// other unknown stages are skipped via dataLen framing.
 type wireStageHeader struct {
 	name     string
 	paramLen uint16
@@ -76,61 +162,6 @@ func writeBytes(w io.Writer, b []byte) (int64, error) {
 	return int64(n), nil
 }
 
-func writeStage(w io.Writer, name string, params []byte, payload []byte) (int64, error) {
-	if len(name) == 0 || len(name) > 255 {
-		return 0, fmt.Errorf("invalid stage name length: %d", len(name))
-	}
-	if len(params) > int(^uint16(0)) {
-		return 0, fmt.Errorf("stage params too large for %q: %d", name, len(params))
-	}
-	if len(payload) > maxStagePayloadBytes {
-		return 0, fmt.Errorf("stage payload too large for %q: %d", name, len(payload))
-	}
-
-	var total int64
-	add := func(n int64) {
-		total += n
-	}
-
-	nameLen := uint8(len(name))
-	if err := binary.Write(w, binary.LittleEndian, nameLen); err != nil {
-		return total, err
-	}
-	add(1)
-
-	paramLen := uint16(len(params))
-	if err := binary.Write(w, binary.LittleEndian, paramLen); err != nil {
-		return total, err
-	}
-	add(2)
-
-	dataLen := uint32(len(payload))
-	if err := binary.Write(w, binary.LittleEndian, dataLen); err != nil {
-		return total, err
-	}
-	add(4)
-
-	n, err := writeBytes(w, []byte(name))
-	add(n)
-	if err != nil {
-		return total, err
-	}
-
-	n, err = writeBytes(w, params)
-	add(n)
-	if err != nil {
-		return total, err
-	}
-
-	n, err = writeBytes(w, payload)
-	add(n)
-	if err != nil {
-		return total, err
-	}
-
-	return total, nil
-}
-
 func readStageHeader(r io.Reader) (wireStageHeader, int64, error) {
 	var total int64
 	var nameLen uint8
@@ -139,7 +170,7 @@ func readStageHeader(r io.Reader) (wireStageHeader, int64, error) {
 	}
 	total += 1
 	if nameLen == 0 {
-		return wireStageHeader{}, total, fmt.Errorf("stage name length must be > 0")
+		return wireStageHeader{}, total, corruptf("stage name length must be > 0")
 	}
 
 	var paramLen uint16
@@ -154,7 +185,7 @@ func readStageHeader(r io.Reader) (wireStageHeader, int64, error) {
 	}
 	total += 4
 	if dataLen > uint32(maxStagePayloadBytes) {
-		return wireStageHeader{}, total, fmt.Errorf("stage payload too large: %d", dataLen)
+		return wireStageHeader{}, total, corruptf("stage payload too large: %d", dataLen)
 	}
 
 	nameBytes := make([]byte, int(nameLen))
@@ -184,41 +215,90 @@ type Archive struct {
 
 	// Internal encoding metadata for compressed token stream.
 	compressedTokenBitWidth uint8
+
+	// Deletion bitmap, one bit per row. Nil when no row has been deleted.
+	tombstones []uint64
+
+	// Bit-packed token stream. When set, it replaces CompressedData (which
+	// is nil) as the in-memory token storage.
+	packed *packedTokens
+
+	// 32-bit row boundaries. When set, they replace StringBoundaries (which
+	// is nil) as the in-memory row index.
+	compactBoundaries []uint32
+
+	// OnPair16 fixed-slot decode table, built on first decode when every
+	// dictionary token fits in 16 bytes. Nil for hand-built archives.
+	slots *lazySlots
+
+	// Shape recorded by the last successful validation. Decoders skip
+	// per-token checks while the archive still matches it.
+	validated *archiveShape
+
+	// User metadata set by SetMetadata. Nil when empty.
+	metadata map[string]string
+
+	// Custom stage values keyed by stage name, encoded by the codecs
+	// registered with RegisterStageCodec. Nil when empty.
+	stageValues map[string]any
+
+	// Passthrough storage (see passthrough.go). When passthrough is set,
+	// raw holds the row bytes, the row boundaries index into it, and the
+	// token stream and dictionary fields are empty.
+	passthrough bool
+	raw         []byte
+
+	// Options of the encoder or model that built the archive, which Merge
+	// re-encodes with. Zero for archives read or built by hand.
+	config Config
 }
 
 func (a *Archive) tokenBitWidth() uint8 {
-	switch a.compressedTokenBitWidth {
-	case tokenBitWidth12:
-		return tokenBitWidth12
-	case tokenBitWidth16:
-		return tokenBitWidth16
-	default:
-		return tokenBitWidth16
+	if a.passthrough {
+		return passthroughTokenBitWidth
+	}
+	if validTokenBitWidth(a.compressedTokenBitWidth) {
+		return a.compressedTokenBitWidth
 	}
+	return tokenBitWidth16
 }
 
-func packed12ByteSize(tokenCount int) int {
-	return (tokenCount*int(tokenBitWidth12) + 7) / 8
+func packedByteSize(tokenCount int, bitWidth uint8) int {
+	return (tokenCount*int(bitWidth) + 7) / 8
 }
 
 // Rows returns the number of strings encoded in this archive.
 func (a *Archive) Rows() int {
-	if len(a.StringBoundaries) == 0 {
+	if a.boundaryCount() == 0 {
 		return 0
 	}
-	return len(a.StringBoundaries) - 1
+	return a.boundaryCount() - 1
 }
 
 // DecodedLen reports the decoded length in bytes for one string.
 func (a *Archive) DecodedLen(index int) (int, error) {
 	if index < 0 || index >= a.Rows() {
-		return 0, fmt.Errorf("index out of bounds: %d", index)
+		return 0, fmt.Errorf("%w: %d", ErrIndexOutOfRange, index)
+	}
+	if a.IsDeleted(index) {
+		return 0, fmt.Errorf("%w: %d", ErrRowDeleted, index)
 	}
 
-	start := a.StringBoundaries[index]
-	end := a.StringBoundaries[index+1]
-	if start < 0 || end < start || end > len(a.CompressedData) {
-		return 0, fmt.Errorf("corrupted string boundaries for index %d", index)
+	start, end := a.rowSpan(index)
+	if a.passthrough {
+		row, err := a.rawRange(start, end)
+		return len(row), err
+	}
+	if a.isValidated() {
+		return a.decodedLenUnchecked(start, end), nil
+	}
+	if start < 0 || end < start || end > a.tokenCount() {
+		return 0, corruptf("corrupted string boundaries for index %d", index)
+	}
+	if slots := a.fixedSlotTable(); slots != nil {
+		if n, ok := slots.decodedLen(a.CompressedData[start:end]); ok {
+			return n, nil
+		}
 	}
 
 	tokenBounds := a.TokenBoundaries
@@ -227,16 +307,17 @@ func (a *Archive) DecodedLen(index int) (int, error) {
 	boundsLen := len(tokenBounds)
 
 	n := 0
-	for tokenPos, tokenID := range a.CompressedData[start:end] {
-		absPos := start + tokenPos
+	for absPos := start; absPos < end; absPos++ {
+		tokenPos := absPos - start
+		tokenID := a.tokenAt(absPos)
 		tokenIdx := int(tokenID)
 		if tokenIdx+1 >= boundsLen {
-			return 0, fmt.Errorf("invalid token ID at row %d token %d (abs %d): %d", index, tokenPos, absPos, tokenID)
+			return 0, corruptf("invalid token ID at row %d token %d (abs %d): %d", index, tokenPos, absPos, tokenID)
 		}
 		tokenStart := tokenBounds[tokenIdx]
 		tokenEnd := tokenBounds[tokenIdx+1]
 		if tokenEnd > dictLen || tokenStart > tokenEnd {
-			return 0, fmt.Errorf("corrupted token boundaries at row %d token %d (abs %d) for ID %d", index, tokenPos, absPos, tokenID)
+			return 0, corruptf("corrupted token boundaries at row %d token %d (abs %d) for ID %d", index, tokenPos, absPos, tokenID)
 		}
 		tokenBytes := dictionary[tokenStart:tokenEnd]
 		n += len(tokenBytes)
@@ -247,13 +328,28 @@ func (a *Archive) DecodedLen(index int) (int, error) {
 // AppendRow appends the decoded string at index to dst.
 func (a *Archive) AppendRow(dst []byte, index int) ([]byte, error) {
 	if index < 0 || index >= a.Rows() {
-		return dst, fmt.Errorf("index out of bounds: %d", index)
+		return dst, fmt.Errorf("%w: %d", ErrIndexOutOfRange, index)
+	}
+	if a.IsDeleted(index) {
+		return dst, fmt.Errorf("%w: %d", ErrRowDeleted, index)
 	}
 
-	start := a.StringBoundaries[index]
-	end := a.StringBoundaries[index+1]
-	if start < 0 || end < start || end > len(a.CompressedData) {
-		return dst, fmt.Errorf("corrupted string boundaries for index %d", index)
+	start, end := a.rowSpan(index)
+	if a.passthrough {
+		row, err := a.rawRange(start, end)
+		return append(dst, row...), err
+	}
+	validated := a.isValidated()
+	if !validated && (start < 0 || end < start || end > a.tokenCount()) {
+		return dst, corruptf("corrupted string boundaries for index %d", index)
+	}
+	if slots := a.fixedSlotTable(); slots != nil {
+		if out, ok := slots.appendTokens(dst, a.CompressedData[start:end]); ok {
+			return out, nil
+		}
+	}
+	if validated {
+		return a.appendTokensUnchecked(dst, start, end), nil
 	}
 
 	tokenBounds := a.TokenBoundaries
@@ -261,16 +357,17 @@ func (a *Archive) AppendRow(dst []byte, index int) ([]byte, error) {
 	dictLen := uint32(len(dictionary))
 	boundsLen := len(tokenBounds)
 
-	for tokenPos, tokenID := range a.CompressedData[start:end] {
-		absPos := start + tokenPos
+	for absPos := start; absPos < end; absPos++ {
+		tokenPos := absPos - start
+		tokenID := a.tokenAt(absPos)
 		tokenIdx := int(tokenID)
 		if tokenIdx+1 >= boundsLen {
-			return dst, fmt.Errorf("invalid token ID at row %d token %d (abs %d): %d", index, tokenPos, absPos, tokenID)
+			return dst, corruptf("invalid token ID at row %d token %d (abs %d): %d", index, tokenPos, absPos, tokenID)
 		}
 		tokenStart := tokenBounds[tokenIdx]
 		tokenEnd := tokenBounds[tokenIdx+1]
 		if tokenEnd > dictLen || tokenStart > tokenEnd {
-			return dst, fmt.Errorf("corrupted token boundaries at row %d token %d (abs %d) for ID %d", index, tokenPos, absPos, tokenID)
+			return dst, corruptf("corrupted token boundaries at row %d token %d (abs %d) for ID %d", index, tokenPos, absPos, tokenID)
 		}
 		tokenBytes := dictionary[tokenStart:tokenEnd]
 		dst = append(dst, tokenBytes...)
@@ -278,22 +375,59 @@ func (a *Archive) AppendRow(dst []byte, index int) ([]byte, error) {
 	return dst, nil
 }
 
-// AppendAll appends all decoded strings to dst.
+// AppendAll appends all decoded strings to dst. Deleted rows are skipped.
 func (a *Archive) AppendAll(dst []byte) ([]byte, error) {
+	if a.tombstones == nil {
+		return a.appendTokenRange(dst, 0, a.tokenCount())
+	}
+
+	for index := 0; index < a.Rows(); index++ {
+		if a.IsDeleted(index) {
+			continue
+		}
+		start, end := a.rowSpan(index)
+		if start < 0 || end < start || end > a.tokenCount() {
+			return dst, corruptf("corrupted string boundaries for index %d", index)
+		}
+		var err error
+		dst, err = a.appendTokenRange(dst, start, end)
+		if err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// appendTokenRange appends the bytes of tokens [lo, hi) to dst.
+func (a *Archive) appendTokenRange(dst []byte, lo, hi int) ([]byte, error) {
+	if a.passthrough {
+		row, err := a.rawRange(lo, hi)
+		return append(dst, row...), err
+	}
+	if slots := a.fixedSlotTable(); slots != nil {
+		if out, ok := slots.appendTokens(dst, a.CompressedData[lo:hi]); ok {
+			return out, nil
+		}
+	}
+	if a.isValidated() {
+		return a.appendTokensUnchecked(dst, lo, hi), nil
+	}
+
 	tokenBounds := a.TokenBoundaries
 	dictionary := a.Dictionary
 	dictLen := uint32(len(dictionary))
 	boundsLen := len(tokenBounds)
 
-	for tokenPos, tokenID := range a.CompressedData {
+	for tokenPos := lo; tokenPos < hi; tokenPos++ {
+		tokenID := a.tokenAt(tokenPos)
 		tokenIdx := int(tokenID)
 		if tokenIdx+1 >= boundsLen {
-			return dst, fmt.Errorf("invalid token ID at token %d: %d", tokenPos, tokenID)
+			return dst, corruptf("invalid token ID at token %d: %d", tokenPos, tokenID)
 		}
 		tokenStart := tokenBounds[tokenIdx]
 		tokenEnd := tokenBounds[tokenIdx+1]
 		if tokenEnd > dictLen || tokenStart > tokenEnd {
-			return dst, fmt.Errorf("corrupted token boundaries at token %d for ID %d", tokenPos, tokenID)
+			return dst, corruptf("corrupted token boundaries at token %d for ID %d", tokenPos, tokenID)
 		}
 		tokenBytes := dictionary[tokenStart:tokenEnd]
 		dst = append(dst, tokenBytes...)
@@ -301,15 +435,32 @@ func (a *Archive) AppendAll(dst []byte) ([]byte, error) {
 	return dst, nil
 }
 
-// DecompressString decompresses a specific string into buffer.
+// DecompressString decompresses a specific string into buffer. Bytes of
+// buffer past the returned length may be overwritten.
 func (a *Archive) DecompressString(index int, buffer []byte) (int, error) {
 	if index < 0 || index >= a.Rows() {
-		return 0, fmt.Errorf("index out of bounds: %d", index)
+		return 0, fmt.Errorf("%w: %d", ErrIndexOutOfRange, index)
+	}
+	if a.IsDeleted(index) {
+		return 0, fmt.Errorf("%w: %d", ErrRowDeleted, index)
 	}
-	start := a.StringBoundaries[index]
-	end := a.StringBoundaries[index+1]
-	if start < 0 || end < start || end > len(a.CompressedData) {
-		return 0, fmt.Errorf("corrupted string boundaries for index %d", index)
+	start, end := a.rowSpan(index)
+	if a.passthrough {
+		return a.copyTokenRange(buffer, 0, start, end)
+	}
+	validated := a.isValidated()
+	if !validated && (start < 0 || end < start || end > a.tokenCount()) {
+		return 0, corruptf("corrupted string boundaries for index %d", index)
+	}
+	if slots := a.fixedSlotTable(); slots != nil {
+		if n, ok := slots.decode(buffer, a.CompressedData[start:end]); ok {
+			return n, nil
+		}
+	}
+	if validated {
+		if n, ok := a.copyTokensUnchecked(buffer, 0, start, end); ok {
+			return n, nil
+		}
 	}
 
 	tokenBounds := a.TokenBoundaries
@@ -318,16 +469,17 @@ func (a *Archive) DecompressString(index int, buffer []byte) (int, error) {
 	boundsLen := len(tokenBounds)
 
 	offset := 0
-	for tokenPos, tokenID := range a.CompressedData[start:end] {
-		absPos := start + tokenPos
+	for absPos := start; absPos < end; absPos++ {
+		tokenPos := absPos - start
+		tokenID := a.tokenAt(absPos)
 		tokenIdx := int(tokenID)
 		if tokenIdx+1 >= boundsLen {
-			return 0, fmt.Errorf("invalid token ID at row %d token %d (abs %d): %d", index, tokenPos, absPos, tokenID)
+			return 0, corruptf("invalid token ID at row %d token %d (abs %d): %d", index, tokenPos, absPos, tokenID)
 		}
 		tokenStart := tokenBounds[tokenIdx]
 		tokenEnd := tokenBounds[tokenIdx+1]
 		if tokenEnd > dictLen || tokenStart > tokenEnd {
-			return 0, fmt.Errorf("corrupted token boundaries at row %d token %d (abs %d) for ID %d", index, tokenPos, absPos, tokenID)
+			return 0, corruptf("corrupted token boundaries at row %d token %d (abs %d) for ID %d", index, tokenPos, absPos, tokenID)
 		}
 		tokenBytes := dictionary[tokenStart:tokenEnd]
 		if offset+len(tokenBytes) > len(buffer) {
@@ -340,22 +492,70 @@ func (a *Archive) DecompressString(index int, buffer []byte) (int, error) {
 }
 
 // DecompressAllChecked decompresses all strings into a single buffer.
+// Bytes of buffer past the returned length may be overwritten.
+// Deleted rows are skipped.
 func (a *Archive) DecompressAllChecked(buffer []byte) (int, error) {
+	if a.tombstones == nil {
+		return a.copyTokenRange(buffer, 0, 0, a.tokenCount())
+	}
+
+	offset := 0
+	for index := 0; index < a.Rows(); index++ {
+		if a.IsDeleted(index) {
+			continue
+		}
+		start, end := a.rowSpan(index)
+		if start < 0 || end < start || end > a.tokenCount() {
+			return 0, corruptf("corrupted string boundaries for index %d", index)
+		}
+		var err error
+		offset, err = a.copyTokenRange(buffer, offset, start, end)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// copyTokenRange decodes tokens [lo, hi) into buffer starting at offset
+// and returns the new offset.
+func (a *Archive) copyTokenRange(buffer []byte, offset, lo, hi int) (int, error) {
+	if a.passthrough {
+		row, err := a.rawRange(lo, hi)
+		if err != nil {
+			return 0, err
+		}
+		if offset+len(row) > len(buffer) {
+			return 0, fmt.Errorf("%w at byte %d: need %d bytes, have %d", ErrShortBuffer, lo, offset+len(row), len(buffer))
+		}
+		return offset + copy(buffer[offset:], row), nil
+	}
+	if slots := a.fixedSlotTable(); slots != nil {
+		if n, ok := slots.decode(buffer[offset:], a.CompressedData[lo:hi]); ok {
+			return offset + n, nil
+		}
+	}
+	if a.isValidated() {
+		if next, ok := a.copyTokensUnchecked(buffer, offset, lo, hi); ok {
+			return next, nil
+		}
+	}
+
 	tokenBounds := a.TokenBoundaries
 	dictionary := a.Dictionary
 	dictLen := uint32(len(dictionary))
 	boundsLen := len(tokenBounds)
 
-	offset := 0
-	for tokenPos, tokenID := range a.CompressedData {
+	for tokenPos := lo; tokenPos < hi; tokenPos++ {
+		tokenID := a.tokenAt(tokenPos)
 		tokenIdx := int(tokenID)
 		if tokenIdx+1 >= boundsLen {
-			return 0, fmt.Errorf("invalid token ID at token %d: %d", tokenPos, tokenID)
+			return 0, corruptf("invalid token ID at token %d: %d", tokenPos, tokenID)
 		}
 		tokenStart := tokenBounds[tokenIdx]
 		tokenEnd := tokenBounds[tokenIdx+1]
 		if tokenEnd > dictLen || tokenStart > tokenEnd {
-			return 0, fmt.Errorf("corrupted token boundaries at token %d for ID %d", tokenPos, tokenID)
+			return 0, corruptf("corrupted token boundaries at token %d for ID %d", tokenPos, tokenID)
 		}
 		tokenBytes := dictionary[tokenStart:tokenEnd]
 		if offset+len(tokenBytes) > len(buffer) {
@@ -369,110 +569,40 @@ func (a *Archive) DecompressAllChecked(buffer []byte) (int, error) {
 
 // SpaceUsed returns the total space (in bytes) used by the archive.
 func (a *Archive) SpaceUsed() int {
-	compressedBytes := len(a.CompressedData) * 2
-	if a.tokenBitWidth() == tokenBitWidth12 {
-		compressedBytes = packed12ByteSize(len(a.CompressedData))
-	}
+	compressedBytes := packedByteSize(a.tokenCount(), a.tokenBitWidth())
 
 	return compressedBytes +
 		len(a.Dictionary) +
 		len(a.TokenBoundaries)*4
 }
 
-func encodeCompressedDataStage(a *Archive) ([]byte, uint8, error) {
-	if len(a.CompressedData) > maxCompressedTokenRead {
-		return nil, 0, fmt.Errorf("compressed token count too large: %d", len(a.CompressedData))
-	}
-
-	var (
-		rawPayload        []byte
-		rawParam          uint8
-		flateParam        uint8
-		codebookParam     uint8
-		codebookFlateParm uint8
-		encodeRawErr      error
-	)
-	switch a.tokenBitWidth() {
-	case tokenBitWidth12:
-		rawPayload, encodeRawErr = encodeCompressedDataStage12(a.CompressedData)
-		rawParam = stageCompressedDataParamWidth12
-		flateParam = stageCompressedDataParamWidth12Flate
-		codebookParam = stageCompressedDataParamWidth12Codebook
-		codebookFlateParm = stageCompressedDataParamWidth12CodebookFlate
-	case tokenBitWidth16:
-		rawPayload, encodeRawErr = encodeCompressedDataStage16(a.CompressedData)
-		rawParam = stageCompressedDataParamWidth16
-		flateParam = stageCompressedDataParamWidth16Flate
-		codebookParam = stageCompressedDataParamWidth16Codebook
-		codebookFlateParm = stageCompressedDataParamWidth16CodebookFlate
-	default:
-		return nil, 0, fmt.Errorf("unsupported token bit-width: %d", a.compressedTokenBitWidth)
-	}
-	if encodeRawErr != nil {
-		return nil, 0, encodeRawErr
-	}
-
-	type candidate struct {
-		payload []byte
-		param   uint8
-	}
-	candidates := []candidate{
-		{payload: rawPayload, param: rawParam},
-	}
-
-	flatePayload, err := encodeFlatePayload(rawPayload)
+// encodeCompressedDataStage encodes the token stream like tokenStreamStage
+// and returns the payload and params.
+func encodeCompressedDataStage(a *Archive, encoding TokenEncoding, flateLevel int, version uint16) ([]byte, []byte, error) {
+	stage, err := tokenStreamStage(a, encoding, flateLevel, version)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
-	candidates = append(candidates, candidate{payload: flatePayload, param: flateParam})
-
-	codebookPayload, codebookErr := encodeCompressedDataStageCodebook(a.CompressedData, a.tokenBitWidth())
-	if codebookErr == nil {
-		candidates = append(candidates, candidate{payload: codebookPayload, param: codebookParam})
-
-		flateCodebook, err := encodeFlatePayload(codebookPayload)
-		if err != nil {
-			return nil, 0, err
-		}
-		candidates = append(candidates, candidate{payload: flateCodebook, param: codebookFlateParm})
-	}
-
-	best := candidates[0]
-	for _, candidate := range candidates[1:] {
-		if len(candidate.payload) < len(best.payload) {
-			best = candidate
-		}
-	}
-	return best.payload, best.param, nil
-}
-
-func encodeFlatePayload(raw []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	payload, err := stage.bytes()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if _, err := w.Write(raw); err != nil {
-		_ = w.Close()
-		return nil, err
-	}
-	if err := w.Close(); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return payload, stage.params, nil
 }
 
-func decodeFlatePayload(payload []byte) ([]byte, error) {
+// decodeFlatePayload inflates payload, failing with ErrLimitExceeded if it
+// expands beyond maxBytes.
+func decodeFlatePayload(payload []byte, maxBytes int) ([]byte, error) {
 	r := flate.NewReader(bytes.NewReader(payload))
 	defer r.Close()
 
-	limited := io.LimitReader(r, maxStagePayloadBytes+1)
+	limited := io.LimitReader(r, int64(maxBytes)+1)
 	raw, err := io.ReadAll(limited)
 	if err != nil {
 		return nil, err
 	}
-	if len(raw) > maxStagePayloadBytes {
-		return nil, fmt.Errorf("flate payload expands beyond limit")
+	if len(raw) > maxBytes {
+		return nil, fmt.Errorf("%w: flate payload expands beyond %d bytes", ErrLimitExceeded, maxBytes)
 	}
 	return raw, nil
 }
@@ -482,27 +612,16 @@ type tokenFrequency struct {
 	count   uint32
 }
 
-func encodeCompressedDataStageCodebook(compressed []uint16, tokenBitWidth uint8) ([]byte, error) {
-	if len(compressed) > maxCompressedTokenRead {
-		return nil, fmt.Errorf("compressed token count too large: %d", len(compressed))
-	}
-
-	var maxTokenID uint16
-	for i, tokenID := range compressed {
-		if tokenBitWidth == tokenBitWidth12 && tokenID > maxTokenID12Bit {
-			return nil, fmt.Errorf("compressed token out of 12-bit range at index %d: %d", i, tokenID)
-		}
-		if tokenID > maxTokenID {
-			maxTokenID = tokenID
-		}
-	}
-
-	counts := make([]uint32, int(maxTokenID)+1)
-	for _, tokenID := range compressed {
-		counts[tokenID]++
+// codebookTokenStream returns the codebook compressed_data stage: the 255
+// most frequent tokens as single-byte codes, the rest escaped. The codebook
+// and size come from the token counts; the stream is coded as it is written.
+func codebookTokenStream(a *Archive, tokenBitWidth uint8) (streamStage, error) {
+	counts, err := streamTokenCounts(a, tokenBitWidth)
+	if err != nil {
+		return streamStage{}, err
 	}
 
-	frequencies := make([]tokenFrequency, 0, len(counts))
+	var frequencies []tokenFrequency
 	for tokenID, count := range counts {
 		if count == 0 {
 			continue
@@ -533,44 +652,51 @@ func encodeCompressedDataStageCodebook(compressed []uint16, tokenBitWidth uint8)
 	}
 
 	payloadLen := uint64(4 + 2 + codebookLen*2)
-	for _, tokenID := range compressed {
-		if codeByToken[tokenID] == compressedDataCodebookEscapeByte {
-			payloadLen += 3
+	for _, f := range frequencies {
+		if codeByToken[f.tokenID] == compressedDataCodebookEscapeByte {
+			payloadLen += 3 * uint64(f.count)
 			continue
 		}
-		payloadLen++
+		payloadLen += uint64(f.count)
 	}
 	if payloadLen > uint64(maxStagePayloadBytes) {
-		return nil, fmt.Errorf("compressed_data codebook payload too large: %d", payloadLen)
-	}
-
-	payload := make([]byte, int(payloadLen))
-	binary.LittleEndian.PutUint32(payload[:4], uint32(len(compressed)))
-	binary.LittleEndian.PutUint16(payload[4:6], uint16(codebookLen))
-
-	outIdx := 6
-	for i := 0; i < codebookLen; i++ {
-		binary.LittleEndian.PutUint16(payload[outIdx:outIdx+2], frequencies[i].tokenID)
-		outIdx += 2
-	}
-
-	for _, tokenID := range compressed {
-		code := codeByToken[tokenID]
-		if code != compressedDataCodebookEscapeByte {
-			payload[outIdx] = code
-			outIdx++
-			continue
-		}
-		payload[outIdx] = compressedDataCodebookEscapeByte
-		outIdx++
-		binary.LittleEndian.PutUint16(payload[outIdx:outIdx+2], tokenID)
-		outIdx += 2
-	}
-
-	if outIdx != len(payload) {
-		return nil, fmt.Errorf("compressed_data codebook payload mismatch: wrote %d bytes, expected %d", outIdx, len(payload))
-	}
-	return payload, nil
+		return streamStage{}, fmt.Errorf("compressed_data codebook payload too large: %d", payloadLen)
+	}
+
+	return streamStage{
+		name:   stageCompressedData,
+		params: compressedDataParams(compressedDataEncodingCodebook, tokenBitWidth),
+		size:   int(payloadLen),
+		write: func(w io.Writer) error {
+			buf := make([]byte, 0, streamBufferSize)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(a.tokenCount()))
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(codebookLen))
+			for i := 0; i < codebookLen; i++ {
+				buf = binary.LittleEndian.AppendUint16(buf, frequencies[i].tokenID)
+			}
+			err := a.forEachTokenChunk(func(_ int, tokens []uint16) error {
+				for _, tokenID := range tokens {
+					if len(buf)+3 > cap(buf) {
+						if _, err := writeBytes(w, buf); err != nil {
+							return err
+						}
+						buf = buf[:0]
+					}
+					code := codeByToken[tokenID]
+					buf = append(buf, code)
+					if code == compressedDataCodebookEscapeByte {
+						buf = binary.LittleEndian.AppendUint16(buf, tokenID)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			_, err = writeBytes(w, buf)
+			return err
+		},
+	}, nil
 }
 
 func decodeCompressedDataStageCodebook(payload []byte, tokenBitWidth uint8) ([]uint16, error) {
@@ -593,13 +719,14 @@ func decodeCompressedDataStageCodebook(payload []byte, tokenBitWidth uint8) ([]u
 		return nil, fmt.Errorf("compressed_data codebook payload too short for dictionary: %d", len(payload))
 	}
 
+	widthLimit := maxTokenIDForBitWidth(tokenBitWidth)
 	codebook := make([]uint16, codebookLen)
 	inIdx := 6
 	for i := 0; i < codebookLen; i++ {
 		tokenID := binary.LittleEndian.Uint16(payload[inIdx : inIdx+2])
 		inIdx += 2
-		if tokenBitWidth == tokenBitWidth12 && tokenID > maxTokenID12Bit {
-			return nil, fmt.Errorf("compressed_data codebook token out of 12-bit range at code %d: %d", i, tokenID)
+		if tokenID > widthLimit {
+			return nil, fmt.Errorf("compressed_data codebook token out of %d-bit range at code %d: %d", tokenBitWidth, i, tokenID)
 		}
 		codebook[i] = tokenID
 	}
@@ -628,8 +755,8 @@ func decodeCompressedDataStageCodebook(payload []byte, tokenBitWidth uint8) ([]u
 		}
 		tokenID := binary.LittleEndian.Uint16(stream[inIdx : inIdx+2])
 		inIdx += 2
-		if tokenBitWidth == tokenBitWidth12 && tokenID > maxTokenID12Bit {
-			return nil, fmt.Errorf("compressed_data codebook escape token out of 12-bit range at token %d: %d", i, tokenID)
+		if tokenID > widthLimit {
+			return nil, fmt.Errorf("compressed_data codebook escape token out of %d-bit range at token %d: %d", tokenBitWidth, i, tokenID)
 		}
 		compressedData[i] = tokenID
 	}
@@ -640,263 +767,65 @@ func decodeCompressedDataStageCodebook(payload []byte, tokenBitWidth uint8) ([]u
 	return compressedData, nil
 }
 
-func encodeCompressedDataStage16(compressed []uint16) ([]byte, error) {
-	var buf bytes.Buffer
-	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(compressed))); err != nil {
-		return nil, err
-	}
-	if err := binary.Write(&buf, binary.LittleEndian, compressed); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-func encodeCompressedDataStage12(compressed []uint16) ([]byte, error) {
-	for i, tokenID := range compressed {
-		if tokenID > maxTokenID12Bit {
-			return nil, fmt.Errorf("compressed token out of 12-bit range at index %d: %d", i, tokenID)
-		}
-	}
-
-	packedLen := packed12ByteSize(len(compressed))
-	payload := make([]byte, 4+packedLen)
-	binary.LittleEndian.PutUint32(payload[:4], uint32(len(compressed)))
-	packed := payload[4:]
-
-	outIdx := 0
+// appendPackedTokens appends tokens packed LSB-first at bitWidth bits each,
+// padding the final byte with zero bits. base is the stream position of
+// tokens[0], used in range errors.
+func appendPackedTokens(dst []byte, tokens []uint16, bitWidth uint8, base int) ([]byte, error) {
+	widthLimit := maxTokenIDForBitWidth(bitWidth)
 	var bitBuf uint32
 	bitsInBuf := 0
-	for _, tokenID := range compressed {
+	for i, tokenID := range tokens {
+		if tokenID > widthLimit {
+			return dst, fmt.Errorf("compressed token out of %d-bit range at index %d: %d", bitWidth, base+i, tokenID)
+		}
 		bitBuf |= uint32(tokenID) << bitsInBuf
-		bitsInBuf += int(tokenBitWidth12)
+		bitsInBuf += int(bitWidth)
 		for bitsInBuf >= 8 {
-			packed[outIdx] = byte(bitBuf)
-			outIdx++
+			dst = append(dst, byte(bitBuf))
 			bitBuf >>= 8
 			bitsInBuf -= 8
 		}
 	}
 	if bitsInBuf > 0 {
-		packed[outIdx] = byte(bitBuf)
-		outIdx++
-	}
-	if outIdx != len(packed) {
-		return nil, fmt.Errorf("packed 12-bit payload mismatch: wrote %d bytes, expected %d", outIdx, len(packed))
-	}
-
-	return payload, nil
-}
-
-func encodeStringBoundariesStage(a *Archive) ([]byte, error) {
-	if len(a.StringBoundaries) > maxBoundaryCountRead {
-		return nil, fmt.Errorf("string boundary count too large: %d", len(a.StringBoundaries))
-	}
-
-	var buf bytes.Buffer
-	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(a.StringBoundaries))); err != nil {
-		return nil, err
-	}
-
-	if len(a.StringBoundaries) == 0 {
-		return buf.Bytes(), nil
-	}
-	if a.StringBoundaries[0] < 0 {
-		return nil, fmt.Errorf("first string boundary is negative: %d", a.StringBoundaries[0])
-	}
-	if uint64(a.StringBoundaries[0]) > maxStringBoundaryValue {
-		return nil, fmt.Errorf("first string boundary exceeds max supported value: %d", a.StringBoundaries[0])
-	}
-	if err := binary.Write(&buf, binary.LittleEndian, uint64(a.StringBoundaries[0])); err != nil {
-		return nil, err
-	}
-
-	deltaBuf := make([]byte, 0, len(a.StringBoundaries)*2)
-	varintBuf := make([]byte, binary.MaxVarintLen64)
-	for i := 1; i < len(a.StringBoundaries); i++ {
-		delta := a.StringBoundaries[i] - a.StringBoundaries[i-1]
-		if delta < 0 {
-			return nil, fmt.Errorf("string boundaries not monotonic at index %d", i)
-		}
-		n := binary.PutUvarint(varintBuf, uint64(delta))
-		deltaBuf = append(deltaBuf, varintBuf[:n]...)
-	}
-
-	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(deltaBuf))); err != nil {
-		return nil, err
-	}
-	if _, err := buf.Write(deltaBuf); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-func encodeDictionaryStage(a *Archive) ([]byte, error) {
-	if len(a.Dictionary) > maxStagePayloadBytes {
-		return nil, fmt.Errorf("dictionary too large: %d", len(a.Dictionary))
+		dst = append(dst, byte(bitBuf))
 	}
-
-	var buf bytes.Buffer
-	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(a.Dictionary))); err != nil {
-		return nil, err
-	}
-	if _, err := buf.Write(a.Dictionary); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return dst, nil
 }
 
-func encodeTokenBoundariesStage(a *Archive) ([]byte, uint8, error) {
-	if len(a.TokenBoundaries) > maxTokenBoundsRead {
-		return nil, 0, fmt.Errorf("token boundary count too large: %d", len(a.TokenBoundaries))
-	}
-
-	rawPayload, err := encodeTokenBoundariesStageRaw(a.TokenBoundaries)
-	if err != nil {
-		return nil, 0, err
-	}
-	deltaPayload, err := encodeTokenBoundariesStageDelta(a.TokenBoundaries)
+func decodeCompressedDataStage(dst *Archive, params []byte, payload []byte, limits readLimits) error {
+	encoding, bitWidth, err := parseCompressedDataParams(params)
 	if err != nil {
-		return nil, 0, err
-	}
-	if len(deltaPayload) < len(rawPayload) {
-		return deltaPayload, stageTokenBoundariesParamDelta, nil
-	}
-	return rawPayload, stageTokenBoundariesParamWidth, nil
-}
-
-func encodeTokenBoundariesStageRaw(bounds []uint32) ([]byte, error) {
-	var buf bytes.Buffer
-	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(bounds))); err != nil {
-		return nil, err
-	}
-	if err := binary.Write(&buf, binary.LittleEndian, bounds); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-func encodeTokenBoundariesStageDelta(bounds []uint32) ([]byte, error) {
-	var buf bytes.Buffer
-	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(bounds))); err != nil {
-		return nil, err
-	}
-
-	if len(bounds) == 0 {
-		return buf.Bytes(), nil
-	}
-	if err := binary.Write(&buf, binary.LittleEndian, bounds[0]); err != nil {
-		return nil, err
+		return err
 	}
 
-	deltaBuf := make([]byte, 0, len(bounds)*2)
-	varintBuf := make([]byte, binary.MaxVarintLen64)
-	for i := 1; i < len(bounds); i++ {
-		if bounds[i] < bounds[i-1] {
-			return nil, fmt.Errorf("token boundaries not monotonic at index %d", i)
+	if encoding == compressedDataEncodingFlate || encoding == compressedDataEncodingCodebookFlate {
+		payload, err = decodeFlatePayload(payload, limits.stageBytes)
+		if err != nil {
+			return err
 		}
-		delta := bounds[i] - bounds[i-1]
-		n := binary.PutUvarint(varintBuf, uint64(delta))
-		deltaBuf = append(deltaBuf, varintBuf[:n]...)
 	}
-
-	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(deltaBuf))); err != nil {
-		return nil, err
-	}
-	if _, err := buf.Write(deltaBuf); err != nil {
-		return nil, err
+	// Every compressed_data encoding starts with its uint32 token count.
+	if len(payload) >= 4 {
+		if size := int64(binary.LittleEndian.Uint32(payload)) * 2; size > int64(limits.stageBytes) {
+			return limitExceeded("decoded compressed_data size", size, int64(limits.stageBytes))
+		}
 	}
-	return buf.Bytes(), nil
-}
 
-func decodeCompressedDataStage(dst *Archive, params []byte, payload []byte) error {
-	if len(params) != 1 {
-		return fmt.Errorf("invalid compressed_data params: %v", params)
+	var compressedData []uint16
+	switch encoding {
+	case compressedDataEncodingRaw, compressedDataEncodingFlate:
+		compressedData, err = decodeCompressedDataStagePacked(payload, bitWidth)
+	case compressedDataEncodingCodebook, compressedDataEncodingCodebookFlate:
+		compressedData, err = decodeCompressedDataStageCodebook(payload, bitWidth)
+	case compressedDataEncodingHuffman:
+		compressedData, err = decodeCompressedDataStageHuffman(payload, bitWidth)
 	}
-
-	switch params[0] {
-	case stageCompressedDataParamWidth16:
-		compressedData, err := decodeCompressedDataStage16(payload)
-		if err != nil {
-			return err
-		}
-		dst.CompressedData = compressedData
-		dst.compressedTokenBitWidth = tokenBitWidth16
-		return nil
-	case stageCompressedDataParamWidth12:
-		compressedData, err := decodeCompressedDataStage12(payload)
-		if err != nil {
-			return err
-		}
-		dst.CompressedData = compressedData
-		dst.compressedTokenBitWidth = tokenBitWidth12
-		return nil
-	case stageCompressedDataParamWidth16Flate:
-		rawPayload, err := decodeFlatePayload(payload)
-		if err != nil {
-			return err
-		}
-		compressedData, err := decodeCompressedDataStage16(rawPayload)
-		if err != nil {
-			return err
-		}
-		dst.CompressedData = compressedData
-		dst.compressedTokenBitWidth = tokenBitWidth16
-		return nil
-	case stageCompressedDataParamWidth12Flate:
-		rawPayload, err := decodeFlatePayload(payload)
-		if err != nil {
-			return err
-		}
-		compressedData, err := decodeCompressedDataStage12(rawPayload)
-		if err != nil {
-			return err
-		}
-		dst.CompressedData = compressedData
-		dst.compressedTokenBitWidth = tokenBitWidth12
-		return nil
-	case stageCompressedDataParamWidth16Codebook:
-		compressedData, err := decodeCompressedDataStageCodebook(payload, tokenBitWidth16)
-		if err != nil {
-			return err
-		}
-		dst.CompressedData = compressedData
-		dst.compressedTokenBitWidth = tokenBitWidth16
-		return nil
-	case stageCompressedDataParamWidth16CodebookFlate:
-		rawPayload, err := decodeFlatePayload(payload)
-		if err != nil {
-			return err
-		}
-		compressedData, err := decodeCompressedDataStageCodebook(rawPayload, tokenBitWidth16)
-		if err != nil {
-			return err
-		}
-		dst.CompressedData = compressedData
-		dst.compressedTokenBitWidth = tokenBitWidth16
-		return nil
-	case stageCompressedDataParamWidth12Codebook:
-		compressedData, err := decodeCompressedDataStageCodebook(payload, tokenBitWidth12)
-		if err != nil {
-			return err
-		}
-		dst.CompressedData = compressedData
-		dst.compressedTokenBitWidth = tokenBitWidth12
-		return nil
-	case stageCompressedDataParamWidth12CodebookFlate:
-		rawPayload, err := decodeFlatePayload(payload)
-		if err != nil {
-			return err
-		}
-		compressedData, err := decodeCompressedDataStageCodebook(rawPayload, tokenBitWidth12)
-		if err != nil {
-			return err
-		}
-		dst.CompressedData = compressedData
-		dst.compressedTokenBitWidth = tokenBitWidth12
-		return nil
-	default:
-		return fmt.Errorf("invalid compressed_data params: %v", params)
+	if err != nil {
+		return err
 	}
+	dst.CompressedData = compressedData
+	dst.compressedTokenBitWidth = bitWidth
+	return nil
 }
 
 func decodeCompressedDataStage16(payload []byte) ([]uint16, error) {
@@ -927,7 +856,10 @@ func decodeCompressedDataStage16(payload []byte) ([]uint16, error) {
 	return compressedData, nil
 }
 
-func decodeCompressedDataStage12(payload []byte) ([]uint16, error) {
+func decodeCompressedDataStagePacked(payload []byte, bitWidth uint8) ([]uint16, error) {
+	if bitWidth == tokenBitWidth16 {
+		return decodeCompressedDataStage16(payload)
+	}
 	if len(payload) < 4 {
 		return nil, fmt.Errorf("compressed_data payload too short: %d", len(payload))
 	}
@@ -941,7 +873,7 @@ func decodeCompressedDataStage12(payload []byte) ([]uint16, error) {
 		return nil, fmt.Errorf("compressed token count too large: %d", compressedLen)
 	}
 
-	expectedBytes := packed12ByteSize(int(compressedLen))
+	expectedBytes := packedByteSize(int(compressedLen), bitWidth)
 	if r.Len() != expectedBytes {
 		return nil, fmt.Errorf("compressed_data length mismatch: payload=%d expected=%d", r.Len(), expectedBytes)
 	}
@@ -955,32 +887,33 @@ func decodeCompressedDataStage12(payload []byte) ([]uint16, error) {
 	}
 
 	compressedData := make([]uint16, compressedLen)
+	mask := uint32(maxTokenIDForBitWidth(bitWidth))
 	inIdx := 0
 	var bitBuf uint32
 	bitsInBuf := 0
 	for i := 0; i < len(compressedData); i++ {
-		for bitsInBuf < int(tokenBitWidth12) {
+		for bitsInBuf < int(bitWidth) {
 			if inIdx >= len(packed) {
-				return nil, fmt.Errorf("compressed_data 12-bit payload underrun at token %d", i)
+				return nil, fmt.Errorf("compressed_data %d-bit payload underrun at token %d", bitWidth, i)
 			}
 			bitBuf |= uint32(packed[inIdx]) << bitsInBuf
 			inIdx++
 			bitsInBuf += 8
 		}
-		compressedData[i] = uint16(bitBuf & uint32(maxTokenID12Bit))
-		bitBuf >>= tokenBitWidth12
-		bitsInBuf -= int(tokenBitWidth12)
+		compressedData[i] = uint16(bitBuf & mask)
+		bitBuf >>= bitWidth
+		bitsInBuf -= int(bitWidth)
 	}
 	if inIdx != len(packed) {
-		return nil, fmt.Errorf("compressed_data 12-bit payload overrun: used %d bytes, have %d", inIdx, len(packed))
+		return nil, fmt.Errorf("compressed_data %d-bit payload overrun: used %d bytes, have %d", bitWidth, inIdx, len(packed))
 	}
 	if bitBuf != 0 {
-		return nil, fmt.Errorf("compressed_data 12-bit payload has non-zero padding")
+		return nil, fmt.Errorf("compressed_data %d-bit payload has non-zero padding", bitWidth)
 	}
 	return compressedData, nil
 }
 
-func decodeStringBoundariesStage(dst *Archive, params []byte, payload []byte) error {
+func decodeStringBoundariesStage(dst *Archive, params []byte, payload []byte, limits readLimits) error {
 	if len(params) != 1 || params[0] != stageStringBoundariesParamDelta {
 		return fmt.Errorf("invalid string_boundaries params: %v", params)
 	}
@@ -996,6 +929,12 @@ func decodeStringBoundariesStage(dst *Archive, params []byte, payload []byte) er
 	if boundariesLen > uint32(maxBoundaryCountRead) {
 		return fmt.Errorf("string boundary count too large: %d", boundariesLen)
 	}
+	if rows := int64(boundariesLen) - 1; rows > int64(limits.rows) {
+		return limitExceeded("row count", rows, int64(limits.rows))
+	}
+	if size := int64(boundariesLen) * 8; size > int64(limits.stageBytes) {
+		return limitExceeded("decoded string_boundaries size", size, int64(limits.stageBytes))
+	}
 
 	if boundariesLen == 0 {
 		if r.Len() != 0 {
@@ -1059,7 +998,15 @@ func decodeStringBoundariesStage(dst *Archive, params []byte, payload []byte) er
 	return nil
 }
 
-func decodeDictionaryStage(dst *Archive, params []byte, payload []byte) error {
+func decodeDictionaryStage(dst *Archive, params []byte, payload []byte, limits readLimits) error {
+	if dictionaryParentsParams(params) {
+		dictionary, err := decodeDictionaryParents(payload, limits.dictionaryBytes)
+		if err != nil {
+			return err
+		}
+		dst.Dictionary = dictionary
+		return nil
+	}
 	if len(params) != 0 {
 		return fmt.Errorf("invalid dictionary params: %v", params)
 	}
@@ -1075,6 +1022,9 @@ func decodeDictionaryStage(dst *Archive, params []byte, payload []byte) error {
 	if dictLen > uint32(maxStagePayloadBytes) {
 		return fmt.Errorf("dictionary length too large: %d", dictLen)
 	}
+	if int64(dictLen) > int64(limits.dictionaryBytes) {
+		return limitExceeded("dictionary size", int64(dictLen), int64(limits.dictionaryBytes))
+	}
 	if r.Len() != int(dictLen) {
 		return fmt.Errorf("dictionary length mismatch: payload=%d expected=%d", r.Len(), dictLen)
 	}
@@ -1090,10 +1040,16 @@ func decodeDictionaryStage(dst *Archive, params []byte, payload []byte) error {
 	return nil
 }
 
-func decodeTokenBoundariesStage(dst *Archive, params []byte, payload []byte) error {
+func decodeTokenBoundariesStage(dst *Archive, params []byte, payload []byte, limits readLimits) error {
 	if len(params) != 1 {
 		return fmt.Errorf("invalid token_boundaries params: %v", params)
 	}
+	// Both token_boundaries encodings start with their uint32 count.
+	if len(payload) >= 4 {
+		if size := int64(binary.LittleEndian.Uint32(payload)) * 4; size > int64(limits.stageBytes) {
+			return limitExceeded("decoded token_boundaries size", size, int64(limits.stageBytes))
+		}
+	}
 
 	switch params[0] {
 	case stageTokenBoundariesParamWidth:
@@ -1211,186 +1167,92 @@ func decodeTokenBoundariesStageDelta(payload []byte) ([]uint32, error) {
 	return tokenBoundaries, nil
 }
 
-func validateArchiveStructure(a *Archive) error {
-	if a.compressedTokenBitWidth != 0 &&
-		a.compressedTokenBitWidth != tokenBitWidth12 &&
-		a.compressedTokenBitWidth != tokenBitWidth16 {
-		return fmt.Errorf("invalid token bit-width: %d", a.compressedTokenBitWidth)
-	}
-
-	if len(a.StringBoundaries) == 0 {
-		return fmt.Errorf("string boundaries must contain at least one entry")
-	}
-	if a.StringBoundaries[0] != 0 {
-		return fmt.Errorf("first string boundary must be 0: %d", a.StringBoundaries[0])
+func decodeTombstonesStage(dst *Archive, params []byte, payload []byte, limits readLimits) error {
+	if len(params) != 1 || params[0] != stageTombstonesParamBitmap {
+		return fmt.Errorf("invalid tombstones params: %v", params)
 	}
-	for i := 1; i < len(a.StringBoundaries); i++ {
-		if a.StringBoundaries[i] < a.StringBoundaries[i-1] {
-			return fmt.Errorf("string boundaries not monotonic at index %d", i)
-		}
-	}
-	if last := a.StringBoundaries[len(a.StringBoundaries)-1]; last > len(a.CompressedData) {
-		return fmt.Errorf("string boundary %d out of range for %d tokens", last, len(a.CompressedData))
+	if len(payload) < 4 {
+		return fmt.Errorf("tombstones payload too short: %d", len(payload))
 	}
 
-	if len(a.TokenBoundaries) == 0 {
-		return fmt.Errorf("token boundaries must contain at least one entry")
+	rows := binary.LittleEndian.Uint32(payload[:4])
+	if rows > uint32(maxBoundaryCountRead) {
+		return fmt.Errorf("tombstone row count too large: %d", rows)
 	}
-	if a.TokenBoundaries[0] != 0 {
-		return fmt.Errorf("first token boundary must be 0: %d", a.TokenBoundaries[0])
+	if int64(rows) > int64(limits.rows) {
+		return limitExceeded("tombstone row count", int64(rows), int64(limits.rows))
 	}
-	for i := 1; i < len(a.TokenBoundaries); i++ {
-		if a.TokenBoundaries[i] < a.TokenBoundaries[i-1] {
-			return fmt.Errorf("token boundaries not monotonic at index %d", i)
-		}
-	}
-	if last := a.TokenBoundaries[len(a.TokenBoundaries)-1]; int(last) > len(a.Dictionary) {
-		return fmt.Errorf("token boundary %d out of range for dictionary size %d", last, len(a.Dictionary))
+	bitmap := payload[4:]
+	if len(bitmap) != (int(rows)+7)/8 {
+		return fmt.Errorf("tombstones length mismatch: payload=%d expected=%d", len(bitmap), (int(rows)+7)/8)
 	}
-	if a.tokenBitWidth() == tokenBitWidth12 {
-		for i, tokenID := range a.CompressedData {
-			if tokenID > maxTokenID12Bit {
-				return fmt.Errorf("compressed token out of 12-bit range at index %d: %d", i, tokenID)
-			}
-		}
-	}
-	for i, tokenID := range a.CompressedData {
-		if int(tokenID)+1 >= len(a.TokenBoundaries) {
-			return fmt.Errorf("compressed token out of range at index %d: %d", i, tokenID)
-		}
+
+	tombstones := make([]uint64, tombstoneWords(int(rows)))
+	for i, b := range bitmap {
+		tombstones[i/8] |= uint64(b) << (uint(i%8) * 8)
 	}
+	dst.tombstones = tombstones
 	return nil
 }
 
+func validateArchiveStructure(a *Archive) error {
+	c := issueCollector{limit: 1}
+	checkArchive(a, &c)
+	return c.corruptionError(1)
+}
+
 // WriteTo serializes the Archive to an io.Writer.
 func (a *Archive) WriteTo(w io.Writer) (int64, error) {
-	if err := validateArchiveStructure(a); err != nil {
-		return 0, fmt.Errorf("invalid archive: %w", err)
-	}
-
-	compressedPayload, compressedParam, err := encodeCompressedDataStage(a)
-	if err != nil {
-		return 0, err
-	}
-	stringBoundariesPayload, err := encodeStringBoundariesStage(a)
-	if err != nil {
-		return 0, err
-	}
-	dictionaryPayload, err := encodeDictionaryStage(a)
-	if err != nil {
-		return 0, err
-	}
-	tokenBoundariesPayload, tokenBoundariesParam, err := encodeTokenBoundariesStage(a)
-	if err != nil {
-		return 0, err
-	}
-
-	stages := []struct {
-		name    string
-		params  []byte
-		payload []byte
-	}{
-		{
-			name:    stageCompressedData,
-			params:  []byte{compressedParam},
-			payload: compressedPayload,
-		},
-		{
-			name:    stageStringBoundaries,
-			params:  []byte{stageStringBoundariesParamDelta},
-			payload: stringBoundariesPayload,
-		},
-		{
-			name:    stageDictionary,
-			params:  nil,
-			payload: dictionaryPayload,
-		},
-		{
-			name:    stageTokenBoundaries,
-			params:  []byte{tokenBoundariesParam},
-			payload: tokenBoundariesPayload,
-		},
-	}
-
-	var total int64
-	n, err := writeBytes(w, []byte(archiveMagic))
-	total += n
-	if err != nil {
-		return total, err
-	}
-
-	if err := binary.Write(w, binary.LittleEndian, archiveVersion); err != nil {
-		return total, err
-	}
-	total += 2
-
-	if err := binary.Write(w, binary.LittleEndian, uint16(len(stages))); err != nil {
-		return total, err
-	}
-	total += 2
-
-	for _, stage := range stages {
-		n, err := writeStage(w, stage.name, stage.params, stage.payload)
-		total += n
-		if err != nil {
-			return total, err
-		}
-	}
-
-	return total, nil
+	return a.WriteToWithOptions(w, WriteOptions{})
 }
 
 // ReadFrom deserializes an Archive from an io.Reader.
 func (a *Archive) ReadFrom(r io.Reader) (int64, error) {
-	var total int64
-	var magic [4]byte
-	magicOffset := total
-	n, err := io.ReadFull(r, magic[:])
-	total += int64(n)
-	if err != nil {
-		return total, fmt.Errorf("read archive magic at offset %d: %w", magicOffset, err)
-	}
-	if string(magic[:]) != archiveMagic {
-		return total, fmt.Errorf("invalid archive magic at offset %d: %q", magicOffset, string(magic[:]))
-	}
+	return a.readFrom(r, defaultReadLimits)
+}
 
-	var version uint16
-	versionOffset := total
-	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
-		return total, fmt.Errorf("read archive version at offset %d: %w", versionOffset, err)
+func (a *Archive) readFrom(r io.Reader, limits readLimits) (int64, error) {
+	header, total, err := readArchiveHeader(r)
+	if err != nil {
+		return total, err
 	}
-	total += 2
-	if version != archiveVersion {
-		return total, fmt.Errorf("unsupported archive version at offset %d: %d", versionOffset, version)
+	if header.rows > uint64(limits.rows) {
+		return total, limitExceeded("declared row count", int64(min(header.rows, math.MaxInt64)), int64(limits.rows))
 	}
 
-	var stageCount uint16
-	stageCountOffset := total
-	if err := binary.Read(r, binary.LittleEndian, &stageCount); err != nil {
-		return total, fmt.Errorf("read stage count at offset %d: %w", stageCountOffset, err)
-	}
-	total += 2
-	if stageCount == 0 || stageCount > maxArchiveStages {
-		return total, fmt.Errorf("invalid stage count at offset %d: %d", stageCountOffset, stageCount)
+	// The checksum covers the header and every stage byte.
+	src := r
+	var sum hash.Hash32
+	if header.checksum == checksumWireCRC32C {
+		sum = crc32.New(crc32cTable)
+		sum.Write(header.raw)
+		r = io.TeeReader(r, sum)
 	}
 
 	tmp := Archive{compressedTokenBitWidth: tokenBitWidth16}
-	seenStages := make(map[string]bool, stageCount)
+	dictionaryParents := false
+	seenStages := make(map[string]bool, header.stageCount)
 	var paramsScratch []byte
 	var payloadScratch []byte
 
-	for i := 0; i < int(stageCount); i++ {
+	for i := 0; i < int(header.stageCount); i++ {
 		headerOffset := total
-		header, n, err := readStageHeader(r)
+		stageHeader, n, err := readStageHeader(r)
 		total += n
 		if err != nil {
-			return total, fmt.Errorf("read stage header at offset %d (stage index %d): %w", headerOffset, i, err)
+			return total, &StageError{Op: "read", Offset: headerOffset, Index: i, Err: err}
 		}
-		if seenStages[header.name] {
-			return total, fmt.Errorf("duplicate stage %q at stage index %d", header.name, i)
+		if seenStages[stageHeader.name] {
+			return total, &StageError{Op: "read", Stage: stageHeader.name, Offset: headerOffset, Index: i, Err: corruptf("duplicate stage")}
+		}
+		if size := total + int64(stageHeader.paramLen) + int64(stageHeader.dataLen); size > limits.totalBytes {
+			return total, &StageError{Op: "read", Stage: stageHeader.name, Offset: headerOffset, Index: i, Err: limitExceeded("archive size", size, limits.totalBytes)}
+		}
+		if int(stageHeader.dataLen) > limits.stageBytes {
+			return total, &StageError{Op: "read", Stage: stageHeader.name, Offset: headerOffset, Index: i, Err: limitExceeded("stage payload size", int64(stageHeader.dataLen), int64(limits.stageBytes))}
 		}
 
-		paramsLen := int(header.paramLen)
+		paramsLen := int(stageHeader.paramLen)
 		if cap(paramsScratch) < paramsLen {
 			paramsScratch = make([]byte, paramsLen)
 		}
@@ -1399,12 +1261,13 @@ func (a *Archive) ReadFrom(r io.Reader) (int64, error) {
 		nParams, err := io.ReadFull(r, params)
 		total += int64(nParams)
 		if err != nil {
-			return total, fmt.Errorf("read stage %q params at offset %d (stage index %d): %w", header.name, paramsOffset, i, err)
+			return total, &StageError{Op: "read params of", Stage: stageHeader.name, Offset: paramsOffset, Index: i, Err: err}
 		}
 
-		switch header.name {
-		case stageCompressedData, stageStringBoundaries, stageDictionary, stageTokenBoundaries:
-			payloadLen := int(header.dataLen)
+		codec := lookupStageCodec(stageHeader.name)
+		switch {
+		case slices.Contains(builtinStages, stageHeader.name) || codec != nil:
+			payloadLen := int(stageHeader.dataLen)
 			if cap(payloadScratch) < payloadLen {
 				payloadScratch = make([]byte, payloadLen)
 			}
@@ -1413,54 +1276,77 @@ func (a *Archive) ReadFrom(r io.Reader) (int64, error) {
 			nPayload, err := io.ReadFull(r, payload)
 			total += int64(nPayload)
 			if err != nil {
-				return total, fmt.Errorf("read stage %q payload at offset %d (stage index %d): %w", header.name, payloadOffset, i, err)
+				return total, &StageError{Op: "read payload of", Stage: stageHeader.name, Offset: payloadOffset, Index: i, Err: err}
 			}
 
-			switch header.name {
+			switch stageHeader.name {
 			case stageCompressedData:
-				if err := decodeCompressedDataStage(&tmp, params, payload); err != nil {
-					return total, fmt.Errorf("decode stage %q at offset %d (stage index %d): %w", header.name, payloadOffset, i, err)
-				}
+				err = decodeCompressedDataStage(&tmp, params, payload, limits)
 			case stageStringBoundaries:
-				if err := decodeStringBoundariesStage(&tmp, params, payload); err != nil {
-					return total, fmt.Errorf("decode stage %q at offset %d (stage index %d): %w", header.name, payloadOffset, i, err)
-				}
+				err = decodeStringBoundariesStage(&tmp, params, payload, limits)
 			case stageDictionary:
-				if err := decodeDictionaryStage(&tmp, params, payload); err != nil {
-					return total, fmt.Errorf("decode stage %q at offset %d (stage index %d): %w", header.name, payloadOffset, i, err)
-				}
+				dictionaryParents = dictionaryParentsParams(params)
+				err = decodeDictionaryStage(&tmp, params, payload, limits)
 			case stageTokenBoundaries:
-				if err := decodeTokenBoundariesStage(&tmp, params, payload); err != nil {
-					return total, fmt.Errorf("decode stage %q at offset %d (stage index %d): %w", header.name, payloadOffset, i, err)
+				err = decodeTokenBoundariesStage(&tmp, params, payload, limits)
+			case stageTombstones:
+				err = decodeTombstonesStage(&tmp, params, payload, limits)
+			case stageMetadata:
+				err = decodeMetadataStage(&tmp, params, payload, limits)
+			case stagePassthrough:
+				err = decodePassthroughStage(&tmp, params, payload, limits)
+			default:
+				err = decodeCustomStage(&tmp, codec, stageHeader.name, params, payload)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrLimitExceeded) {
+					err = corrupt(err)
 				}
+				return total, &StageError{Op: "decode", Stage: stageHeader.name, Offset: payloadOffset, Index: i, Err: err}
 			}
-			seenStages[header.name] = true
+			seenStages[stageHeader.name] = true
 
 		default:
 			skipOffset := total
-			skipped, err := io.CopyN(io.Discard, r, int64(header.dataLen))
+			skipped, err := io.CopyN(io.Discard, r, int64(stageHeader.dataLen))
 			total += skipped
 			if err != nil {
-				return total, fmt.Errorf("skip unknown stage %q at offset %d (stage index %d): %w", header.name, skipOffset, i, err)
+				return total, &StageError{Op: "skip", Stage: stageHeader.name, Offset: skipOffset, Index: i, Err: err}
 			}
 		}
 	}
 
-	requiredStages := []string{
-		stageCompressedData,
-		stageStringBoundaries,
-		stageDictionary,
-		stageTokenBoundaries,
-	}
-	for _, stageName := range requiredStages {
+	for _, stageName := range header.requiredStages() {
 		if !seenStages[stageName] {
-			return total, fmt.Errorf("missing required stage %q", stageName)
+			return total, corruptf("missing required stage %q", stageName)
+		}
+	}
+	if sum != nil {
+		if size := total + archiveChecksumLen; size > limits.totalBytes {
+			return total, limitExceeded("archive size", size, limits.totalBytes)
+		}
+		var stored [archiveChecksumLen]byte
+		n, err := io.ReadFull(src, stored[:])
+		total += int64(n)
+		if err != nil {
+			return total, fmt.Errorf("read archive checksum at offset %d: %w", total-int64(n), err)
+		}
+		if err := verifyChecksum(stored[:], sum.Sum32()); err != nil {
+			return total, err
 		}
 	}
 	if err := validateArchiveStructure(&tmp); err != nil {
 		return total, fmt.Errorf("invalid archive structure: %w", err)
 	}
+	if err := header.check(&tmp, dictionaryParents); err != nil {
+		return total, fmt.Errorf("invalid archive structure: %w", err)
+	}
+	if header.version == FormatVersion2 {
+		restoreLegacyPassthrough(&tmp)
+	}
 
+	tmp.slots = &lazySlots{}
+	tmp.markValidated()
 	*a = tmp
 	return total, nil
 }
@@ -0,0 +1,87 @@
+package onpair
+
+import (
+	"fmt"
+	"math"
+)
+
+// CompactBoundaries switches the archive's row index to 32-bit offsets,
+// releasing StringBoundaries. This halves the per-row overhead on 64-bit
+// platforms while keeping row lookups O(1). Use Boundaries to obtain the
+// legacy []int form.
+//
+// Compacting an archive whose boundaries are already compact is a no-op.
+func (a *Archive) CompactBoundaries() error {
+	if a.compactBoundaries != nil {
+		return nil
+	}
+	if err := validateArchiveStructure(a); err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+	if !boundariesFitUint32(a.StringBoundaries) {
+		return fmt.Errorf("string boundary %d exceeds 32-bit range", a.StringBoundaries[len(a.StringBoundaries)-1])
+	}
+	a.compactBoundaries = compactBoundaries(a.StringBoundaries)
+	a.StringBoundaries = nil
+	a.markValidated()
+	return nil
+}
+
+// Boundaries returns the archive's row boundaries, where row i spans tokens
+// [Boundaries()[i], Boundaries()[i+1]). For archives with legacy boundaries
+// this is StringBoundaries itself; compact archives return a fresh copy.
+func (a *Archive) Boundaries() []int {
+	if a.compactBoundaries == nil {
+		return a.StringBoundaries
+	}
+	boundaries := make([]int, len(a.compactBoundaries))
+	for i, boundary := range a.compactBoundaries {
+		boundaries[i] = int(boundary)
+	}
+	return boundaries
+}
+
+// boundariesFitUint32 reports whether monotonic boundaries fit in 32 bits.
+func boundariesFitUint32(boundaries []int) bool {
+	return len(boundaries) == 0 || uint64(boundaries[len(boundaries)-1]) <= math.MaxUint32
+}
+
+func compactBoundaries(boundaries []int) []uint32 {
+	out := make([]uint32, len(boundaries))
+	for i, boundary := range boundaries {
+		out[i] = uint32(boundary)
+	}
+	return out
+}
+
+func (a *Archive) boundaryCount() int {
+	if a.compactBoundaries != nil {
+		return len(a.compactBoundaries)
+	}
+	return len(a.StringBoundaries)
+}
+
+func (a *Archive) boundaryAt(i int) int {
+	if a.compactBoundaries != nil {
+		return int(a.compactBoundaries[i])
+	}
+	return a.StringBoundaries[i]
+}
+
+// rowSpan returns the token range [start, end) of row index.
+func (a *Archive) rowSpan(index int) (int, int) {
+	if a.compactBoundaries != nil {
+		return int(a.compactBoundaries[index]), int(a.compactBoundaries[index+1])
+	}
+	return a.StringBoundaries[index], a.StringBoundaries[index+1]
+}
+
+// setBoundaries replaces the row boundaries, keeping the archive's index
+// representation.
+func (a *Archive) setBoundaries(boundaries []int) {
+	if a.compactBoundaries != nil {
+		a.compactBoundaries = compactBoundaries(boundaries)
+		return
+	}
+	a.StringBoundaries = boundaries
+}
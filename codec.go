@@ -0,0 +1,130 @@
+package onpair
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// StageCodec encodes and decodes the value of a custom archive stage, such
+// as per-row timestamps or a secondary index, so it is written alongside the
+// archive and restored on read.
+type StageCodec interface {
+	// EncodeStage returns the params and payload that represent value.
+	EncodeStage(value any) (params, payload []byte, err error)
+
+	// DecodeStage rebuilds a value from the params and payload written by
+	// EncodeStage. Errors are reported as archive corruption.
+	DecodeStage(params, payload []byte) (any, error)
+}
+
+var (
+	stageCodecsMu sync.RWMutex
+	stageCodecs   = make(map[string]StageCodec)
+)
+
+// builtinStages are the stage names reserved by the archive format.
+var builtinStages = []string{
+	stageCompressedData,
+	stageStringBoundaries,
+	stageDictionary,
+	stageTokenBoundaries,
+	stageTombstones,
+	stageMetadata,
+	stagePassthrough,
+}
+
+// RegisterStageCodec makes codec responsible for the stage called name.
+// Archives carry values for registered stages through SetStageValue; WriteTo
+// writes each as a stage of that name, and ReadFrom and NewReader decode
+// stages of that name with codec. Stages with no registered codec are still
+// skipped on read.
+//
+// Like database/sql.Register, it is meant to be called from an init
+// function, and panics if name is empty, longer than 255 bytes, a built-in
+// stage name or already registered, or if codec is nil.
+func RegisterStageCodec(name string, codec StageCodec) {
+	if len(name) == 0 || len(name) > 255 {
+		panic(fmt.Sprintf("onpair: invalid stage name length %d", len(name)))
+	}
+	if slices.Contains(builtinStages, name) {
+		panic(fmt.Sprintf("onpair: stage name %q is reserved", name))
+	}
+	if codec == nil {
+		panic(fmt.Sprintf("onpair: nil codec for stage %q", name))
+	}
+
+	stageCodecsMu.Lock()
+	defer stageCodecsMu.Unlock()
+	if _, ok := stageCodecs[name]; ok {
+		panic(fmt.Sprintf("onpair: stage codec %q registered twice", name))
+	}
+	stageCodecs[name] = codec
+}
+
+// lookupStageCodec returns the codec registered for name, or nil.
+func lookupStageCodec(name string) StageCodec {
+	stageCodecsMu.RLock()
+	defer stageCodecsMu.RUnlock()
+	return stageCodecs[name]
+}
+
+// SetStageValue sets the value written as the custom stage name, which must
+// have a codec registered with RegisterStageCodec. A nil value removes the
+// stage.
+//
+// Stage values are opaque to the archive: in-place operations such as Delete
+// and Compact leave them unchanged, and Slice, Split and Merge results start
+// without them.
+func (a *Archive) SetStageValue(name string, value any) error {
+	if lookupStageCodec(name) == nil {
+		return fmt.Errorf("no codec registered for stage %q", name)
+	}
+	if value == nil {
+		delete(a.stageValues, name)
+		if len(a.stageValues) == 0 {
+			a.stageValues = nil
+		}
+		return nil
+	}
+	if a.stageValues == nil {
+		a.stageValues = make(map[string]any)
+	}
+	a.stageValues[name] = value
+	return nil
+}
+
+// StageValue returns the value of the custom stage name, as set by
+// SetStageValue or decoded by its codec on read.
+func (a *Archive) StageValue(name string) (any, bool) {
+	value, ok := a.stageValues[name]
+	return value, ok
+}
+
+// customStream encodes one custom stage with its registered codec.
+func customStream(name string, value any) (streamStage, error) {
+	codec := lookupStageCodec(name)
+	if codec == nil {
+		return streamStage{}, fmt.Errorf("no codec registered for stage %q", name)
+	}
+	params, payload, err := codec.EncodeStage(value)
+	if err != nil {
+		return streamStage{}, fmt.Errorf("encode stage %q: %w", name, err)
+	}
+	return bytesStage(name, params, payload), nil
+}
+
+// decodeCustomStage decodes a registered custom stage into dst. The codec
+// receives its own copy of params and payload, which it may retain.
+func decodeCustomStage(dst *Archive, codec StageCodec, name string, params, payload []byte) error {
+	value, err := codec.DecodeStage(bytes.Clone(params), bytes.Clone(payload))
+	if err != nil {
+		return err
+	}
+	if dst.stageValues == nil {
+		dst.stageValues = make(map[string]any)
+	}
+	dst.stageValues[name] = value
+	return nil
+}
@@ -0,0 +1,193 @@
+package onpair
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// CompactOptions configures Compact.
+type CompactOptions struct {
+	// PruneDictionary drops merged tokens (IDs >= 256) that are no longer
+	// referenced by any remaining row and renumbers the rest densely.
+	PruneDictionary bool
+}
+
+func tombstoneWords(rows int) int {
+	return (rows + 63) / 64
+}
+
+// Delete marks the row at index as deleted. Deleted rows keep their index,
+// so Rows is unchanged and other row indices stay stable, but the row can no
+// longer be decoded and is skipped by AppendAll and DecompressAllChecked.
+//
+// The row's tokens remain in the token stream until Compact is called.
+// Deleting an already deleted row is a no-op.
+func (a *Archive) Delete(index int) error {
+	rows := a.Rows()
+	if index < 0 || index >= rows {
+		return fmt.Errorf("%w: %d", ErrIndexOutOfRange, index)
+	}
+	if a.tombstones == nil {
+		a.tombstones = make([]uint64, tombstoneWords(rows))
+	}
+	a.tombstones[index/64] |= 1 << (uint(index) % 64)
+	return nil
+}
+
+// IsDeleted reports whether the row at index has been deleted.
+func (a *Archive) IsDeleted(index int) bool {
+	word := index / 64
+	if index < 0 || word >= len(a.tombstones) {
+		return false
+	}
+	return a.tombstones[word]&(1<<(uint(index)%64)) != 0
+}
+
+// LiveRows returns the number of rows that have not been deleted.
+func (a *Archive) LiveRows() int {
+	deleted := 0
+	for _, word := range a.tombstones {
+		deleted += bits.OnesCount64(word)
+	}
+	return a.Rows() - deleted
+}
+
+// Compact rewrites the token stream and row boundaries without the deleted
+// rows and clears all tombstones. Row indices of the surviving rows shift
+// down accordingly.
+func (a *Archive) Compact(opts CompactOptions) error {
+	if err := validateArchiveStructure(a); err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+
+	if a.tombstones != nil {
+		rows := a.Rows()
+		compressedData := make([]uint16, 0, a.tokenCount())
+		stringBoundaries := make([]int, 1, a.LiveRows()+1)
+		for i := 0; i < rows; i++ {
+			if a.IsDeleted(i) {
+				continue
+			}
+			compressedData = append(compressedData, a.tokenSlice(a.rowSpan(i))...)
+			stringBoundaries = append(stringBoundaries, len(compressedData))
+		}
+		a.setTokens(compressedData)
+		a.setBoundaries(stringBoundaries)
+		a.tombstones = nil
+	}
+
+	if opts.PruneDictionary {
+		pruneUnusedTokens(a)
+	}
+	a.markValidated()
+	return nil
+}
+
+// PruneDictionary removes merged tokens (IDs >= 256) that no row references
+// and renumbers the remaining tokens densely, rewriting the token stream to
+// match. When the pruned dictionary fits in fewer bits the archive switches
+// to the narrowest packed token width that holds it.
+//
+// Pruning is useful because training often creates tokens that are later
+// superseded by longer merges and never emitted by the parser. A pruned
+// archive no longer shares token IDs with the model that produced it.
+func (a *Archive) PruneDictionary() error {
+	if err := validateArchiveStructure(a); err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+	pruneUnusedTokens(a)
+	a.markValidated()
+	return nil
+}
+
+// RenumberByFrequency reassigns merged token IDs (>= 256) in order of how
+// often they occur in the token stream, most frequent first, and rewrites the
+// token stream to match. Single-byte tokens keep their identity IDs.
+//
+// Token IDs are otherwise assigned in creation order during training, so
+// frequent tokens end up scattered across the ID space. Small IDs for hot
+// tokens help the codebook and flate stages of the serialized token stream.
+func (a *Archive) RenumberByFrequency() error {
+	if err := validateArchiveStructure(a); err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+	renumberTokensByFrequency(a)
+	a.markValidated()
+	return nil
+}
+
+// pruneUnusedTokens removes merged tokens that do not occur in the token
+// stream and renumbers the remaining ones in their original order.
+// Single-byte tokens are always kept so IDs 0-255 stay byte identities.
+func pruneUnusedTokens(a *Archive) {
+	tokenCount := len(a.TokenBoundaries) - 1
+	if tokenCount <= singleByteTokens {
+		return
+	}
+
+	counts := tokenCounts(a)
+	order := make([]int, 0, tokenCount)
+	for tokenID := 0; tokenID < tokenCount; tokenID++ {
+		if tokenID < singleByteTokens || counts[tokenID] > 0 {
+			order = append(order, tokenID)
+		}
+	}
+	if bits := tokenBitWidthFor(len(order)); bits < a.tokenBitWidth() {
+		a.compressedTokenBitWidth = bits
+	}
+	reorderTokens(a, order)
+}
+
+// renumberTokensByFrequency orders merged tokens by descending usage count,
+// breaking ties by original ID.
+func renumberTokensByFrequency(a *Archive) {
+	tokenCount := len(a.TokenBoundaries) - 1
+	if tokenCount <= singleByteTokens {
+		return
+	}
+
+	counts := tokenCounts(a)
+	order := make([]int, tokenCount)
+	for tokenID := range order {
+		order[tokenID] = tokenID
+	}
+	merged := order[singleByteTokens:]
+	sort.SliceStable(merged, func(i, j int) bool {
+		return counts[merged[i]] > counts[merged[j]]
+	})
+	reorderTokens(a, order)
+}
+
+func tokenCounts(a *Archive) []uint32 {
+	counts := make([]uint32, len(a.TokenBoundaries)-1)
+	for i := 0; i < a.tokenCount(); i++ {
+		counts[a.tokenAt(i)]++
+	}
+	return counts
+}
+
+// reorderTokens rebuilds the dictionary so that new token ID i holds old token
+// order[i], drops tokens missing from order, and rewrites the token stream.
+// Every token referenced by the token stream must appear in order.
+func reorderTokens(a *Archive, order []int) {
+	remap := make([]uint16, len(a.TokenBoundaries)-1)
+	dictionary := make([]byte, 0, len(a.Dictionary))
+	tokenBoundaries := make([]uint32, 1, len(order)+1)
+	for newID, oldID := range order {
+		remap[oldID] = uint16(newID)
+		dictionary = append(dictionary, a.Dictionary[a.TokenBoundaries[oldID]:a.TokenBoundaries[oldID+1]]...)
+		tokenBoundaries = append(tokenBoundaries, uint32(len(dictionary)))
+	}
+
+	compressedData := make([]uint16, a.tokenCount())
+	for i := range compressedData {
+		compressedData[i] = remap[a.tokenAt(i)]
+	}
+	a.setTokens(compressedData)
+	a.Dictionary = dictionary
+	a.TokenBoundaries = tokenBoundaries
+	if a.slots != nil {
+		a.slots = &lazySlots{}
+	}
+}
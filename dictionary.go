@@ -0,0 +1,265 @@
+package onpair
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Parent-coded dictionary stage (params {stageDictionaryParamParents}).
+// Merged tokens are concatenations of other tokens, so each token is stored
+// as a reference to the token it starts with plus either another token or
+// the literal remaining bytes:
+//
+//	tokenCount    = uvarint
+//	identityRun   = uvarint (tokens [0, identityRun) are the bytes 0, 1, ...)
+//	repeat tokenCount-identityRun times, x = uvarint:
+//	  x == 0        literal: uvarint len, len bytes
+//	  x odd         token (x-1)/2 followed by uvarint len, len bytes
+//	  x even, x > 0 token x/2-1 followed by token uvarint
+//
+// References may point at any token ID, so frequency-ordered dictionaries
+// code as well as merge-ordered ones; decoding rejects reference cycles.
+
+// Dictionary entry kinds used while decoding.
+const (
+	dictEntryLiteral = iota
+	dictEntryPrefixLiteral
+	dictEntryPair
+)
+
+// dictionaryParentsParams reports whether dictionary stage params select the
+// parent-coded layout.
+func dictionaryParentsParams(params []byte) bool {
+	return len(params) == 1 && params[0] == stageDictionaryParamParents
+}
+
+// dictionaryParentsStream returns the parent-coded dictionary stage, or false
+// if it would not be smaller than the raw stage or the dictionary holds
+// bytes outside its tokens.
+func dictionaryParentsStream(a *Archive) (streamStage, bool) {
+	tokenBounds := a.TokenBoundaries
+	if len(tokenBounds) < 2 || tokenBounds[0] != 0 || int(tokenBounds[len(tokenBounds)-1]) != len(a.Dictionary) {
+		return streamStage{}, false
+	}
+	payload := dictionaryParentsPayload(a)
+	if len(payload) >= 4+len(a.Dictionary) {
+		return streamStage{}, false
+	}
+	return bytesStage(stageDictionary, []byte{stageDictionaryParamParents}, payload), true
+}
+
+// dictionaryParentsPayload encodes a's dictionary with parent references,
+// picking for each token the shortest of the three entry forms.
+func dictionaryParentsPayload(a *Archive) []byte {
+	tokenBounds := a.TokenBoundaries
+	tokenCount := len(tokenBounds) - 1
+	token := func(id int) []byte {
+		return a.Dictionary[tokenBounds[id]:tokenBounds[id+1]]
+	}
+
+	identityRun := 0
+	for identityRun < tokenCount && identityRun < 256 {
+		t := token(identityRun)
+		if len(t) != 1 || t[0] != byte(identityRun) {
+			break
+		}
+		identityRun++
+	}
+
+	ids := make(map[string]int, tokenCount)
+	for id := range tokenCount {
+		if _, ok := ids[string(token(id))]; !ok {
+			ids[string(token(id))] = id
+		}
+	}
+
+	payload := binary.AppendUvarint(nil, uint64(tokenCount))
+	payload = binary.AppendUvarint(payload, uint64(identityRun))
+	var best, candidate []byte
+	for id := identityRun; id < tokenCount; id++ {
+		t := token(id)
+		best = binary.AppendUvarint(append(best[:0], 0), uint64(len(t)))
+		best = append(best, t...)
+		for split := len(t) - 1; split >= 1; split-- {
+			prefix, ok := ids[string(t[:split])]
+			if !ok || prefix == id {
+				continue
+			}
+			if suffix, ok := ids[string(t[split:])]; ok && suffix != id {
+				candidate = binary.AppendUvarint(candidate[:0], uint64(2*(prefix+1)))
+				candidate = binary.AppendUvarint(candidate, uint64(suffix))
+				if len(candidate) < len(best) {
+					best, candidate = candidate, best
+				}
+			}
+			candidate = binary.AppendUvarint(candidate[:0], uint64(2*prefix+1))
+			candidate = binary.AppendUvarint(candidate, uint64(len(t)-split))
+			candidate = append(candidate, t[split:]...)
+			if len(candidate) < len(best) {
+				best, candidate = candidate, best
+			}
+		}
+		payload = append(payload, best...)
+	}
+	return payload
+}
+
+// decodeDictionaryParents rebuilds the dictionary bytes from a parent-coded
+// payload. The decoded size is bounded by maxBytes before it is allocated.
+func decodeDictionaryParents(payload []byte, maxBytes int) ([]byte, error) {
+	rest := payload
+	readUvarint := func(what string) (uint64, error) {
+		v, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return 0, fmt.Errorf("truncated dictionary %s", what)
+		}
+		rest = rest[n:]
+		return v, nil
+	}
+
+	count, err := readUvarint("token count")
+	if err != nil {
+		return nil, err
+	}
+	identityRun, err := readUvarint("identity run")
+	if err != nil {
+		return nil, err
+	}
+	// Every coded entry takes at least one byte.
+	if identityRun > 256 || identityRun > count || count-identityRun > uint64(len(rest)) {
+		return nil, fmt.Errorf("invalid dictionary token count %d (identity run %d) for %d payload bytes", count, identityRun, len(payload))
+	}
+
+	tokenCount := int(count)
+	kinds := make([]uint8, tokenCount)
+	left := make([]int, tokenCount)
+	right := make([]int, tokenCount)
+	literals := make([][]byte, tokenCount)
+	for id := range int(identityRun) {
+		literals[id] = []byte{byte(id)}
+	}
+	readToken := func(v uint64) (int, error) {
+		if v >= count {
+			return 0, fmt.Errorf("dictionary token reference out of range: %d", v)
+		}
+		return int(v), nil
+	}
+	readLiteral := func() ([]byte, error) {
+		n, err := readUvarint("literal length")
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(rest)) {
+			return nil, fmt.Errorf("truncated dictionary literal")
+		}
+		literal := rest[:n]
+		rest = rest[n:]
+		return literal, nil
+	}
+
+	for id := int(identityRun); id < tokenCount; id++ {
+		x, err := readUvarint("entry")
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case x == 0:
+			kinds[id] = dictEntryLiteral
+			literals[id], err = readLiteral()
+		case x%2 == 1:
+			kinds[id] = dictEntryPrefixLiteral
+			if left[id], err = readToken((x - 1) / 2); err == nil {
+				literals[id], err = readLiteral()
+			}
+		default:
+			kinds[id] = dictEntryPair
+			if left[id], err = readToken(x/2 - 1); err == nil {
+				var suffix uint64
+				if suffix, err = readUvarint("suffix token"); err == nil {
+					right[id], err = readToken(suffix)
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("dictionary trailing bytes: %d", len(rest))
+	}
+
+	// Compute token lengths in dependency order, rejecting cycles and
+	// sizes past maxBytes.
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]uint8, tokenCount)
+	lengths := make([]int, tokenCount)
+	order := make([]int, 0, tokenCount)
+	parents := func(id int) []int {
+		switch kinds[id] {
+		case dictEntryPrefixLiteral:
+			return []int{left[id]}
+		case dictEntryPair:
+			return []int{left[id], right[id]}
+		}
+		return nil
+	}
+	var stack []int
+	for root := range tokenCount {
+		if state[root] != unvisited {
+			continue
+		}
+		stack = append(stack[:0], root)
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			if state[id] == unvisited {
+				state[id] = visiting
+				for _, parent := range parents(id) {
+					switch state[parent] {
+					case visiting:
+						return nil, fmt.Errorf("dictionary token reference cycle at token %d", parent)
+					case unvisited:
+						stack = append(stack, parent)
+					}
+				}
+				continue
+			}
+			stack = stack[:len(stack)-1]
+			if state[id] == done {
+				continue
+			}
+			n := len(literals[id])
+			for _, parent := range parents(id) {
+				n += lengths[parent]
+			}
+			if n > maxBytes {
+				return nil, limitExceeded("dictionary token size", int64(n), int64(maxBytes))
+			}
+			lengths[id] = n
+			state[id] = done
+			order = append(order, id)
+		}
+	}
+
+	total := 0
+	offsets := make([]int, tokenCount)
+	for id, n := range lengths {
+		offsets[id] = total
+		total += n
+		if total > maxBytes {
+			return nil, limitExceeded("dictionary size", int64(total), int64(maxBytes))
+		}
+	}
+	dictionary := make([]byte, total)
+	for _, id := range order {
+		pos := offsets[id]
+		for _, parent := range parents(id) {
+			pos += copy(dictionary[pos:], dictionary[offsets[parent]:offsets[parent]+lengths[parent]])
+		}
+		copy(dictionary[pos:], literals[id])
+	}
+	return dictionary, nil
+}
@@ -0,0 +1,50 @@
+package onpair
+
+import "fmt"
+
+// StageError reports a failure reading, decoding or skipping one stage of a
+// serialized archive. Decode failures also match ErrCorruptArchive; read
+// failures wrap the underlying I/O error.
+type StageError struct {
+	Op     string // "read", "read params of", "read payload of", "decode" or "skip"
+	Stage  string // Stage name, empty if the stage header could not be read
+	Offset int64  // Byte offset of the failing part within the stream
+	Index  int    // Position of the stage in the archive
+	Err    error
+}
+
+func (e *StageError) Error() string {
+	name := "stage"
+	if e.Stage != "" {
+		name = fmt.Sprintf("stage %q", e.Stage)
+	}
+	return fmt.Sprintf("%s %s at offset %d (stage index %d): %v", e.Op, name, e.Offset, e.Index, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// corruptError marks an error as matching ErrCorruptArchive without changing
+// its message.
+type corruptError struct {
+	err error
+}
+
+func (e *corruptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *corruptError) Unwrap() []error {
+	return []error{ErrCorruptArchive, e.err}
+}
+
+// corrupt marks err as matching ErrCorruptArchive.
+func corrupt(err error) error {
+	return &corruptError{err: err}
+}
+
+// corruptf formats an error that matches ErrCorruptArchive.
+func corruptf(format string, args ...any) error {
+	return corrupt(fmt.Errorf(format, args...))
+}
@@ -0,0 +1,206 @@
+package onpair
+
+import (
+	"compress/flate"
+	"io"
+	"math"
+)
+
+const (
+	// estimateTrainBytes caps the training sample of EstimateRatio.
+	estimateTrainBytes = 256 << 10
+	// estimateSampleBytes bounds the rows EstimateRatio parses.
+	estimateSampleBytes = 128 << 10
+	// estimateTemplatePoolBytes bounds the rows EstimateRatio stratifies
+	// its training sample from under template stratified sampling.
+	estimateTemplatePoolBytes = 4 * estimateTrainBytes
+	// estimateShuffleSeed seeds the order rows are parsed in, distinct from
+	// trainingShuffleSeed.
+	estimateShuffleSeed = 7
+	// estimateZ is the normal quantile of the 95% confidence interval.
+	estimateZ = 1.96
+)
+
+// RatioEstimate is the result of EstimateRatio.
+type RatioEstimate struct {
+	InputBytes     int     // Total bytes of the rows.
+	EstimatedBytes int     // Estimated WriteTo size of the encoded rows.
+	Ratio          float64 // InputBytes / EstimatedBytes.
+	Low, High      float64 // 95% confidence interval of Ratio.
+	SampledRows    int     // Rows parsed to extrapolate from.
+	Passthrough    bool    // Whether Encode is expected to return a passthrough archive.
+}
+
+// EstimateRatio estimates the compression ratio Encode with opts would reach
+// on rows, as input bytes per byte written by WriteTo, without encoding every
+// row. It trains the dictionary as Encode does but on at most 256 KiB of rows
+// (or the configured training sample, if smaller), parses a further random
+// sample of up to 128 KiB of rows, and extrapolates the token stream and row
+// boundaries from it. The dictionary and stage framing are counted exactly.
+// Only the sampled rows are copied; template stratified sampling draws from
+// at most 1 MiB of rows.
+//
+// The token stream is costed with the encoding WriteTo picks for the sample.
+// The interval covers the sampling error of the per-byte cost only. It does
+// not cover the dictionary differing from the one Encode trains on a larger
+// sample, nor flate doing better on the full stream than on the sample, so
+// on rows past the sample sizes the actual ratio can lie outside it.
+// Dictionary pruning and frequency ordering are not estimated.
+func EstimateRatio(rows []string, opts ...Option) (RatioEstimate, error) {
+	e := NewEncoder(opts...)
+	if err := validateConfig(e.config); err != nil {
+		return RatioEstimate{}, err
+	}
+	inputBytes := 0
+	for _, row := range rows {
+		inputBytes += len(row)
+	}
+	estimate := RatioEstimate{InputBytes: inputBytes}
+	if len(rows) == 0 {
+		return estimate, nil
+	}
+	if resolveTrainingSampleBytes(e.config) > estimateTrainBytes {
+		e.config.TrainingSampleBytes = estimateTrainBytes
+	}
+	matcher, dict, tokenBoundaries := e.estimateTrain(rows, inputBytes)
+
+	sample := estimateSample(rows)
+	sampleData, sampleEnds := flattenStrings(sample)
+	tokens, sampleBoundaries := e.compress(sampleData, sampleEnds, matcher)
+	estimate.SampledRows = len(sample)
+
+	bitWidth := modelTokenBitWidth(e.config, len(tokenBoundaries)-1)
+	// Tokens per input byte in the sample, extrapolated for the SpaceUsed
+	// comparison Encode makes against the input size.
+	totalTokens := float64(len(tokens)) / float64(max(len(sampleData), 1)) * float64(inputBytes)
+	spaceUsed := packedByteSize(int(totalTokens), bitWidth) + len(dict) + len(tokenBoundaries)*4
+
+	rowTokens := func(i int) int { return sampleBoundaries[i+1] - sampleBoundaries[i] }
+	if !e.config.NoPassthrough && spaceUsed > inputBytes {
+		// WriteTo stores passthrough rows as single-byte tokens in
+		// version 2 archives.
+		estimate.Passthrough = true
+		tokens = make([]uint16, len(sampleData))
+		for i, b := range sampleData {
+			tokens[i] = uint16(b)
+		}
+		dict = dict[:singleByteTokens]
+		tokenBoundaries = tokenBoundaries[:singleByteTokens+1]
+		bitWidth = tokenBitWidth12
+		rowTokens = func(i int) int { return sampleEnds[i+1] - sampleEnds[i] }
+	}
+
+	// Fixed cost: an archive with the dictionary and no rows.
+	empty := &Archive{
+		StringBoundaries:        []int{0},
+		Dictionary:              dict,
+		TokenBoundaries:         tokenBoundaries,
+		compressedTokenBitWidth: bitWidth,
+	}
+	cw := &countingWriter{w: io.Discard}
+	if _, err := empty.WriteTo(cw); err != nil {
+		return estimate, err
+	}
+	fixed := float64(cw.n)
+
+	// Per-token cost of the encoding WriteTo would pick for the sample.
+	perToken := 0.0
+	if len(tokens) > 0 {
+		sampleArchive := &Archive{CompressedData: tokens, compressedTokenBitWidth: bitWidth}
+		payload, _, err := encodeCompressedDataStage(sampleArchive, EncodingAuto, flate.BestCompression, archiveVersion)
+		if err != nil {
+			return estimate, err
+		}
+		perToken = float64(len(payload)-4) / float64(len(tokens))
+	}
+
+	// Ratio estimator of serialized bytes per input byte over the sampled
+	// rows, each costing its tokens plus its boundary delta.
+	costs := make([]float64, len(sample))
+	var costSum, byteSum float64
+	for i, row := range sample {
+		t := rowTokens(i)
+		costs[i] = float64(t)*perToken + float64(uvarintLen(uint64(t)))
+		costSum += costs[i]
+		byteSum += float64(len(row))
+	}
+	perByte := 0.0
+	if byteSum > 0 {
+		perByte = costSum / byteSum
+	}
+	stdErr := 0.0
+	if n := len(sample); n > 1 && byteSum > 0 {
+		var sq float64
+		for i, row := range sample {
+			d := costs[i] - perByte*float64(len(row))
+			sq += d * d
+		}
+		meanBytes := byteSum / float64(n)
+		fpc := 1 - float64(n)/float64(len(rows))
+		stdErr = math.Sqrt(sq/float64(n*(n-1))*fpc) / meanBytes
+	}
+
+	size := func(perByte float64) float64 {
+		return fixed + math.Max(perByte, 0)*float64(inputBytes)
+	}
+	estimate.EstimatedBytes = int(math.Round(size(perByte)))
+	estimate.Ratio = float64(inputBytes) / size(perByte)
+	estimate.Low = float64(inputBytes) / size(perByte+estimateZ*stdErr)
+	estimate.High = float64(inputBytes) / size(perByte-estimateZ*stdErr)
+	return estimate, nil
+}
+
+// estimateTrain trains e on the rows Encode would sample for training,
+// flattening only those. It takes rows in the training shuffle order until
+// the training sample size is reached, which is the sample Encode draws; under
+// template stratified sampling it takes up to estimateTemplatePoolBytes and
+// stratifies those instead of all rows.
+func (e *Encoder) estimateTrain(rows []string, inputBytes int) (*Matcher, []byte, []uint32) {
+	trainingSampleBytes := resolveTrainingSampleBytes(e.config)
+	stratify := e.config.TemplateStratified && inputBytes > trainingSampleBytes
+	poolBytes := trainingSampleBytes
+	if stratify {
+		poolBytes = estimateTemplatePoolBytes
+	}
+	pool := shuffledPrefix(rows, trainingShuffleSeed, poolBytes)
+	data, endPositions := flattenStrings(pool)
+	sampleIndices := make([]int, len(pool))
+	for i := range sampleIndices {
+		sampleIndices[i] = i
+	}
+	sampleBytes := len(data)
+	if stratify {
+		sampleIndices, sampleBytes = stratifiedSampleIndicesByTemplateKey(
+			data, endPositions, sampleIndices, trainingSampleBytes, resolveTemplateMaxClusters(e.config),
+		)
+	}
+	return e.trainSample(data, endPositions, sampleIndices, sampleBytes)
+}
+
+// estimateSample picks rows in a deterministic shuffled order, distinct from
+// the training sample's, until estimateSampleBytes are taken.
+func estimateSample(rows []string) []string {
+	total := 0
+	for _, row := range rows {
+		total += len(row)
+	}
+	if total <= estimateSampleBytes {
+		return rows
+	}
+	return shuffledPrefix(rows, estimateShuffleSeed, estimateSampleBytes)
+}
+
+// shuffledPrefix returns rows in the order shuffleIndices gives for seed,
+// up to and including the row that reaches limit bytes.
+func shuffledPrefix(rows []string, seed uint64, limit int) []string {
+	var prefix []string
+	size := 0
+	for _, idx := range shuffleIndices(len(rows), seed) {
+		if size >= limit && len(prefix) > 0 {
+			break
+		}
+		prefix = append(prefix, rows[idx])
+		size += len(rows[idx])
+	}
+	return prefix
+}
@@ -0,0 +1,116 @@
+package onpair
+
+// EvalReport describes how well a model's dictionary fits a set of rows,
+// next to the same measurements on the rows it was trained on. Ratios count
+// only the token stream at the model's token bit width, since the dictionary
+// is shared by every archive the model encodes.
+type EvalReport struct {
+	Rows             int     // Rows evaluated.
+	Bytes            int     // Total bytes of the rows.
+	Tokens           int     // Tokens the model encodes the rows into.
+	BytesPerToken    float64 // Bytes / Tokens.
+	FallbackFraction float64 // Fraction of tokens that are single bytes (IDs below 256).
+	Ratio            float64 // Bytes per token stream byte.
+
+	TrainingBytesPerToken    float64 // BytesPerToken of the training rows.
+	TrainingFallbackFraction float64 // FallbackFraction of the training rows.
+	TrainingRatio            float64 // Ratio of the training rows.
+
+	// TrainingHeldOut reports whether the training measurements come from
+	// training rows outside the dictionary's training sample. When every
+	// training row was sampled they are in-sample, and so optimistic: the
+	// dictionary fits its own rows more closely than any new ones.
+	TrainingHeldOut bool
+
+	// RatioChange is Ratio / TrainingRatio. Values well below 1 mean the
+	// rows have drifted from the training data and retraining may pay off.
+	RatioChange float64
+}
+
+// Evaluate encodes rows with the model's dictionary and reports how well it
+// fits them compared with its training rows, so long-lived models can be
+// retrained when the data drifts. The training measurements are taken by
+// Train on up to 128 KiB of the training rows, preferring rows outside the
+// training sample (see WithTrainingSampleBytes). A model trained on no row
+// bytes has no training ratio and reports a RatioChange of zero, as does an
+// untrained model, which reports zeros throughout.
+func (m *Model) Evaluate(rows []string) EvalReport {
+	if m.matcher == nil {
+		return EvalReport{}
+	}
+	report := m.evaluate(rows)
+	report.TrainingBytesPerToken = m.training.BytesPerToken
+	report.TrainingFallbackFraction = m.training.FallbackFraction
+	report.TrainingRatio = m.training.Ratio
+	report.TrainingHeldOut = m.training.TrainingHeldOut
+	if report.TrainingRatio > 0 {
+		report.RatioChange = report.Ratio / report.TrainingRatio
+	}
+	return report
+}
+
+// evaluate measures the token stream of rows under the model.
+func (m *Model) evaluate(rows []string) EvalReport {
+	enc := &Encoder{config: m.config}
+	data, endPositions := flattenStrings(rows)
+	tokens, _ := enc.compress(data, endPositions, m.matcher)
+
+	report := EvalReport{Rows: len(rows), Bytes: len(data), Tokens: len(tokens)}
+	if len(tokens) == 0 {
+		return report
+	}
+	fallback := 0
+	for _, tokenID := range tokens {
+		if tokenID < singleByteTokens {
+			fallback++
+		}
+	}
+	bitWidth := modelTokenBitWidth(m.config, len(m.tokenBoundaries)-1)
+	report.BytesPerToken = float64(len(data)) / float64(len(tokens))
+	report.FallbackFraction = float64(fallback) / float64(len(tokens))
+	report.Ratio = float64(len(data)) / float64(packedByteSize(len(tokens), bitWidth))
+	return report
+}
+
+// trainingBaseline measures up to estimateSampleBytes of the training rows
+// the dictionary was not built from, in shuffled order, or a sample of all
+// training rows if the training sample took every row. shuffledIndices and
+// sampleIndices are those Train drew the training sample with.
+func (m *Model) trainingBaseline(rows []string, shuffledIndices, sampleIndices []int) EvalReport {
+	if len(rows) == 0 {
+		return EvalReport{}
+	}
+	sampled := make([]bool, len(rows))
+	for _, idx := range sampleIndices {
+		sampled[idx] = true
+	}
+	var heldOut []string
+	size := 0
+	for _, idx := range shuffledIndices {
+		if size >= estimateSampleBytes {
+			break
+		}
+		if !sampled[idx] {
+			heldOut = append(heldOut, rows[idx])
+			size += len(rows[idx])
+		}
+	}
+	if len(heldOut) == 0 {
+		return m.evaluate(estimateSample(rows))
+	}
+	baseline := m.evaluate(heldOut)
+	baseline.TrainingHeldOut = true
+	return baseline
+}
+
+// modelTokenBitWidth returns the token bit width archives encoded with cfg
+// and a dictionary of tokenCount tokens use, before dictionary pruning.
+func modelTokenBitWidth(cfg Config, tokenCount int) uint8 {
+	bitWidth := resolveTokenBitWidth(cfg)
+	if cfg.AutoTokenBitWidth {
+		if bits := tokenBitWidthFor(tokenCount); bits < bitWidth {
+			bitWidth = bits
+		}
+	}
+	return bitWidth
+}
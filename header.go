@@ -0,0 +1,228 @@
+package onpair
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Archive format versions accepted by WriteOptions.FormatVersion. Readers
+// accept both; writers default to FormatVersion2 so archives stay readable
+// by releases that predate version 3, within the limits described on
+// WriteOptions.FormatVersion.
+const (
+	FormatVersion2 = uint16(2)
+	FormatVersion3 = uint16(3)
+)
+
+// ChecksumAlgorithm selects the whole-archive checksum of a version 3
+// archive.
+type ChecksumAlgorithm uint8
+
+const (
+	// ChecksumDefault is CRC-32C for version 3 and none for version 2.
+	ChecksumDefault ChecksumAlgorithm = iota
+	// ChecksumNone writes no checksum.
+	ChecksumNone
+	// ChecksumCRC32C appends the CRC-32C (Castagnoli) of every preceding
+	// archive byte. Version 3 only.
+	ChecksumCRC32C
+)
+
+const (
+	// Version 3 header fields after headerLen: features u32, rows u64,
+	// tokenBitWidth u8, checksum u8. Readers ignore any extra bytes a later
+	// revision appends.
+	archiveHeaderV3Len    = 14
+	maxArchiveHeaderV3Len = 1024
+
+	// Feature flags name format features a reader must understand to
+	// decode the archive. Readers reject archives with unknown flags.
+	featureTombstones        = uint32(1) << 0 // a tombstones stage is present
+	featureDictionaryParents = uint32(1) << 1 // the dictionary stage is parent-coded
+	featurePassthrough       = uint32(1) << 2 // a passthrough stage replaces the token and dictionary stages
+	knownFeatures            = featureTombstones | featureDictionaryParents | featurePassthrough
+
+	// Checksum algorithm IDs on the wire.
+	checksumWireNone   = uint8(0)
+	checksumWireCRC32C = uint8(1)
+
+	archiveChecksumLen = 4
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// archiveHeader is the decoded archive header. The version 3 fields are zero
+// for version 2 archives.
+type archiveHeader struct {
+	version    uint16
+	stageCount uint16
+
+	features      uint32
+	rows          uint64
+	tokenBitWidth uint8
+	checksum      uint8
+
+	// raw holds the header bytes exactly as read, which the checksum
+	// covers.
+	raw []byte
+}
+
+// newArchiveHeader describes a for writing.
+func newArchiveHeader(a *Archive, version uint16, checksum uint8, stageCount int) archiveHeader {
+	h := archiveHeader{version: version, stageCount: uint16(stageCount)}
+	if version == FormatVersion3 {
+		if a.tombstones != nil {
+			h.features |= featureTombstones
+		}
+		if a.passthrough {
+			h.features |= featurePassthrough
+		}
+		h.rows = uint64(a.Rows())
+		h.tokenBitWidth = a.tokenBitWidth()
+		h.checksum = checksum
+	}
+	return h
+}
+
+// appendTo appends the encoded header to dst.
+func (h archiveHeader) appendTo(dst []byte) []byte {
+	dst = append(dst, archiveMagic...)
+	dst = binary.LittleEndian.AppendUint16(dst, h.version)
+	if h.version == FormatVersion3 {
+		dst = binary.LittleEndian.AppendUint16(dst, archiveHeaderV3Len)
+		dst = binary.LittleEndian.AppendUint32(dst, h.features)
+		dst = binary.LittleEndian.AppendUint64(dst, h.rows)
+		dst = append(dst, h.tokenBitWidth, h.checksum)
+	}
+	return binary.LittleEndian.AppendUint16(dst, h.stageCount)
+}
+
+// checksumLen returns the length of the checksum trailing the stages.
+func (h archiveHeader) checksumLen() int {
+	if h.checksum == checksumWireCRC32C {
+		return archiveChecksumLen
+	}
+	return 0
+}
+
+// readArchiveHeader reads and checks the archive header, returning it and
+// the bytes consumed.
+func readArchiveHeader(r io.Reader) (archiveHeader, int64, error) {
+	var h archiveHeader
+	read := func(n int) ([]byte, error) {
+		start := len(h.raw)
+		h.raw = append(h.raw, make([]byte, n)...)
+		m, err := io.ReadFull(r, h.raw[start:])
+		h.raw = h.raw[:start+m]
+		return h.raw[start:], err
+	}
+	offset := func() int64 { return int64(len(h.raw)) }
+
+	magic, err := read(4)
+	if err != nil {
+		return h, offset(), fmt.Errorf("read archive magic at offset 0: %w", err)
+	}
+	if string(magic) != archiveMagic {
+		return h, offset(), corruptf("invalid archive magic at offset 0: %q", string(magic))
+	}
+
+	versionOffset := offset()
+	b, err := read(2)
+	if err != nil {
+		return h, offset(), fmt.Errorf("read archive version at offset %d: %w", versionOffset, err)
+	}
+	h.version = binary.LittleEndian.Uint16(b)
+	if h.version != FormatVersion2 && h.version != FormatVersion3 {
+		return h, offset(), fmt.Errorf("%w at offset %d: %d", ErrUnsupportedVersion, versionOffset, h.version)
+	}
+
+	if h.version == FormatVersion3 {
+		headerOffset := offset()
+		b, err := read(2)
+		if err != nil {
+			return h, offset(), fmt.Errorf("read header length at offset %d: %w", headerOffset, err)
+		}
+		headerLen := int(binary.LittleEndian.Uint16(b))
+		if headerLen < archiveHeaderV3Len || headerLen > maxArchiveHeaderV3Len {
+			return h, offset(), corruptf("invalid header length at offset %d: %d", headerOffset, headerLen)
+		}
+		fieldsOffset := offset()
+		fields, err := read(headerLen)
+		if err != nil {
+			return h, offset(), fmt.Errorf("read header at offset %d: %w", fieldsOffset, err)
+		}
+		h.features = binary.LittleEndian.Uint32(fields[0:4])
+		h.rows = binary.LittleEndian.Uint64(fields[4:12])
+		h.tokenBitWidth = fields[12]
+		h.checksum = fields[13]
+		if unknown := h.features &^ knownFeatures; unknown != 0 {
+			return h, offset(), fmt.Errorf("%w at offset %d: unknown feature flags %#x", ErrUnsupportedVersion, fieldsOffset, unknown)
+		}
+		if h.checksum != checksumWireNone && h.checksum != checksumWireCRC32C {
+			return h, offset(), fmt.Errorf("%w at offset %d: unknown checksum algorithm %d", ErrUnsupportedVersion, fieldsOffset+13, h.checksum)
+		}
+		if h.features&featurePassthrough != 0 {
+			if h.tokenBitWidth != passthroughTokenBitWidth {
+				return h, offset(), corruptf("invalid passthrough token bit width at offset %d: %d", fieldsOffset+12, h.tokenBitWidth)
+			}
+		} else if !validTokenBitWidth(h.tokenBitWidth) {
+			return h, offset(), corruptf("invalid token bit width at offset %d: %d", fieldsOffset+12, h.tokenBitWidth)
+		}
+	}
+
+	stageCountOffset := offset()
+	b, err = read(2)
+	if err != nil {
+		return h, offset(), fmt.Errorf("read stage count at offset %d: %w", stageCountOffset, err)
+	}
+	h.stageCount = binary.LittleEndian.Uint16(b)
+	if h.stageCount == 0 || h.stageCount > maxArchiveStages {
+		return h, offset(), corruptf("invalid stage count at offset %d: %d", stageCountOffset, h.stageCount)
+	}
+	return h, offset(), nil
+}
+
+// requiredStages returns the stages an archive with header h must contain.
+func (h archiveHeader) requiredStages() []string {
+	if h.features&featurePassthrough != 0 {
+		return []string{stagePassthrough, stageStringBoundaries}
+	}
+	return []string{stageCompressedData, stageStringBoundaries, stageDictionary, stageTokenBoundaries}
+}
+
+// check verifies that a decoded archive matches the version 3 header.
+// dictionaryParents reports whether the dictionary stage was parent-coded;
+// only version 3 archives may use that layout or a passthrough stage, and
+// only with their feature flags set.
+func (h archiveHeader) check(a *Archive, dictionaryParents bool) error {
+	if dictionaryParents != (h.features&featureDictionaryParents != 0) {
+		return corruptf("dictionary parents feature flag does not match dictionary stage")
+	}
+	if a.passthrough != (h.features&featurePassthrough != 0) {
+		return corruptf("passthrough feature flag does not match passthrough stage")
+	}
+	if h.version < FormatVersion3 {
+		return nil
+	}
+	if rows := uint64(a.Rows()); rows != h.rows {
+		return corruptf("header declares %d rows, archive has %d", h.rows, rows)
+	}
+	if width := a.tokenBitWidth(); width != h.tokenBitWidth {
+		return corruptf("header declares %d-bit tokens, compressed_data has %d", h.tokenBitWidth, width)
+	}
+	if hasTombstones := a.tombstones != nil; hasTombstones != (h.features&featureTombstones != 0) {
+		return corruptf("tombstones feature flag does not match tombstones stage")
+	}
+	return nil
+}
+
+// verifyChecksum compares the checksum trailing the archive with the
+// checksum of the bytes before it.
+func verifyChecksum(stored []byte, computed uint32) error {
+	if got := binary.LittleEndian.Uint32(stored); got != computed {
+		return corruptf("archive checksum mismatch: stored %#08x, computed %#08x", got, computed)
+	}
+	return nil
+}
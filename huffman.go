@@ -0,0 +1,329 @@
+package onpair
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// maxHuffmanCodeLen bounds canonical Huffman code lengths so the decoder can
+// keep a small per-length table and codes fit comfortably in a uint64 buffer.
+const maxHuffmanCodeLen = 24
+
+// Canonical Huffman compressed_data payload:
+//
+//	tokenCount  = uint32 little-endian
+//	symbolCount = uint32 little-endian
+//	repeat symbolCount times, in ascending token ID order:
+//	  idDelta = uvarint (token ID minus previous token ID, first from 0)
+//	  codeLen = uint8 in [1, maxHuffmanCodeLen]
+//	bitstream = codes packed MSB-first, zero-padded to a byte boundary
+
+// huffmanTokenStream returns the Huffman compressed_data stage. The code and
+// size come from the token counts; the bitstream is coded as it is written.
+func huffmanTokenStream(a *Archive, tokenBitWidth uint8) (streamStage, error) {
+	counts, err := streamTokenCounts(a, tokenBitWidth)
+	if err != nil {
+		return streamStage{}, err
+	}
+
+	symbols := make([]uint16, 0, 1024)
+	for tokenID, count := range counts {
+		if count > 0 {
+			symbols = append(symbols, uint16(tokenID))
+		}
+	}
+	lengths := huffmanCodeLengths(symbols, counts)
+	codes := canonicalHuffmanCodes(symbols, lengths)
+
+	table := make([]byte, 8, 8+len(symbols)*3)
+	binary.LittleEndian.PutUint32(table[:4], uint32(a.tokenCount()))
+	binary.LittleEndian.PutUint32(table[4:8], uint32(len(symbols)))
+	prev := 0
+	var bits uint64
+	for i, symbol := range symbols {
+		table = binary.AppendUvarint(table, uint64(int(symbol)-prev))
+		table = append(table, lengths[i])
+		prev = int(symbol)
+		bits += uint64(counts[symbol]) * uint64(lengths[i])
+	}
+	payloadLen := uint64(len(table)) + (bits+7)/8
+	if payloadLen > uint64(maxStagePayloadBytes) {
+		return streamStage{}, fmt.Errorf("compressed_data huffman payload too large: %d", payloadLen)
+	}
+
+	codeBySymbol := make([]uint32, len(counts))
+	lenBySymbol := make([]uint8, len(counts))
+	for i, symbol := range symbols {
+		codeBySymbol[symbol] = codes[i]
+		lenBySymbol[symbol] = lengths[i]
+	}
+
+	return streamStage{
+		name:   stageCompressedData,
+		params: compressedDataParams(compressedDataEncodingHuffman, tokenBitWidth),
+		size:   int(payloadLen),
+		write: func(w io.Writer) error {
+			if _, err := writeBytes(w, table); err != nil {
+				return err
+			}
+			buf := make([]byte, 0, streamBufferSize)
+			var bitBuf uint64
+			bitsInBuf := uint(0)
+			err := a.forEachTokenChunk(func(_ int, tokens []uint16) error {
+				for _, tokenID := range tokens {
+					// A code adds at most three whole bytes.
+					if len(buf)+3 > cap(buf) {
+						if _, err := writeBytes(w, buf); err != nil {
+							return err
+						}
+						buf = buf[:0]
+					}
+					bitBuf = bitBuf<<lenBySymbol[tokenID] | uint64(codeBySymbol[tokenID])
+					bitsInBuf += uint(lenBySymbol[tokenID])
+					for bitsInBuf >= 8 {
+						bitsInBuf -= 8
+						buf = append(buf, byte(bitBuf>>bitsInBuf))
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if bitsInBuf > 0 {
+				buf = append(buf, byte(bitBuf<<(8-bitsInBuf)))
+			}
+			_, err = writeBytes(w, buf)
+			return err
+		},
+	}, nil
+}
+
+func decodeCompressedDataStageHuffman(payload []byte, tokenBitWidth uint8) ([]uint16, error) {
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("compressed_data huffman payload too short: %d", len(payload))
+	}
+
+	compressedLen := binary.LittleEndian.Uint32(payload[:4])
+	if compressedLen > uint32(maxCompressedTokenRead) {
+		return nil, fmt.Errorf("compressed token count too large: %d", compressedLen)
+	}
+	symbolCount := binary.LittleEndian.Uint32(payload[4:8])
+	// Each table entry takes at least two bytes.
+	if symbolCount > maxTokenID+1 || uint64(symbolCount)*2 > uint64(len(payload)-8) {
+		return nil, fmt.Errorf("compressed_data huffman symbol count too large: %d", symbolCount)
+	}
+	if compressedLen > 0 && symbolCount == 0 {
+		return nil, fmt.Errorf("compressed_data huffman table is empty for %d tokens", compressedLen)
+	}
+
+	widthLimit := int(maxTokenIDForBitWidth(tokenBitWidth))
+	symbols := make([]uint16, symbolCount)
+	lengths := make([]uint8, symbolCount)
+	inIdx := 8
+	next := 0
+	for i := range symbols {
+		delta, n := binary.Uvarint(payload[inIdx:])
+		if n <= 0 {
+			return nil, fmt.Errorf("compressed_data huffman table underrun at symbol %d", i)
+		}
+		inIdx += n
+		if i > 0 && delta == 0 {
+			return nil, fmt.Errorf("compressed_data huffman symbols not increasing at symbol %d", i)
+		}
+		if delta > uint64(maxTokenID-next) {
+			return nil, fmt.Errorf("compressed_data huffman symbol out of range at symbol %d", i)
+		}
+		next += int(delta)
+		if next > widthLimit {
+			return nil, fmt.Errorf("compressed_data huffman symbol out of %d-bit range at symbol %d: %d", tokenBitWidth, i, next)
+		}
+		if inIdx >= len(payload) {
+			return nil, fmt.Errorf("compressed_data huffman table underrun at symbol %d", i)
+		}
+		codeLen := payload[inIdx]
+		inIdx++
+		if codeLen == 0 || codeLen > maxHuffmanCodeLen {
+			return nil, fmt.Errorf("compressed_data huffman invalid code length at symbol %d: %d", i, codeLen)
+		}
+		symbols[i] = uint16(next)
+		lengths[i] = codeLen
+	}
+
+	// Canonical decoding tables: symbols sorted by (length, ID) and the number
+	// of codes of each length.
+	var lengthCounts [maxHuffmanCodeLen + 1]int
+	for _, codeLen := range lengths {
+		lengthCounts[codeLen]++
+	}
+	left := 1
+	for codeLen := 1; codeLen <= maxHuffmanCodeLen; codeLen++ {
+		left <<= 1
+		left -= lengthCounts[codeLen]
+		if left < 0 {
+			return nil, fmt.Errorf("compressed_data huffman code lengths are over-subscribed")
+		}
+	}
+	sorted := canonicalHuffmanOrder(symbols, lengths)
+
+	// Every code is at least one bit long, so the stream bounds the token
+	// count; check it before allocating.
+	stream := payload[inIdx:]
+	if uint64(compressedLen) > uint64(len(stream))*8 {
+		return nil, fmt.Errorf("compressed_data huffman payload too short for %d tokens: %d bytes", compressedLen, len(stream))
+	}
+	compressedData := make([]uint16, compressedLen)
+	bitPos := 0
+	totalBits := len(stream) * 8
+	for i := range compressedData {
+		code, first, index := 0, 0, 0
+		decoded := false
+		for codeLen := 1; codeLen <= maxHuffmanCodeLen; codeLen++ {
+			if bitPos >= totalBits {
+				return nil, fmt.Errorf("compressed_data huffman payload underrun at token %d", i)
+			}
+			code |= int(stream[bitPos>>3]>>(7-uint(bitPos&7))) & 1
+			bitPos++
+			count := lengthCounts[codeLen]
+			if code-first < count {
+				compressedData[i] = sorted[index+code-first]
+				decoded = true
+				break
+			}
+			index += count
+			first = (first + count) << 1
+			code <<= 1
+		}
+		if !decoded {
+			return nil, fmt.Errorf("compressed_data huffman invalid code at token %d", i)
+		}
+	}
+	if (bitPos+7)/8 != len(stream) {
+		return nil, fmt.Errorf("compressed_data huffman trailing bytes: %d", len(stream)-(bitPos+7)/8)
+	}
+	if bitPos%8 != 0 && stream[len(stream)-1]&(0xFF>>uint(bitPos%8)) != 0 {
+		return nil, fmt.Errorf("compressed_data huffman payload has non-zero padding")
+	}
+	return compressedData, nil
+}
+
+// huffmanCodeLengths computes code lengths for symbols (ascending IDs) from
+// their counts, limited to maxHuffmanCodeLen by flattening the counts and
+// rebuilding when the optimal tree is too deep.
+func huffmanCodeLengths(symbols []uint16, counts []uint32) []uint8 {
+	lengths := make([]uint8, len(symbols))
+	if len(symbols) == 0 {
+		return lengths
+	}
+	if len(symbols) == 1 {
+		lengths[0] = 1
+		return lengths
+	}
+
+	weights := make([]uint64, len(symbols))
+	for i, symbol := range symbols {
+		weights[i] = uint64(counts[symbol])
+	}
+	for {
+		if huffmanBuildLengths(weights, lengths) <= maxHuffmanCodeLen {
+			return lengths
+		}
+		for i := range weights {
+			weights[i] = weights[i]/2 + 1
+		}
+	}
+}
+
+// huffmanBuildLengths fills lengths with optimal code lengths for weights
+// using the two-queue method and returns the maximum length.
+func huffmanBuildLengths(weights []uint64, lengths []uint8) int {
+	n := len(weights)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return weights[order[i]] < weights[order[j]]
+	})
+
+	// Nodes 0..n-1 are leaves in ascending weight order; n..2n-2 are internal
+	// nodes created in non-decreasing weight order.
+	nodeWeight := make([]uint64, 2*n-1)
+	parent := make([]int, 2*n-1)
+	for i, symbolIdx := range order {
+		nodeWeight[i] = weights[symbolIdx]
+	}
+	leaf, internal := 0, n
+	pick := func(next int) int {
+		if leaf < n && (internal >= next || nodeWeight[leaf] <= nodeWeight[internal]) {
+			leaf++
+			return leaf - 1
+		}
+		internal++
+		return internal - 1
+	}
+	for next := n; next < 2*n-1; next++ {
+		a := pick(next)
+		b := pick(next)
+		nodeWeight[next] = nodeWeight[a] + nodeWeight[b]
+		parent[a] = next
+		parent[b] = next
+	}
+
+	depth := make([]int, 2*n-1)
+	maxLen := 0
+	for node := 2*n - 3; node >= 0; node-- {
+		depth[node] = depth[parent[node]] + 1
+	}
+	for i, symbolIdx := range order {
+		lengths[symbolIdx] = uint8(min(depth[i], 255))
+		if depth[i] > maxLen {
+			maxLen = depth[i]
+		}
+	}
+	return maxLen
+}
+
+// canonicalHuffmanOrder returns symbols sorted by (code length, symbol ID),
+// the order in which canonical codes are assigned.
+func canonicalHuffmanOrder(symbols []uint16, lengths []uint8) []uint16 {
+	idx := make([]int, len(symbols))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return lengths[idx[i]] < lengths[idx[j]]
+	})
+	sorted := make([]uint16, len(symbols))
+	for i, symbolIdx := range idx {
+		sorted[i] = symbols[symbolIdx]
+	}
+	return sorted
+}
+
+// canonicalHuffmanCodes assigns canonical codes to symbols (ascending IDs)
+// with the given lengths.
+func canonicalHuffmanCodes(symbols []uint16, lengths []uint8) []uint32 {
+	idx := make([]int, len(symbols))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return lengths[idx[i]] < lengths[idx[j]]
+	})
+
+	codes := make([]uint32, len(symbols))
+	code := uint32(0)
+	prevLen := uint8(0)
+	for _, symbolIdx := range idx {
+		codeLen := lengths[symbolIdx]
+		if prevLen != 0 {
+			code = (code + 1) << (codeLen - prevLen)
+		}
+		codes[symbolIdx] = code
+		prevLen = codeLen
+	}
+	return codes
+}
@@ -0,0 +1,62 @@
+package onpair
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// ReaderOptions bounds the resources ReadFromWithOptions may spend on one
+// archive, so archives from untrusted sources can be rejected before large
+// allocations. Zero fields use the package limits, which also cap any larger
+// value.
+type ReaderOptions struct {
+	MaxTotalBytes             int64 // Serialized bytes consumed from the reader
+	MaxRows                   int   // Rows declared by string_boundaries and tombstones
+	MaxDictionaryBytes        int   // Dictionary size in bytes
+	MaxDecompressedStageBytes int   // In-memory size of any one stage after decoding, including flate output
+}
+
+// readLimits holds ReaderOptions resolved against the package limits.
+type readLimits struct {
+	totalBytes      int64
+	rows            int
+	dictionaryBytes int
+	stageBytes      int
+}
+
+var defaultReadLimits = ReaderOptions{}.limits()
+
+func (o ReaderOptions) limits() readLimits {
+	l := readLimits{
+		totalBytes:      math.MaxInt64,
+		rows:            maxBoundaryCountRead - 1,
+		dictionaryBytes: maxStagePayloadBytes,
+		stageBytes:      maxStagePayloadBytes,
+	}
+	if o.MaxTotalBytes > 0 {
+		l.totalBytes = o.MaxTotalBytes
+	}
+	if o.MaxRows > 0 && o.MaxRows < l.rows {
+		l.rows = o.MaxRows
+	}
+	if o.MaxDictionaryBytes > 0 && o.MaxDictionaryBytes < l.dictionaryBytes {
+		l.dictionaryBytes = o.MaxDictionaryBytes
+	}
+	if o.MaxDecompressedStageBytes > 0 && o.MaxDecompressedStageBytes < l.stageBytes {
+		l.stageBytes = o.MaxDecompressedStageBytes
+	}
+	return l
+}
+
+// limitExceeded reports a value over a reader limit.
+func limitExceeded(what string, value, limit int64) error {
+	return fmt.Errorf("%w: %s %d exceeds %d", ErrLimitExceeded, what, value, limit)
+}
+
+// ReadFromWithOptions is like ReadFrom but enforces the resource limits in
+// opts. Stage sizes and declared counts are checked before the matching
+// buffers are allocated; violations match ErrLimitExceeded.
+func (a *Archive) ReadFromWithOptions(r io.Reader, opts ReaderOptions) (int64, error) {
+	return a.readFrom(r, opts.limits())
+}
@@ -0,0 +1,174 @@
+package onpair
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Merge concatenates the live rows of archives into a new archive, in order.
+// Deleted rows are dropped.
+//
+// When every archive shares the same dictionary the token streams are
+// appended as-is, and passthrough archives merge into a passthrough archive.
+// Otherwise all rows are decoded and re-encoded against a new model trained
+// on the merged rows, falling back to passthrough as Encode does; use
+// MergeWithModel to choose the model. Re-encoding uses the options the first
+// archive was encoded with, at the widest token bit width of the inputs, and
+// the result keeps the first archive's in-memory layout (see
+// WithPackedTokenStorage and WithCompactBoundaries).
+func Merge(archives ...*Archive) (*Archive, error) {
+	if err := validateMergeInputs(archives); err != nil {
+		return nil, err
+	}
+
+	first := archives[0]
+	shared := true
+	bitWidth := first.tokenBitWidth()
+	for _, a := range archives[1:] {
+		if a.passthrough != first.passthrough || !sameDictionary(a, first.Dictionary, first.TokenBoundaries) {
+			shared = false
+		}
+		if a.tokenBitWidth() > bitWidth {
+			bitWidth = a.tokenBitWidth()
+		}
+	}
+
+	cfg := first.config
+	cfg.PackedTokenStorage = cfg.PackedTokenStorage || first.packed != nil
+	cfg.CompactBoundaries = cfg.CompactBoundaries || first.compactBoundaries != nil
+	enc := &Encoder{config: cfg}
+
+	if shared && first.passthrough {
+		data, endPositions, err := decodeMergeRows(archives)
+		if err != nil {
+			return nil, err
+		}
+		return enc.newPassthroughArchive(data, endPositions), nil
+	}
+	if shared {
+		merged := &Archive{
+			StringBoundaries:        []int{0},
+			Dictionary:              append([]byte(nil), first.Dictionary...),
+			TokenBoundaries:         append([]uint32(nil), first.TokenBoundaries...),
+			compressedTokenBitWidth: bitWidth,
+		}
+		for _, a := range archives {
+			appendArchiveTokens(merged, a)
+		}
+		enc.finishArchive(merged)
+		return merged, nil
+	}
+
+	data, endPositions, err := decodeMergeRows(archives)
+	if err != nil {
+		return nil, err
+	}
+	// Passthrough inputs leave no room for merged tokens; retrain at the
+	// narrowest width that has some.
+	if bitWidth < minTokenBitWidth {
+		bitWidth = minTokenBitWidth
+	}
+	enc.config.TokenBitWidth = bitWidth
+	return enc.encodeFlattened(data, endPositions), nil
+}
+
+// MergeWithModel concatenates the live rows of archives into a new archive
+// encoded with model. Archives already encoded with the model's dictionary
+// are appended without re-encoding; all others are decoded and re-encoded.
+// The result is built as Model.Encode builds it, applying the model's
+// post-encoding options.
+func MergeWithModel(model *Model, archives ...*Archive) (*Archive, error) {
+	if model == nil || !model.Trained() {
+		return nil, ErrUntrainedModel
+	}
+	if err := validateMergeInputs(archives); err != nil {
+		return nil, err
+	}
+
+	// Collect the rows' tokens, then build the archive the way Model.Encode
+	// does so the model's post-encoding settings apply.
+	enc := &Encoder{config: model.config}
+	merged := &Archive{StringBoundaries: []int{0}}
+	for _, a := range archives {
+		if sameDictionary(a, model.dictionary, model.tokenBoundaries) {
+			appendArchiveTokens(merged, a)
+			continue
+		}
+
+		data, endPositions, err := decodeMergeRows([]*Archive{a})
+		if err != nil {
+			return nil, err
+		}
+		compressedData, stringBoundaries := enc.compress(data, endPositions, model.matcher)
+		base := len(merged.CompressedData)
+		merged.CompressedData = append(merged.CompressedData, compressedData...)
+		for _, boundary := range stringBoundaries[1:] {
+			merged.StringBoundaries = append(merged.StringBoundaries, base+boundary)
+		}
+	}
+	return model.newArchive(merged.CompressedData, merged.StringBoundaries), nil
+}
+
+func validateMergeInputs(archives []*Archive) error {
+	if len(archives) == 0 {
+		return errors.New("no archives to merge")
+	}
+	for i, a := range archives {
+		if a == nil {
+			return fmt.Errorf("archive %d is nil", i)
+		}
+		if err := validateArchiveStructure(a); err != nil {
+			return fmt.Errorf("invalid archive %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func sameDictionary(a *Archive, dictionary []byte, tokenBoundaries []uint32) bool {
+	return bytes.Equal(a.Dictionary, dictionary) && slices.Equal(a.TokenBoundaries, tokenBoundaries)
+}
+
+// appendArchiveTokens appends the token streams of src's live rows to dst.
+// Both archives must share the same dictionary.
+func appendArchiveTokens(dst *Archive, src *Archive) {
+	base := len(dst.CompressedData)
+	if src.tombstones == nil {
+		end := src.boundaryAt(src.boundaryCount() - 1)
+		dst.CompressedData = append(dst.CompressedData, src.tokenSlice(0, end)...)
+		for i := 1; i < src.boundaryCount(); i++ {
+			dst.StringBoundaries = append(dst.StringBoundaries, base+src.boundaryAt(i))
+		}
+		return
+	}
+
+	for i := 0; i < src.Rows(); i++ {
+		if src.IsDeleted(i) {
+			continue
+		}
+		dst.CompressedData = append(dst.CompressedData, src.tokenSlice(src.rowSpan(i))...)
+		dst.StringBoundaries = append(dst.StringBoundaries, len(dst.CompressedData))
+	}
+}
+
+// decodeMergeRows decodes the live rows of archives into a flattened buffer
+// with end positions, in the layout produced by flattenStrings.
+func decodeMergeRows(archives []*Archive) ([]byte, []int, error) {
+	var data []byte
+	endPositions := []int{0}
+	for i, a := range archives {
+		for row := 0; row < a.Rows(); row++ {
+			if a.IsDeleted(row) {
+				continue
+			}
+			var err error
+			data, err = a.AppendRow(data, row)
+			if err != nil {
+				return nil, nil, fmt.Errorf("decode archive %d row %d: %w", i, row, err)
+			}
+			endPositions = append(endPositions, len(data))
+		}
+	}
+	return data, endPositions, nil
+}
@@ -0,0 +1,95 @@
+package onpair
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// SetMetadata attaches key/value metadata, such as the source file or the
+// model that produced the archive. It is written as an optional metadata
+// stage, which readers that predate it skip. The map is copied; a nil or
+// empty map removes the metadata.
+//
+// Slice and Split carry the metadata over to their results; Merge and
+// MergeWithModel results start without metadata.
+func (a *Archive) SetMetadata(metadata map[string]string) {
+	if len(metadata) == 0 {
+		a.metadata = nil
+		return
+	}
+	a.metadata = maps.Clone(metadata)
+}
+
+// Metadata returns a copy of the archive's metadata, or nil if it has none.
+func (a *Archive) Metadata() map[string]string {
+	return maps.Clone(a.metadata)
+}
+
+// metadataStream returns the metadata stage: the entry count, then each
+// entry as a uvarint-prefixed key and value, in key order.
+func metadataStream(metadata map[string]string) (streamStage, error) {
+	keys := slices.Sorted(maps.Keys(metadata))
+	payload := binary.LittleEndian.AppendUint32(nil, uint32(len(keys)))
+	for _, key := range keys {
+		value := metadata[key]
+		payload = binary.AppendUvarint(payload, uint64(len(key)))
+		payload = append(payload, key...)
+		payload = binary.AppendUvarint(payload, uint64(len(value)))
+		payload = append(payload, value...)
+		if len(payload) > maxStagePayloadBytes {
+			return streamStage{}, fmt.Errorf("metadata too large: more than %d bytes", maxStagePayloadBytes)
+		}
+	}
+	return bytesStage(stageMetadata, []byte{stageMetadataParamEntries}, payload), nil
+}
+
+func decodeMetadataStage(dst *Archive, params []byte, payload []byte, limits readLimits) error {
+	if len(params) != 1 || params[0] != stageMetadataParamEntries {
+		return fmt.Errorf("invalid metadata params: %v", params)
+	}
+	if len(payload) < 4 {
+		return fmt.Errorf("metadata payload too short: %d", len(payload))
+	}
+
+	count := binary.LittleEndian.Uint32(payload[:4])
+	rest := payload[4:]
+	// Every entry takes at least two bytes, for its two empty lengths.
+	if uint64(count) > uint64(len(rest)/2) {
+		return fmt.Errorf("metadata entry count %d exceeds payload size %d", count, len(payload))
+	}
+
+	readString := func(what string, entry int) (string, error) {
+		n, size := binary.Uvarint(rest)
+		if size <= 0 || n > uint64(len(rest)-size) {
+			return "", fmt.Errorf("truncated metadata %s in entry %d", what, entry)
+		}
+		s := string(rest[size : size+int(n)])
+		rest = rest[size+int(n):]
+		return s, nil
+	}
+
+	metadata := make(map[string]string, count)
+	for i := range int(count) {
+		key, err := readString("key", i)
+		if err != nil {
+			return err
+		}
+		value, err := readString("value", i)
+		if err != nil {
+			return err
+		}
+		if _, ok := metadata[key]; ok {
+			return fmt.Errorf("duplicate metadata key %q", key)
+		}
+		metadata[key] = value
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("metadata has %d trailing bytes", len(rest))
+	}
+	if len(metadata) > 0 {
+		dst.metadata = metadata
+	}
+	return nil
+}
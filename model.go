@@ -6,6 +6,9 @@ type Model struct {
 	matcher         *Matcher
 	dictionary      []byte
 	tokenBoundaries []uint32
+
+	// training holds Evaluate's measurements of the training rows.
+	training EvalReport
 }
 
 // NewModel creates an empty model with the provided options.
@@ -26,18 +29,31 @@ func TrainModel(strings []string, opts ...Option) (*Model, error) {
 	return m, nil
 }
 
-// Train builds the dictionary and matcher for subsequent Encode calls.
+// Train builds the dictionary and matcher for subsequent Encode calls, and
+// measures how it fits the training rows for Evaluate.
 func (m *Model) Train(strings []string) error {
+	if err := validateConfig(m.config); err != nil {
+		return err
+	}
 	enc := &Encoder{config: m.config}
 	data, endPositions := flattenStrings(strings)
-	matcher, dict, tokenBoundaries := enc.train(data, endPositions)
+	var shuffledIndices, sampleIndices []int
+	sampleBytes := 0
+	if len(endPositions) > 1 {
+		shuffledIndices, sampleIndices, sampleBytes = enc.trainingSample(data, endPositions)
+	}
+	matcher, dict, tokenBoundaries := enc.trainSample(data, endPositions, sampleIndices, sampleBytes)
 	m.matcher = matcher
 	m.dictionary = append(m.dictionary[:0], dict...)
 	m.tokenBoundaries = append(m.tokenBoundaries[:0], tokenBoundaries...)
+	m.training = m.trainingBaseline(strings, shuffledIndices, sampleIndices)
 	return nil
 }
 
-// Encode compresses strings using a previously trained model.
+// Encode compresses strings using a previously trained model. Unlike
+// Encoder.Encode it never returns a passthrough archive, so every archive a
+// model encodes shares its dictionary and merges with MergeWithModel without
+// re-encoding, even when storing the rows as is would take less space.
 func (m *Model) Encode(strings []string) (*Archive, error) {
 	if m.matcher == nil {
 		return nil, ErrUntrainedModel
@@ -45,16 +61,16 @@ func (m *Model) Encode(strings []string) (*Archive, error) {
 	enc := &Encoder{config: m.config}
 	data, endPositions := flattenStrings(strings)
 	compressedData, stringBoundaries := enc.compress(data, endPositions, m.matcher)
+	return m.newArchive(compressedData, stringBoundaries), nil
+}
 
+// newArchive assembles an Archive from tokens encoded with the model's
+// dictionary and applies the model's post-encoding passes.
+func (m *Model) newArchive(compressedData []uint16, stringBoundaries []int) *Archive {
+	enc := &Encoder{config: m.config}
 	dict := append([]byte(nil), m.dictionary...)
 	tokenBoundaries := append([]uint32(nil), m.tokenBoundaries...)
-	return &Archive{
-		CompressedData:          compressedData,
-		StringBoundaries:        stringBoundaries,
-		Dictionary:              dict,
-		TokenBoundaries:         tokenBoundaries,
-		compressedTokenBitWidth: resolveTokenBitWidth(enc.config),
-	}, nil
+	return enc.newArchive(compressedData, stringBoundaries, dict, tokenBoundaries)
 }
 
 // Trained reports whether the model is ready for Encode.
@@ -64,19 +80,73 @@ func (m *Model) Trained() bool {
 
 // Encode compresses a collection of strings into an Archive.
 func (e *Encoder) Encode(strings []string) (*Archive, error) {
+	if err := validateConfig(e.config); err != nil {
+		return nil, err
+	}
 	data, endPositions := flattenStrings(strings)
+	return e.encodeFlattened(data, endPositions), nil
+}
 
+// encodeFlattened trains on and compresses flattened rows. It returns a
+// passthrough archive instead when the OnPair archive would need more space
+// than the input, which is the SpaceUsed of a passthrough archive.
+func (e *Encoder) encodeFlattened(data []byte, endPositions []int) *Archive {
 	// Train the dictionary
 	matcher, dict, tokenBoundaries := e.train(data, endPositions)
 
 	// Compress the data
 	compressedData, stringBoundaries := e.compress(data, endPositions, matcher)
 
-	return &Archive{
+	a := e.newArchive(compressedData, stringBoundaries, dict, tokenBoundaries)
+	if e.fallsBack(a, len(data)) {
+		return e.newPassthroughArchive(data, endPositions)
+	}
+	return a
+}
+
+// fallsBack reports whether Encode replaces a, encoded from inputBytes of
+// rows, with a passthrough archive.
+func (e *Encoder) fallsBack(a *Archive, inputBytes int) bool {
+	return !e.config.NoPassthrough && a.SpaceUsed() > inputBytes
+}
+
+// newArchive assembles an Archive from encoder output and applies the
+// configured post-encoding passes.
+func (e *Encoder) newArchive(compressedData []uint16, stringBoundaries []int, dict []byte, tokenBoundaries []uint32) *Archive {
+	a := &Archive{
 		CompressedData:          compressedData,
 		StringBoundaries:        stringBoundaries,
 		Dictionary:              dict,
 		TokenBoundaries:         tokenBoundaries,
 		compressedTokenBitWidth: resolveTokenBitWidth(e.config),
-	}, nil
+	}
+	if e.config.PruneDictionary {
+		pruneUnusedTokens(a)
+	}
+	if e.config.AutoTokenBitWidth {
+		if bits := tokenBitWidthFor(len(a.TokenBoundaries) - 1); bits < a.tokenBitWidth() {
+			a.compressedTokenBitWidth = bits
+		}
+	}
+	if e.config.FrequencyOrdered {
+		renumberTokensByFrequency(a)
+	}
+	e.finishArchive(a)
+	return a
+}
+
+// finishArchive applies the configured in-memory layout to a and marks it
+// validated.
+func (e *Encoder) finishArchive(a *Archive) {
+	if e.config.PackedTokenStorage && !a.passthrough {
+		a.packed = packTokens(a.CompressedData, a.tokenBitWidth())
+		a.CompressedData = nil
+	}
+	if e.config.CompactBoundaries && boundariesFitUint32(a.StringBoundaries) {
+		a.compactBoundaries = compactBoundaries(a.StringBoundaries)
+		a.StringBoundaries = nil
+	}
+	a.config = e.config
+	a.slots = &lazySlots{}
+	a.markValidated()
 }
@@ -3,6 +3,7 @@ package onpair
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"math"
 	"sort"
 )
@@ -13,6 +14,12 @@ const (
 	maxTokenID12Bit  = 4095  // maxTokenID12Bit is the maximum token ID representable in 12 bits.
 	tokenBitWidth12  = uint8(12)
 	tokenBitWidth16  = uint8(16)
+	minTokenBitWidth = uint8(9) // minTokenBitWidth is the narrowest width that still holds all single-byte tokens plus merges.
+	maxTokenBitWidth = tokenBitWidth16
+
+	// passthroughTokenBitWidth is the token width of passthrough archives,
+	// which store one byte per input byte (see passthrough.go).
+	passthroughTokenBitWidth = uint8(8)
 )
 
 // Config holds configuration for the compressor.
@@ -20,10 +27,16 @@ type Config struct {
 	Threshold           uint16 // Minimum frequency to merge tokens (0 = dynamic)
 	MaxTokenID          uint16 // Maximum token ID (0 = default, max 65535)
 	MaxTokenLen         int    // Maximum token length (0 = unlimited)
-	TokenBitWidth       uint8  // Encoded token bit-width for archives (0 = default 16, supported: 12 or 16)
+	TokenBitWidth       uint8  // Encoded token bit-width for archives (0 = default 16, supported: 9-16)
+	AutoTokenBitWidth   bool   // Use the narrowest bit-width that fits the trained dictionary.
 	TrainingSampleBytes int    // Maximum sampled training bytes (0 = default 1 MiB)
 	TemplateStratified  bool   // Enable template-based stratified sampling for training.
 	TemplateMaxClusters int    // Maximum number of template clusters for stratified sampling.
+	PruneDictionary     bool   // Drop dictionary tokens unused by the encoded rows.
+	FrequencyOrdered    bool   // Renumber merged tokens by usage frequency after encoding.
+	PackedTokenStorage  bool   // Keep archive tokens bit-packed in memory.
+	CompactBoundaries   bool   // Keep archive row boundaries as 32-bit offsets.
+	NoPassthrough       bool   // Keep the OnPair archive even when it is larger than the input.
 }
 
 // Option is a functional option for configuring the compressor.
@@ -53,14 +66,24 @@ func WithMaxTokenLength(n int) Option {
 }
 
 // WithTokenBitWidth configures the encoded token bit-width used in archive
-// storage calculations and serialization. Supported values: 12 or 16.
-// Any other value falls back to 16.
+// storage calculations and serialization. Supported values: 9 through 16.
+// The dictionary is capped at 2^bits-1 token IDs. Encode and Train return
+// ErrInvalidTokenBitWidth for any other value.
 func WithTokenBitWidth(bits uint8) Option {
 	return func(c *Config) {
 		c.TokenBitWidth = bits
 	}
 }
 
+// WithAutoTokenBitWidth packs archive token streams at the narrowest
+// bit-width (at least 9) that holds every token ID of the trained dictionary.
+// An explicit WithTokenBitWidth still caps the dictionary size.
+func WithAutoTokenBitWidth() Option {
+	return func(c *Config) {
+		c.AutoTokenBitWidth = true
+	}
+}
+
 // WithTrainingSampleBytes sets the maximum number of sampled bytes used to
 // train the dictionary. Non-positive values fall back to the default.
 func WithTrainingSampleBytes(n int) Option {
@@ -79,6 +102,46 @@ func WithTemplateStratifiedSampling(maxClusters int) Option {
 	}
 }
 
+// WithDictionaryPruning drops merged tokens that the encoded rows never
+// reference and renumbers the rest densely, see (*Archive).PruneDictionary.
+func WithDictionaryPruning() Option {
+	return func(c *Config) {
+		c.PruneDictionary = true
+	}
+}
+
+// WithFrequencyOrderedTokens renumbers merged tokens by how often the encoded
+// rows use them, see (*Archive).RenumberByFrequency.
+func WithFrequencyOrderedTokens() Option {
+	return func(c *Config) {
+		c.FrequencyOrdered = true
+	}
+}
+
+// WithPackedTokenStorage keeps encoded archives' token streams bit-packed in
+// memory at the archive token bit-width, see (*Archive).PackTokens.
+func WithPackedTokenStorage() Option {
+	return func(c *Config) {
+		c.PackedTokenStorage = true
+	}
+}
+
+// WithCompactBoundaries keeps encoded archives' row boundaries as 32-bit
+// offsets in memory, see (*Archive).CompactBoundaries.
+func WithCompactBoundaries() Option {
+	return func(c *Config) {
+		c.CompactBoundaries = true
+	}
+}
+
+// WithoutPassthrough makes Encode keep the OnPair archive even when a
+// passthrough archive of the raw rows would be smaller.
+func WithoutPassthrough() Option {
+	return func(c *Config) {
+		c.NoPassthrough = true
+	}
+}
+
 // Encoder trains the dictionary and compresses data.
 type Encoder struct {
 	config Config
@@ -89,6 +152,21 @@ var (
 	ErrShortBuffer = errors.New("short buffer")
 	// ErrUntrainedModel indicates Encode was called before a model was trained.
 	ErrUntrainedModel = errors.New("model is not trained")
+	// ErrRowDeleted indicates the requested row has been deleted.
+	ErrRowDeleted = errors.New("row deleted")
+	// ErrInvalidTokenBitWidth indicates a token bit-width outside 9-16 was configured.
+	ErrInvalidTokenBitWidth = errors.New("invalid token bit-width")
+	// ErrIndexOutOfRange indicates a row index outside [0, Rows()).
+	ErrIndexOutOfRange = errors.New("index out of range")
+	// ErrCorruptArchive indicates an archive, in memory or serialized, is
+	// structurally invalid.
+	ErrCorruptArchive = errors.New("corrupt archive")
+	// ErrUnsupportedVersion indicates a serialized archive uses an unknown
+	// format version.
+	ErrUnsupportedVersion = errors.New("unsupported archive version")
+	// ErrLimitExceeded indicates a serialized archive exceeds a ReaderOptions
+	// limit.
+	ErrLimitExceeded = errors.New("archive exceeds reader limit")
 )
 
 // NewEncoder creates a new encoder with the given options.
@@ -111,6 +189,16 @@ const (
 )
 
 func (e *Encoder) train(data []byte, endPositions []int) (*Matcher, []byte, []uint32) {
+	if len(endPositions) <= 1 {
+		return e.trainSample(data, endPositions, nil, 0)
+	}
+	_, sampleIndices, sampleBytes := e.trainingSample(data, endPositions)
+	return e.trainSample(data, endPositions, sampleIndices, sampleBytes)
+}
+
+// trainSample builds the dictionary from the rows at sampleIndices, which
+// hold sampleBytes bytes.
+func (e *Encoder) trainSample(data []byte, endPositions []int, sampleIndices []int, sampleBytes int) (*Matcher, []byte, []uint32) {
 	tokenBoundaries := make([]uint32, 0, singleByteTokens+4096)
 	tokenBoundaries = append(tokenBoundaries, 0)
 	dictionary := make([]byte, 0, 1024*1024)
@@ -125,40 +213,10 @@ func (e *Encoder) train(data []byte, endPositions []int) (*Matcher, []byte, []ui
 		tokenBoundaries = append(tokenBoundaries, uint32(len(dictionary)))
 	}
 
-	numStrings := len(endPositions) - 1
-	if numStrings == 0 {
+	if len(sampleIndices) == 0 {
 		return matcher, dictionary, tokenBoundaries
 	}
 
-	// Create shuffled indices
-	shuffledIndices := make([]int, numStrings)
-	for i := range shuffledIndices {
-		shuffledIndices[i] = i
-	}
-
-	// Simple deterministic shuffle (LCG)
-	state := uint64(42)
-	for i := len(shuffledIndices) - 1; i > 0; i-- {
-		state = state*6364136223846793005 + 1442695040888963407
-		j := int(state % uint64(i+1))
-		shuffledIndices[i], shuffledIndices[j] = shuffledIndices[j], shuffledIndices[i]
-	}
-
-	// Sample if data is large - use first N shuffled strings up to the configured sample size.
-	sampleIndices := shuffledIndices
-	sampleBytes := len(data)
-	trainingSampleBytes := resolveTrainingSampleBytes(e.config)
-	if len(data) > trainingSampleBytes {
-		if e.config.TemplateStratified {
-			maxClusters := resolveTemplateMaxClusters(e.config)
-			sampleIndices, sampleBytes = stratifiedSampleIndicesByTemplateKey(
-				data, endPositions, shuffledIndices, trainingSampleBytes, maxClusters,
-			)
-		} else {
-			sampleIndices, sampleBytes = sampleIndicesByBytes(shuffledIndices, endPositions, trainingSampleBytes)
-		}
-	}
-
 	// Determine threshold
 	threshold := e.config.Threshold
 	if threshold == 0 {
@@ -179,6 +237,47 @@ func (e *Encoder) train(data []byte, endPositions []int) (*Matcher, []byte, []ui
 	return matcher, dictionary, tokenBoundaries
 }
 
+// trainingSample returns the row indices in a deterministic shuffled order,
+// and the rows and bytes train builds merged tokens from.
+func (e *Encoder) trainingSample(data []byte, endPositions []int) (shuffledIndices, sampleIndices []int, sampleBytes int) {
+	shuffledIndices = shuffleIndices(len(endPositions)-1, trainingShuffleSeed)
+
+	// Sample if data is large - use first N shuffled strings up to the configured sample size.
+	sampleIndices = shuffledIndices
+	sampleBytes = len(data)
+	trainingSampleBytes := resolveTrainingSampleBytes(e.config)
+	if len(data) > trainingSampleBytes {
+		if e.config.TemplateStratified {
+			maxClusters := resolveTemplateMaxClusters(e.config)
+			sampleIndices, sampleBytes = stratifiedSampleIndicesByTemplateKey(
+				data, endPositions, shuffledIndices, trainingSampleBytes, maxClusters,
+			)
+		} else {
+			sampleIndices, sampleBytes = sampleIndicesByBytes(shuffledIndices, endPositions, trainingSampleBytes)
+		}
+	}
+	return shuffledIndices, sampleIndices, sampleBytes
+}
+
+// trainingShuffleSeed seeds the row order training samples are drawn in.
+const trainingShuffleSeed = 42
+
+// shuffleIndices returns 0..n-1 in a deterministic shuffled order: a
+// Fisher-Yates shuffle driven by an LCG seeded with seed.
+func shuffleIndices(n int, seed uint64) []int {
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	state := seed
+	for i := n - 1; i > 0; i-- {
+		state = state*6364136223846793005 + 1442695040888963407
+		j := int(state % uint64(i+1))
+		indices[i], indices[j] = indices[j], indices[i]
+	}
+	return indices
+}
+
 func resolveTokenLimit(cfg Config) uint16 {
 	limit := uint16(maxTokenID)
 	if cfg.MaxTokenID != 0 {
@@ -191,21 +290,45 @@ func resolveTokenLimit(cfg Config) uint16 {
 		}
 	}
 
-	if resolveTokenBitWidth(cfg) == tokenBitWidth12 && limit > maxTokenID12Bit {
-		limit = maxTokenID12Bit
+	if widthLimit := maxTokenIDForBitWidth(resolveTokenBitWidth(cfg)); limit > widthLimit {
+		limit = widthLimit
 	}
 	return limit
 }
 
+// resolveTokenBitWidth returns the configured bit-width, falling back to 16
+// for unset or unsupported values. validateConfig rejects the latter before
+// any encoding happens.
 func resolveTokenBitWidth(cfg Config) uint8 {
-	switch cfg.TokenBitWidth {
-	case tokenBitWidth12:
-		return tokenBitWidth12
-	case tokenBitWidth16:
-		return tokenBitWidth16
-	default:
-		return tokenBitWidth16
+	if validTokenBitWidth(cfg.TokenBitWidth) {
+		return cfg.TokenBitWidth
+	}
+	return tokenBitWidth16
+}
+
+func validTokenBitWidth(bits uint8) bool {
+	return bits >= minTokenBitWidth && bits <= maxTokenBitWidth
+}
+
+func maxTokenIDForBitWidth(bits uint8) uint16 {
+	return uint16(1<<bits - 1)
+}
+
+// tokenBitWidthFor returns the narrowest supported bit-width that can hold
+// tokenCount token IDs.
+func tokenBitWidthFor(tokenCount int) uint8 {
+	bits := minTokenBitWidth
+	for bits < maxTokenBitWidth && tokenCount > int(maxTokenIDForBitWidth(bits))+1 {
+		bits++
+	}
+	return bits
+}
+
+func validateConfig(cfg Config) error {
+	if cfg.TokenBitWidth != 0 && !validTokenBitWidth(cfg.TokenBitWidth) {
+		return fmt.Errorf("%w: %d (supported: %d-%d)", ErrInvalidTokenBitWidth, cfg.TokenBitWidth, minTokenBitWidth, maxTokenBitWidth)
 	}
+	return nil
 }
 
 func resolveTrainingSampleBytes(cfg Config) int {
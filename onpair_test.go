@@ -3,16 +3,23 @@ package onpair
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // ============================================================================
@@ -50,6 +57,106 @@ func loadTestDataLines(filename string) ([]string, error) {
 	return lines, scanner.Err()
 }
 
+// ============================================================================
+// Stage Encoding Helpers
+// ============================================================================
+
+// The helpers below encode single stages into memory, for tests that build or
+// inspect payloads directly. WriteTo streams stages instead.
+
+func writeStage(w io.Writer, name string, params []byte, payload []byte) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := writeStreamStage(cw, bytesStage(name, params, payload))
+	return cw.n, err
+}
+
+func encodeFlatePayload(raw []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeCompressedDataStageCodebook(compressed []uint16, tokenBitWidth uint8) ([]byte, error) {
+	stage, err := codebookTokenStream(&Archive{CompressedData: compressed}, tokenBitWidth)
+	if err != nil {
+		return nil, err
+	}
+	return stage.bytes()
+}
+
+func encodeCompressedDataStage16(compressed []uint16) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(compressed))); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, compressed); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeCompressedDataStagePacked writes the token count followed by the
+// tokens packed LSB-first at bitWidth bits each. At 16 bits this is exactly
+// the little-endian uint16 layout of encodeCompressedDataStage16.
+func encodeCompressedDataStagePacked(compressed []uint16, bitWidth uint8) ([]byte, error) {
+	if bitWidth == tokenBitWidth16 {
+		return encodeCompressedDataStage16(compressed)
+	}
+	packedLen := packedByteSize(len(compressed), bitWidth)
+	payload := make([]byte, 4, 4+packedLen)
+	binary.LittleEndian.PutUint32(payload[:4], uint32(len(compressed)))
+	payload, err := appendPackedTokens(payload, compressed, bitWidth, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) != 4+packedLen {
+		return nil, fmt.Errorf("packed %d-bit payload mismatch: wrote %d bytes, expected %d", bitWidth, len(payload)-4, packedLen)
+	}
+	return payload, nil
+}
+
+func encodeTokenBoundariesStage(a *Archive) ([]byte, uint8, error) {
+	stage, err := tokenBoundariesStream(a.TokenBoundaries)
+	if err != nil {
+		return nil, 0, err
+	}
+	payload, err := stage.bytes()
+	if err != nil {
+		return nil, 0, err
+	}
+	return payload, stage.params[0], nil
+}
+
+func encodeTokenBoundariesStageRaw(bounds []uint32) ([]byte, error) {
+	return tokenBoundariesRawStream(bounds).bytes()
+}
+
+func encodeTokenBoundariesStageDelta(bounds []uint32) ([]byte, error) {
+	stage, err := tokenBoundariesDeltaStream(bounds)
+	if err != nil {
+		return nil, err
+	}
+	return stage.bytes()
+}
+
+func encodeCompressedDataStageHuffman(compressed []uint16, tokenBitWidth uint8) ([]byte, error) {
+	stage, err := huffmanTokenStream(&Archive{CompressedData: compressed}, tokenBitWidth)
+	if err != nil {
+		return nil, err
+	}
+	return stage.bytes()
+}
+
 // ============================================================================
 // Basic Compression Tests
 // ============================================================================
@@ -947,7 +1054,7 @@ func TestAllTestdataFiles(t *testing.T) {
 
 func testOnPairCompression(t *testing.T, lines []string, originalData []byte) {
 	// Compress
-	enc := NewEncoder()
+	enc := NewEncoder(WithoutPassthrough())
 	archive := mustEncode(enc, lines)
 
 	// Verify compression
@@ -1036,7 +1143,7 @@ func testOnPairCompression(t *testing.T, lines []string, originalData []byte) {
 
 func testOnPair16Compression(t *testing.T, lines []string, originalData []byte) {
 	// Compress with constraint
-	enc := NewEncoder(WithMaxTokenLength(16))
+	enc := NewEncoder(WithMaxTokenLength(16), WithoutPassthrough())
 	archive := mustEncode(enc, lines)
 
 	// Verify compression
@@ -1152,7 +1259,7 @@ func TestSerialization(t *testing.T) {
 	}
 
 	// Create and compress with OnPair
-	enc := NewEncoder()
+	enc := NewEncoder(WithoutPassthrough())
 	archive := mustEncode(enc, strings)
 
 	// Serialize
@@ -1262,12 +1369,12 @@ func TestSerializationPacked12Bit(t *testing.T) {
 		"user_000004",
 	}
 
-	archive := mustEncode(NewEncoder(WithTokenBitWidth(12)), input)
+	archive := mustEncode(NewEncoder(WithTokenBitWidth(12), WithoutPassthrough()), input)
 	if archive.tokenBitWidth() != tokenBitWidth12 {
 		t.Fatalf("token bit-width mismatch: got %d want %d", archive.tokenBitWidth(), tokenBitWidth12)
 	}
 
-	expectedCompressedBytes := packed12ByteSize(len(archive.CompressedData))
+	expectedCompressedBytes := packedByteSize(len(archive.CompressedData), tokenBitWidth12)
 	expectedSpaceUsed := expectedCompressedBytes + len(archive.Dictionary) + len(archive.TokenBoundaries)*4
 	if got := archive.SpaceUsed(); got != expectedSpaceUsed {
 		t.Fatalf("SpaceUsed mismatch: got %d want %d", got, expectedSpaceUsed)
@@ -1495,9 +1602,9 @@ func TestSerializationCompressedDataUsesFlateWhenSmaller12Bit(t *testing.T) {
 			)
 		}
 
-		raw, err := encodeCompressedDataStage12(archive.CompressedData)
+		raw, err := encodeCompressedDataStagePacked(archive.CompressedData, tokenBitWidth12)
 		if err != nil {
-			t.Fatalf("encodeCompressedDataStage12 failed: %v", err)
+			t.Fatalf("encodeCompressedDataStagePacked failed: %v", err)
 		}
 		if len(payload) >= len(raw) {
 			t.Fatalf("flate compressed payload not smaller: got %d want < %d", len(payload), len(raw))
@@ -1518,7 +1625,7 @@ func TestSerializationCompressedDataUsesFlateWhenSmaller12Bit(t *testing.T) {
 
 func TestDecodeCompressedDataStageRejectsInvalidFlatePayload(t *testing.T) {
 	dst := &Archive{}
-	err := decodeCompressedDataStage(dst, []byte{stageCompressedDataParamWidth16Flate}, []byte{0x00, 0x01, 0x02, 0x03})
+	err := decodeCompressedDataStage(dst, []byte{stageCompressedDataParamWidth16Flate}, []byte{0x00, 0x01, 0x02, 0x03}, defaultReadLimits)
 	if err == nil {
 		t.Fatalf("expected decodeCompressedDataStage to fail on invalid flate payload")
 	}
@@ -1574,7 +1681,7 @@ func TestDecodeCompressedDataStageRejectsInvalidCodebookPayload(t *testing.T) {
 		0x01,
 	}
 	dst := &Archive{}
-	err := decodeCompressedDataStage(dst, []byte{stageCompressedDataParamWidth16Codebook}, payload)
+	err := decodeCompressedDataStage(dst, []byte{stageCompressedDataParamWidth16Codebook}, payload, defaultReadLimits)
 	if err == nil {
 		t.Fatalf("expected decodeCompressedDataStage to fail on invalid codebook payload")
 	}
@@ -1692,7 +1799,7 @@ func TestReadFromRejectsMissingRequiredStages(t *testing.T) {
 }
 
 func TestDecompressAllCheckedReturnsErrorOnFailure(t *testing.T) {
-	archive := mustEncode(NewEncoder(), []string{"hello", "world"})
+	archive := mustEncode(NewEncoder(WithoutPassthrough()), []string{"hello", "world"})
 	if len(archive.CompressedData) == 0 {
 		t.Fatalf("expected compressed data")
 	}
@@ -1880,7 +1987,7 @@ func TestEncodeTokenBoundariesStageSelectsDelta(t *testing.T) {
 	}
 
 	var decoded Archive
-	if err := decodeTokenBoundariesStage(&decoded, []byte{param}, payload); err != nil {
+	if err := decodeTokenBoundariesStage(&decoded, []byte{param}, payload, defaultReadLimits); err != nil {
 		t.Fatalf("decodeTokenBoundariesStage failed: %v", err)
 	}
 	if !slices.Equal(decoded.TokenBoundaries, bounds) {
@@ -2342,176 +2449,3269 @@ func TestCompressionRatioSummary(t *testing.T) {
 }
 
 // ============================================================================
-// Fuzz Tests
+// Deletion and Compaction Tests
 // ============================================================================
 
-func FuzzOnPairCompression(f *testing.F) {
-	// Seed corpus with interesting test cases
-	f.Add("hello")
-	f.Add("user_000001")
-	f.Add("hello世界")
-	f.Add("🚀rocket")
-	f.Add("")
-	f.Add("a")
-	f.Add("abcdefghijklmnopqrstuvwxyz")
-	f.Add("tab\there")
-	f.Add("null\x00byte")
-
-	f.Fuzz(func(t *testing.T, input string) {
-		// Create a slice with the input string repeated to enable pattern matching
-		strings := []string{input, input, input}
+func TestArchiveDeleteSkipsRows(t *testing.T) {
+	input := []string{"user_001", "user_002", "admin_001", "user_003"}
+	archive := mustEncode(NewEncoder(), input)
 
-		enc := NewEncoder()
-		archive := mustEncode(enc, strings)
+	if err := archive.Delete(1); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := archive.Delete(1); err != nil {
+		t.Fatalf("Delete should be idempotent: %v", err)
+	}
+	if err := archive.Delete(len(input)); err == nil {
+		t.Fatalf("expected Delete out of range to fail")
+	}
 
-		// Verify decompression
-		buffer := make([]byte, len(input)*2+100) // Extra space for safety
-		for i, expected := range strings {
-			size, err := archive.DecompressString(i, buffer)
-			if err != nil {
-				t.Errorf("DecompressString failed: %v", err)
-				continue
-			}
-			actual := string(buffer[:size])
-			if actual != expected {
-				t.Errorf("String %d: expected %q, got %q", i, expected, actual)
-			}
-		}
-	})
-}
+	if archive.Rows() != len(input) {
+		t.Fatalf("Rows should include deleted rows: got %d want %d", archive.Rows(), len(input))
+	}
+	if archive.LiveRows() != len(input)-1 {
+		t.Fatalf("LiveRows mismatch: got %d want %d", archive.LiveRows(), len(input)-1)
+	}
+	if !archive.IsDeleted(1) || archive.IsDeleted(0) {
+		t.Fatalf("IsDeleted mismatch")
+	}
 
-func FuzzOnPair16Compression(f *testing.F) {
-	// Seed corpus with interesting test cases
-	f.Add("hello")
-	f.Add("user_001")
-	f.Add("hello世界")
-	f.Add("🚀")
-	f.Add("")
-	f.Add("x")
-	f.Add("1234567890abcdef") // Exactly 16 bytes
+	if _, err := archive.AppendRow(nil, 1); !errors.Is(err, ErrRowDeleted) {
+		t.Fatalf("AppendRow expected ErrRowDeleted, got %v", err)
+	}
+	if _, err := archive.DecodedLen(1); !errors.Is(err, ErrRowDeleted) {
+		t.Fatalf("DecodedLen expected ErrRowDeleted, got %v", err)
+	}
+	if _, err := archive.DecompressString(1, make([]byte, 64)); !errors.Is(err, ErrRowDeleted) {
+		t.Fatalf("DecompressString expected ErrRowDeleted, got %v", err)
+	}
 
-	f.Fuzz(func(t *testing.T, input string) {
-		// Create a slice with the input string repeated
-		strings := []string{input, input, input}
+	row, err := archive.AppendRow(nil, 2)
+	if err != nil {
+		t.Fatalf("AppendRow failed: %v", err)
+	}
+	if string(row) != input[2] {
+		t.Fatalf("AppendRow(2) mismatch: got %q want %q", row, input[2])
+	}
 
-		enc := NewEncoder(WithMaxTokenLength(16))
-		archive := mustEncode(enc, strings)
+	want := input[0] + input[2] + input[3]
+	all, err := archive.AppendAll(nil)
+	if err != nil {
+		t.Fatalf("AppendAll failed: %v", err)
+	}
+	if string(all) != want {
+		t.Fatalf("AppendAll mismatch: got %q want %q", all, want)
+	}
 
-		// Verify decompression
-		buffer := make([]byte, len(input)*2+100) // Extra space for safety
-		for i, expected := range strings {
-			size, err := archive.DecompressString(i, buffer)
-			if err != nil {
-				t.Errorf("DecompressString failed: %v", err)
-				continue
-			}
-			actual := string(buffer[:size])
-			if actual != expected {
-				t.Errorf("String %d: expected %q, got %q", i, expected, actual)
-			}
-		}
-	})
+	buf := make([]byte, len(want))
+	n, err := archive.DecompressAllChecked(buf)
+	if err != nil {
+		t.Fatalf("DecompressAllChecked failed: %v", err)
+	}
+	if string(buf[:n]) != want {
+		t.Fatalf("DecompressAllChecked mismatch: got %q want %q", buf[:n], want)
+	}
 }
 
-func FuzzOnPairMultipleStrings(f *testing.F) {
-	// Seed with pairs of strings
-	f.Add("hello", "world")
-	f.Add("user_", "admin_")
-	f.Add("café", "naïve")
+func TestArchiveTombstonesSerialization(t *testing.T) {
+	input := []string{"alpha", "beta", "gamma"}
+	archive := mustEncode(NewEncoder(), input)
+	if err := archive.Delete(0); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
 
-	f.Fuzz(func(t *testing.T, s1, s2 string) {
-		// Create various combinations
-		strings := []string{s1, s2, s1, s2, s1 + s2, s2 + s1}
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
 
-		enc := NewEncoder()
-		archive := mustEncode(enc, strings)
+	loaded := &Archive{}
+	if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if !loaded.IsDeleted(0) || loaded.IsDeleted(1) || loaded.IsDeleted(2) {
+		t.Fatalf("tombstones not preserved across serialization")
+	}
+	if _, err := loaded.AppendRow(nil, 0); !errors.Is(err, ErrRowDeleted) {
+		t.Fatalf("AppendRow expected ErrRowDeleted, got %v", err)
+	}
 
-		// Verify decompression
-		maxLen := len(s1) + len(s2) + 100
-		buffer := make([]byte, maxLen)
-		for i, expected := range strings {
-			size, err := archive.DecompressString(i, buffer)
-			if err != nil {
-				t.Errorf("DecompressString failed: %v", err)
-				continue
-			}
-			actual := string(buffer[:size])
-			if actual != expected {
-				t.Errorf("String %d: expected %q, got %q", i, expected, actual)
-			}
-		}
-	})
+	var clean bytes.Buffer
+	if _, err := mustEncode(NewEncoder(), input).WriteTo(&clean); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if bytes.Contains(clean.Bytes(), []byte(stageTombstones)) {
+		t.Fatalf("tombstones stage should be omitted when no rows are deleted")
+	}
 }
 
-func FuzzOnPairDecompressAllChecked(f *testing.F) {
-	f.Add("foo", "bar", "baz")
-
-	f.Fuzz(func(t *testing.T, s1, s2, s3 string) {
-		strings := []string{s1, s2, s3}
-
-		enc := NewEncoder()
-		archive := mustEncode(enc, strings)
+func TestArchiveCompact(t *testing.T) {
+	lines, err := loadTestDataLines("testdata/logs_apache_2k.log")
+	if err != nil {
+		t.Skipf("testdata not available: %v", err)
+	}
 
-		// Calculate expected result
-		expected := s1 + s2 + s3
-		totalLen := len(expected)
+	archive := mustEncode(NewEncoder(), lines)
+	tokensBefore := len(archive.TokenBoundaries) - 1
 
-		// Decompress all
-		buffer := make([]byte, totalLen+100) // Extra space for safety
-		size, err := archive.DecompressAllChecked(buffer)
-		if err != nil {
-			t.Fatalf("DecompressAllChecked failed: %v", err)
+	var kept []string
+	for i, line := range lines {
+		if i%3 == 0 {
+			if err := archive.Delete(i); err != nil {
+				t.Fatalf("Delete(%d) failed: %v", i, err)
+			}
+			continue
 		}
-		actual := string(buffer[:size])
+		kept = append(kept, line)
+	}
 
-		if actual != expected {
-			t.Errorf("DecompressAllChecked: expected %q, got %q", expected, actual)
-		}
+	if err := archive.Compact(CompactOptions{PruneDictionary: true}); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if archive.LiveRows() != archive.Rows() {
+		t.Fatalf("Compact should clear tombstones")
+	}
+	if tokensAfter := len(archive.TokenBoundaries) - 1; tokensAfter > tokensBefore || tokensAfter < singleByteTokens {
+		t.Fatalf("unexpected token count after pruning: before=%d after=%d", tokensBefore, tokensAfter)
+	}
+	t.Logf("tokens before=%d after=%d", tokensBefore, len(archive.TokenBoundaries)-1)
 
-		if size != totalLen {
-			t.Errorf("DecompressAllChecked size: expected %d, got %d", totalLen, size)
-		}
-	})
+	verifyArchiveRoundTrip(t, archive, kept)
 }
 
 // ============================================================================
-// Basic Benchmarks
+// Merge Tests
 // ============================================================================
 
-func BenchmarkOnPairCompression(b *testing.B) {
-	strings := make([]string, 1000)
-	for i := 0; i < 1000; i++ {
-		strings[i] = "user_000001"
+func TestMergeSharedDictionary(t *testing.T) {
+	first := []string{"user_001", "user_002", "admin_001"}
+	second := []string{"user_003", "", "admin_002"}
+
+	model, err := TrainModel(append(append([]string(nil), first...), second...))
+	if err != nil {
+		t.Fatalf("TrainModel failed: %v", err)
+	}
+	a1, err := model.Encode(first)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	a2, err := model.Encode(second)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if err := a2.Delete(1); err != nil {
+		t.Fatalf("Delete failed: %v", err)
 	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		enc := NewEncoder()
-		mustEncode(enc, strings)
+	merged, err := Merge(a1, a2)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if !slices.Equal(merged.Dictionary, a1.Dictionary) {
+		t.Fatalf("shared-dictionary merge should keep the dictionary")
 	}
+	if want := len(a1.CompressedData) + len(a2.CompressedData); len(merged.CompressedData) != want {
+		t.Fatalf("shared-dictionary merge should append tokens: got %d want %d", len(merged.CompressedData), want)
+	}
+	verifyArchiveRoundTrip(t, merged, []string{"user_001", "user_002", "admin_001", "user_003", "admin_002"})
 }
 
-func BenchmarkOnPair16Compression(b *testing.B) {
-	strings := make([]string, 1000)
-	for i := 0; i < 1000; i++ {
-		strings[i] = "user_000001"
+func TestMergeHeterogeneousDictionaries(t *testing.T) {
+	first := []string{"user_000001", "user_000002", "user_000003"}
+	second := []string{"GET /index.html", "GET /about.html", "POST /login"}
+
+	a1 := mustEncode(NewEncoder(), first)
+	a2 := mustEncode(NewEncoder(WithTokenBitWidth(12)), second)
+
+	merged, err := Merge(a1, a2)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
 	}
+	verifyArchiveRoundTrip(t, merged, append(append([]string(nil), first...), second...))
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		enc := NewEncoder(WithMaxTokenLength(16))
-		mustEncode(enc, strings)
+	model, err := TrainModel(second, WithTokenBitWidth(12))
+	if err != nil {
+		t.Fatalf("TrainModel failed: %v", err)
+	}
+	withModel, err := MergeWithModel(model, a1, a2)
+	if err != nil {
+		t.Fatalf("MergeWithModel failed: %v", err)
 	}
+	if !slices.Equal(withModel.Dictionary, model.dictionary) {
+		t.Fatalf("MergeWithModel should use the target model dictionary")
+	}
+	if withModel.tokenBitWidth() != tokenBitWidth12 {
+		t.Fatalf("MergeWithModel should use the model token bit-width")
+	}
+	verifyArchiveRoundTrip(t, withModel, append(append([]string(nil), first...), second...))
 }
 
-func BenchmarkOnPairDecompression(b *testing.B) {
-	strings := make([]string, 1000)
-	for i := 0; i < 1000; i++ {
-		strings[i] = "user_000001"
+func TestMergeKeepsEncoderOptions(t *testing.T) {
+	rows := makeSyntheticMixedRows(2000)
+	first, second := rows[:1000], rows[1000:]
+	opts := []Option{WithMaxTokenLength(16), WithPackedTokenStorage(), WithCompactBoundaries(), WithoutPassthrough()}
+	a1 := mustEncode(NewEncoder(opts...), first)
+	a2 := mustEncode(NewEncoder(WithoutPassthrough()), second)
+	if sameDictionary(a1, a2.Dictionary, a2.TokenBoundaries) {
+		t.Fatalf("inputs should have different dictionaries")
 	}
 
-	enc := NewEncoder()
-	archive := mustEncode(enc, strings)
+	// Re-encoding trains with the first archive's options and keeps its
+	// layout.
+	merged, err := Merge(a1, a2)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if merged.packed == nil || merged.compactBoundaries == nil || merged.config.MaxTokenLen != 16 {
+		t.Fatalf("Merge should keep the first archive's options, got config %+v", merged.config)
+	}
+	for i := 1; i < len(merged.TokenBoundaries); i++ {
+		if n := merged.TokenBoundaries[i] - merged.TokenBoundaries[i-1]; n > 16 {
+			t.Fatalf("token %d is %d bytes, longer than the first archive's limit", i-1, n)
+		}
+	}
+	verifyArchiveRoundTrip(t, merged, rows)
+
+	// Appending shared token streams keeps the layout too.
+	model, err := TrainModel(rows, opts...)
+	if err != nil {
+		t.Fatalf("TrainModel failed: %v", err)
+	}
+	m1, _ := model.Encode(first)
+	m2, _ := model.Encode(second)
+	merged, err = Merge(m1, m2)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if merged.packed == nil || merged.compactBoundaries == nil {
+		t.Fatalf("shared-dictionary Merge should keep the first archive's layout")
+	}
+	verifyArchiveRoundTrip(t, merged, rows)
+}
+
+func TestMergeWithModelAppliesModelOptions(t *testing.T) {
+	first := []string{"user_000001", "user_000002", "user_000003"}
+	second := []string{"GET /index.html", "GET /about.html", "POST /login"}
+	all := append(append([]string(nil), first...), second...)
+
+	model, err := TrainModel(all, WithDictionaryPruning(), WithFrequencyOrderedTokens(),
+		WithAutoTokenBitWidth(), WithPackedTokenStorage(), WithCompactBoundaries())
+	if err != nil {
+		t.Fatalf("TrainModel failed: %v", err)
+	}
+	want, err := model.Encode(all)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	merged, err := MergeWithModel(model, mustEncode(NewEncoder(), first), mustEncode(NewEncoder(), second))
+	if err != nil {
+		t.Fatalf("MergeWithModel failed: %v", err)
+	}
+	if merged.packed == nil || merged.compactBoundaries == nil {
+		t.Fatalf("MergeWithModel should apply the model's in-memory layout")
+	}
+	if !slices.Equal(merged.Dictionary, want.Dictionary) || merged.tokenBitWidth() != want.tokenBitWidth() {
+		t.Fatalf("MergeWithModel dictionary or width differs from Model.Encode")
+	}
+	var gotBlob, wantBlob bytes.Buffer
+	if _, err := merged.WriteTo(&gotBlob); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if _, err := want.WriteTo(&wantBlob); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if !bytes.Equal(gotBlob.Bytes(), wantBlob.Bytes()) {
+		t.Fatalf("MergeWithModel should serialize like Model.Encode of the same rows")
+	}
+	verifyArchiveRoundTrip(t, merged, all)
+}
+
+func TestMergeRejectsInvalidInput(t *testing.T) {
+	if _, err := Merge(); err == nil {
+		t.Fatalf("expected Merge with no archives to fail")
+	}
+	if _, err := Merge(mustEncode(NewEncoder(), []string{"a"}), nil); err == nil {
+		t.Fatalf("expected Merge with nil archive to fail")
+	}
+	if _, err := MergeWithModel(NewModel(), mustEncode(NewEncoder(), []string{"a"})); !errors.Is(err, ErrUntrainedModel) {
+		t.Fatalf("expected ErrUntrainedModel, got %v", err)
+	}
+}
+
+// ============================================================================
+// Slice and Split Tests
+// ============================================================================
+
+func TestArchiveSlice(t *testing.T) {
+	input := []string{"user_001", "user_002", "", "admin_001", "user_003"}
+	archive := mustEncode(NewEncoder(WithoutPassthrough()), input)
+
+	part := archive.Slice(1, 4)
+	if &part.Dictionary[0] != &archive.Dictionary[0] {
+		t.Fatalf("Slice should share the dictionary")
+	}
+	verifyArchiveRoundTrip(t, part, input[1:4])
+
+	empty := archive.Slice(2, 2)
+	verifyArchiveRoundTrip(t, empty, nil)
+
+	if err := archive.Delete(3); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	tail := archive.Slice(3, 5)
+	if !tail.IsDeleted(0) || tail.IsDeleted(1) {
+		t.Fatalf("Slice should carry tombstones in range")
+	}
+}
+
+func TestArchiveSliceAppendDoesNotClobberParent(t *testing.T) {
+	input := []string{"user_001", "user_002", "admin_001", "user_003"}
+	archive := mustEncode(NewEncoder(WithoutPassthrough()), input)
+
+	part := archive.Slice(0, 2)
+	part.CompressedData = append(part.CompressedData, 0)
+	part.Dictionary = append(part.Dictionary, 'x')
+	part.TokenBoundaries = append(part.TokenBoundaries, 0)
+	verifyArchiveRoundTrip(t, archive, input)
+}
+
+func TestArchiveSlicePanicsOutOfRange(t *testing.T) {
+	archive := mustEncode(NewEncoder(), []string{"a", "b"})
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected Slice to panic")
+		}
+	}()
+	archive.Slice(1, 3)
+}
+
+func TestArchiveSplit(t *testing.T) {
+	lines, err := loadTestDataLines("testdata/logs_hdfs_2k.log")
+	if err != nil {
+		t.Skipf("testdata not available: %v", err)
+	}
+	archive := mustEncode(NewEncoder(), lines)
+
+	parts := archive.Split(7)
+	if len(parts) != 7 {
+		t.Fatalf("Split returned %d parts, want 7", len(parts))
+	}
+	offset := 0
+	for i, part := range parts {
+		if rows := part.Rows(); rows < len(lines)/7 || rows > len(lines)/7+1 {
+			t.Fatalf("part %d has %d rows, want about %d", i, rows, len(lines)/7)
+		}
+
+		var blob bytes.Buffer
+		if _, err := part.WriteTo(&blob); err != nil {
+			t.Fatalf("WriteTo(part %d) failed: %v", i, err)
+		}
+		loaded := &Archive{}
+		if _, err := loaded.ReadFrom(&blob); err != nil {
+			t.Fatalf("ReadFrom(part %d) failed: %v", i, err)
+		}
+		for row := 0; row < loaded.Rows(); row++ {
+			got, err := loaded.AppendRow(nil, row)
+			if err != nil {
+				t.Fatalf("AppendRow(part %d, row %d) failed: %v", i, row, err)
+			}
+			if string(got) != lines[offset+row] {
+				t.Fatalf("part %d row %d mismatch: got %q want %q", i, row, got, lines[offset+row])
+			}
+		}
+		offset += part.Rows()
+	}
+	if offset != len(lines) {
+		t.Fatalf("Split covered %d rows, want %d", offset, len(lines))
+	}
+	if archive.Split(0) != nil {
+		t.Fatalf("Split(0) should return nil")
+	}
+}
+
+// ============================================================================
+// Dictionary Pruning Tests
+// ============================================================================
+
+func TestPruneDictionary(t *testing.T) {
+	input := []string{"user_000001", "user_000002", "user_000003", "admin_001", "user_000004"}
+	archive := mustEncode(NewEncoder(WithoutPassthrough()), input)
+	tokensBefore := len(archive.TokenBoundaries) - 1
+
+	if err := archive.PruneDictionary(); err != nil {
+		t.Fatalf("PruneDictionary failed: %v", err)
+	}
+	tokensAfter := len(archive.TokenBoundaries) - 1
+	if tokensAfter > tokensBefore {
+		t.Fatalf("pruning grew dictionary: before=%d after=%d", tokensBefore, tokensAfter)
+	}
+	for i := 0; i < singleByteTokens; i++ {
+		if archive.TokenBoundaries[i+1]-archive.TokenBoundaries[i] != 1 || archive.Dictionary[archive.TokenBoundaries[i]] != byte(i) {
+			t.Fatalf("single-byte token %d not preserved", i)
+		}
+	}
+	used := make(map[uint16]bool)
+	for _, tokenID := range archive.CompressedData {
+		used[tokenID] = true
+	}
+	for tokenID := singleByteTokens; tokenID < tokensAfter; tokenID++ {
+		if !used[uint16(tokenID)] {
+			t.Fatalf("token %d survived pruning without references", tokenID)
+		}
+	}
+	if want := tokenBitWidthFor(tokensAfter); archive.tokenBitWidth() != want {
+		t.Fatalf("pruned dictionary should switch to %d-bit tokens, got %d", want, archive.tokenBitWidth())
+	}
+	verifyArchiveRoundTrip(t, archive, input)
+
+	pruned := mustEncode(NewEncoder(WithDictionaryPruning(), WithoutPassthrough()), input)
+	if !slices.Equal(pruned.Dictionary, archive.Dictionary) {
+		t.Fatalf("WithDictionaryPruning should match PruneDictionary")
+	}
+}
+
+func TestPruneDictionarySizes(t *testing.T) {
+	testFiles := []string{
+		"testdata/art_of_war.txt",
+		"testdata/en_bible_kjv.txt",
+		"testdata/en_mobydick.txt",
+		"testdata/en_shakespeare.txt",
+		"testdata/logs_apache_2k.log",
+		"testdata/logs_hdfs_2k.log",
+		"testdata/zh_tao_te_ching_en.txt",
+	}
+
+	t.Logf("%-25s | %8s | %8s | %12s | %12s | %s", "File", "Tokens", "Pruned", "Serialized", "Pruned Ser.", "Saved")
+	for _, testFile := range testFiles {
+		lines, err := loadTestDataLines(testFile)
+		if err != nil {
+			continue
+		}
+
+		archive := mustEncode(NewEncoder(), lines)
+		var before bytes.Buffer
+		if _, err := archive.WriteTo(&before); err != nil {
+			t.Fatalf("WriteTo failed for %s: %v", testFile, err)
+		}
+		tokensBefore := len(archive.TokenBoundaries) - 1
+
+		if err := archive.PruneDictionary(); err != nil {
+			t.Fatalf("PruneDictionary failed for %s: %v", testFile, err)
+		}
+		var after bytes.Buffer
+		if _, err := archive.WriteTo(&after); err != nil {
+			t.Fatalf("WriteTo after pruning failed for %s: %v", testFile, err)
+		}
+		if after.Len() > before.Len() {
+			t.Errorf("%s: pruning grew serialized size from %d to %d", testFile, before.Len(), after.Len())
+		}
+
+		all, err := archive.AppendAll(nil)
+		if err != nil {
+			t.Fatalf("AppendAll failed for %s: %v", testFile, err)
+		}
+		if string(all) != strings.Join(lines, "") {
+			t.Fatalf("%s: round-trip mismatch after pruning", testFile)
+		}
+
+		name := testFile[9:]
+		saved := 100 * float64(before.Len()-after.Len()) / float64(before.Len())
+		t.Logf("%-25s | %8d | %8d | %12d | %12d | %.1f%%", name, tokensBefore, len(archive.TokenBoundaries)-1, before.Len(), after.Len(), saved)
+	}
+}
+
+// ============================================================================
+// Token Renumbering Tests
+// ============================================================================
+
+func TestRenumberByFrequency(t *testing.T) {
+	lines, err := loadTestDataLines("testdata/logs_apache_2k.log")
+	if err != nil {
+		t.Skipf("testdata not available: %v", err)
+	}
+	archive := mustEncode(NewEncoder(), lines)
+	tokenCount := len(archive.TokenBoundaries) - 1
+
+	if err := archive.RenumberByFrequency(); err != nil {
+		t.Fatalf("RenumberByFrequency failed: %v", err)
+	}
+	if got := len(archive.TokenBoundaries) - 1; got != tokenCount {
+		t.Fatalf("renumbering changed token count: got %d want %d", got, tokenCount)
+	}
+	for i := 0; i < singleByteTokens; i++ {
+		if archive.Dictionary[archive.TokenBoundaries[i]] != byte(i) {
+			t.Fatalf("single-byte token %d not preserved", i)
+		}
+	}
+	counts := tokenCounts(archive)
+	for tokenID := singleByteTokens + 1; tokenID < tokenCount; tokenID++ {
+		if counts[tokenID] > counts[tokenID-1] {
+			t.Fatalf("token %d used %d times after token %d used %d times", tokenID, counts[tokenID], tokenID-1, counts[tokenID-1])
+		}
+	}
+	verifyArchiveRoundTrip(t, archive, lines)
+
+	viaOption := mustEncode(NewEncoder(WithFrequencyOrderedTokens()), lines)
+	if !slices.Equal(viaOption.CompressedData, archive.CompressedData) {
+		t.Fatalf("WithFrequencyOrderedTokens should match RenumberByFrequency")
+	}
+}
+
+func TestRenumberByFrequencySizes(t *testing.T) {
+	testFiles := []string{
+		"testdata/art_of_war.txt",
+		"testdata/en_mobydick.txt",
+		"testdata/logs_apache_2k.log",
+		"testdata/logs_hdfs_2k.log",
+		"testdata/zh_tao_te_ching_en.txt",
+	}
+
+	t.Logf("%-25s | %12s | %12s", "File", "Serialized", "Freq-Ordered")
+	for _, testFile := range testFiles {
+		lines, err := loadTestDataLines(testFile)
+		if err != nil {
+			continue
+		}
+
+		var plain, ordered bytes.Buffer
+		if _, err := mustEncode(NewEncoder(), lines).WriteTo(&plain); err != nil {
+			t.Fatalf("WriteTo failed for %s: %v", testFile, err)
+		}
+		if _, err := mustEncode(NewEncoder(WithFrequencyOrderedTokens()), lines).WriteTo(&ordered); err != nil {
+			t.Fatalf("WriteTo failed for %s: %v", testFile, err)
+		}
+		t.Logf("%-25s | %12d | %12d", testFile[9:], plain.Len(), ordered.Len())
+	}
+}
+
+// ============================================================================
+// Huffman Token Stream Tests
+// ============================================================================
+
+func TestCompressedDataHuffmanRoundTrip(t *testing.T) {
+	skewed := make([]uint16, 0, 1<<16)
+	for i := 0; i < 40; i++ {
+		for j := 0; j < 1<<(i%20); j++ {
+			skewed = append(skewed, uint16(300+i))
+			if len(skewed) == cap(skewed) {
+				break
+			}
+		}
+	}
+
+	cases := []struct {
+		name       string
+		compressed []uint16
+		bitWidth   uint8
+	}{
+		{name: "empty", compressed: nil, bitWidth: tokenBitWidth16},
+		{name: "single-symbol", compressed: []uint16{7, 7, 7, 7, 7}, bitWidth: tokenBitWidth16},
+		{name: "mixed16", compressed: []uint16{10, 10, 10, 11, 10, 500, 65535, 500, 0, 10}, bitWidth: tokenBitWidth16},
+		{name: "mixed12", compressed: []uint16{1, 1, 1, 2, 3, 4095, 100, 1, 100}, bitWidth: tokenBitWidth12},
+		{name: "skewed", compressed: skewed, bitWidth: tokenBitWidth16},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			payload, err := encodeCompressedDataStageHuffman(tc.compressed, tc.bitWidth)
+			if err != nil {
+				t.Fatalf("encodeCompressedDataStageHuffman failed: %v", err)
+			}
+			decoded, err := decodeCompressedDataStageHuffman(payload, tc.bitWidth)
+			if err != nil {
+				t.Fatalf("decodeCompressedDataStageHuffman failed: %v", err)
+			}
+			if !slices.Equal(decoded, tc.compressed) {
+				t.Fatalf("huffman round-trip mismatch")
+			}
+		})
+	}
+}
+
+func TestDecodeCompressedDataStageRejectsInvalidHuffmanPayload(t *testing.T) {
+	payload, err := encodeCompressedDataStageHuffman([]uint16{1, 2, 3, 3, 3, 3}, tokenBitWidth16)
+	if err != nil {
+		t.Fatalf("encodeCompressedDataStageHuffman failed: %v", err)
+	}
+
+	truncated := payload[:len(payload)-1]
+	if err := decodeCompressedDataStage(&Archive{}, []byte{stageCompressedDataParamWidth16Huffman}, truncated, defaultReadLimits); err == nil {
+		t.Fatalf("expected truncated huffman payload to fail")
+	}
+
+	// Three symbols all claiming 1-bit codes over-subscribe the code space.
+	oversubscribed := append([]byte(nil), payload...)
+	oversubscribed[9], oversubscribed[11], oversubscribed[13] = 1, 1, 1
+	if err := decodeCompressedDataStage(&Archive{}, []byte{stageCompressedDataParamWidth16Huffman}, oversubscribed, defaultReadLimits); err == nil {
+		t.Fatalf("expected over-subscribed huffman table to fail")
+	}
+
+	if _, err := decodeCompressedDataStageHuffman([]byte{1, 0, 0, 0, 0, 0, 0, 0}, tokenBitWidth16); err == nil {
+		t.Fatalf("expected empty huffman table with tokens to fail")
+	}
+}
+
+func TestWriteToOmitsHuffmanFromVersion2(t *testing.T) {
+	lines, err := loadTestDataLines("testdata/en_mobydick.txt")
+	if err != nil {
+		t.Skipf("testdata not available: %v", err)
+	}
+	archive := mustEncode(NewEncoder(WithTokenBitWidth(12)), lines)
+
+	var v2, v3 bytes.Buffer
+	if _, err := archive.WriteTo(&v2); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if _, err := archive.WriteToWithOptions(&v3, WriteOptions{FormatVersion: FormatVersion3}); err != nil {
+		t.Fatalf("WriteToWithOptions: %v", err)
+	}
+	if encoding, _ := compressedDataEncodingOf(t, v2.Bytes()); encoding == compressedDataEncodingHuffman {
+		t.Fatalf("version 2 archives must not pick Huffman automatically")
+	}
+	// Huffman is the smallest encoding for this stream.
+	if encoding, _ := compressedDataEncodingOf(t, v3.Bytes()); encoding != compressedDataEncodingHuffman {
+		t.Fatalf("version 3 archive picked encoding %d, want Huffman", encoding)
+	}
+}
+
+func TestDecodeHuffmanRejectsOversizedTokenCount(t *testing.T) {
+	// A one-symbol table followed by a one-byte stream cannot hold more than
+	// eight tokens, whatever the header claims.
+	payload := binary.LittleEndian.AppendUint32(nil, uint32(maxCompressedTokenRead))
+	payload = binary.LittleEndian.AppendUint32(payload, 1)
+	payload = append(payload, 7, 1, 0)
+	if _, err := decodeCompressedDataStageHuffman(payload, tokenBitWidth16); err == nil {
+		t.Fatalf("expected token count beyond the stream to fail")
+	}
+	payload = binary.LittleEndian.AppendUint32(nil, 8)
+	payload = binary.LittleEndian.AppendUint32(payload, 1)
+	payload = append(payload, 7, 1, 0)
+	decoded, err := decodeCompressedDataStageHuffman(payload, tokenBitWidth16)
+	if err != nil || !slices.Equal(decoded, []uint16{7, 7, 7, 7, 7, 7, 7, 7}) {
+		t.Fatalf("got %v (%v), want eight 7s", decoded, err)
+	}
+}
+
+func TestCompressedDataStageEncodingSizes(t *testing.T) {
+	testFiles := []string{
+		"testdata/art_of_war.txt",
+		"testdata/en_mobydick.txt",
+		"testdata/logs_apache_2k.log",
+		"testdata/logs_hdfs_2k.log",
+		"testdata/zh_tao_te_ching_en.txt",
+	}
+
+	t.Logf("%-25s | %5s | %10s | %10s | %10s | %10s | %10s", "File", "Bits", "Raw", "Flate", "Codebook", "CB+Flate", "Huffman")
+	for _, testFile := range testFiles {
+		lines, err := loadTestDataLines(testFile)
+		if err != nil {
+			continue
+		}
+		for _, bitWidth := range []uint8{tokenBitWidth16, tokenBitWidth12} {
+			archive := mustEncode(NewEncoder(WithTokenBitWidth(bitWidth), WithoutPassthrough()), lines)
+
+			var raw []byte
+			if bitWidth == tokenBitWidth12 {
+				raw, err = encodeCompressedDataStagePacked(archive.CompressedData, tokenBitWidth12)
+			} else {
+				raw, err = encodeCompressedDataStage16(archive.CompressedData)
+			}
+			if err != nil {
+				t.Fatalf("raw encode failed: %v", err)
+			}
+			flated, err := encodeFlatePayload(raw, flate.BestCompression)
+			if err != nil {
+				t.Fatalf("flate encode failed: %v", err)
+			}
+			codebook, err := encodeCompressedDataStageCodebook(archive.CompressedData, bitWidth)
+			if err != nil {
+				t.Fatalf("codebook encode failed: %v", err)
+			}
+			codebookFlate, err := encodeFlatePayload(codebook, flate.BestCompression)
+			if err != nil {
+				t.Fatalf("flate codebook encode failed: %v", err)
+			}
+			huffman, err := encodeCompressedDataStageHuffman(archive.CompressedData, bitWidth)
+			if err != nil {
+				t.Fatalf("huffman encode failed: %v", err)
+			}
+
+			decoded, err := decodeCompressedDataStageHuffman(huffman, bitWidth)
+			if err != nil {
+				t.Fatalf("huffman decode failed for %s: %v", testFile, err)
+			}
+			if !slices.Equal(decoded, archive.CompressedData) {
+				t.Fatalf("huffman round-trip mismatch for %s", testFile)
+			}
+
+			best, _, err := encodeCompressedDataStage(archive, EncodingAuto, flate.BestCompression, FormatVersion3)
+			if err != nil {
+				t.Fatalf("encodeCompressedDataStage failed: %v", err)
+			}
+			if len(best) > len(huffman) {
+				t.Fatalf("%s: selected payload %d larger than huffman %d", testFile, len(best), len(huffman))
+			}
+
+			t.Logf("%-25s | %5d | %10d | %10d | %10d | %10d | %10d", testFile[9:], bitWidth, len(raw), len(flated), len(codebook), len(codebookFlate), len(huffman))
+		}
+	}
+}
+
+// ============================================================================
+// Token Bit-Width Tests
+// ============================================================================
+
+func TestCompressedDataPackedRoundTripAllWidths(t *testing.T) {
+	for bitWidth := minTokenBitWidth; bitWidth <= maxTokenBitWidth; bitWidth++ {
+		limit := maxTokenIDForBitWidth(bitWidth)
+		compressed := []uint16{0, 1, 255, 256, limit, limit - 1, limit / 2, 7}
+
+		payload, err := encodeCompressedDataStagePacked(compressed, bitWidth)
+		if err != nil {
+			t.Fatalf("width %d: encode failed: %v", bitWidth, err)
+		}
+		if want := 4 + packedByteSize(len(compressed), bitWidth); len(payload) != want {
+			t.Fatalf("width %d: payload size %d want %d", bitWidth, len(payload), want)
+		}
+		decoded, err := decodeCompressedDataStagePacked(payload, bitWidth)
+		if err != nil {
+			t.Fatalf("width %d: decode failed: %v", bitWidth, err)
+		}
+		if !slices.Equal(decoded, compressed) {
+			t.Fatalf("width %d: round-trip mismatch", bitWidth)
+		}
+
+		if bitWidth < maxTokenBitWidth {
+			if _, err := encodeCompressedDataStagePacked([]uint16{limit + 1}, bitWidth); err == nil {
+				t.Fatalf("width %d: expected out-of-range token to fail", bitWidth)
+			}
+		}
+	}
+}
+
+func TestSerializationAllTokenBitWidths(t *testing.T) {
+	lines, err := loadTestDataLines("testdata/logs_apache_2k.log")
+	if err != nil {
+		t.Skipf("testdata not available: %v", err)
+	}
+	lines = lines[:500]
+
+	for bitWidth := minTokenBitWidth; bitWidth <= maxTokenBitWidth; bitWidth++ {
+		archive := mustEncode(NewEncoder(WithTokenBitWidth(bitWidth)), lines)
+		if archive.tokenBitWidth() != bitWidth {
+			t.Fatalf("width %d: archive width %d", bitWidth, archive.tokenBitWidth())
+		}
+		if maxID := len(archive.TokenBoundaries) - 2; maxID > int(maxTokenIDForBitWidth(bitWidth)) {
+			t.Fatalf("width %d: dictionary max ID %d exceeds width", bitWidth, maxID)
+		}
+
+		var blob bytes.Buffer
+		if _, err := archive.WriteTo(&blob); err != nil {
+			t.Fatalf("width %d: WriteTo failed: %v", bitWidth, err)
+		}
+		loaded := &Archive{}
+		if _, err := loaded.ReadFrom(&blob); err != nil {
+			t.Fatalf("width %d: ReadFrom failed: %v", bitWidth, err)
+		}
+		if loaded.tokenBitWidth() != bitWidth {
+			t.Fatalf("width %d: loaded width %d", bitWidth, loaded.tokenBitWidth())
+		}
+		if !slices.Equal(loaded.CompressedData, archive.CompressedData) {
+			t.Fatalf("width %d: compressed data mismatch after round-trip", bitWidth)
+		}
+	}
+}
+
+func TestCompressedDataParams(t *testing.T) {
+	if got := compressedDataParams(compressedDataEncodingFlate, tokenBitWidth12); !slices.Equal(got, []byte{stageCompressedDataParamWidth12Flate}) {
+		t.Fatalf("12-bit flate should use legacy params, got %v", got)
+	}
+	params := compressedDataParams(compressedDataEncodingHuffman, 10)
+	encoding, bitWidth, err := parseCompressedDataParams(params)
+	if err != nil || encoding != compressedDataEncodingHuffman || bitWidth != 10 {
+		t.Fatalf("params round-trip mismatch: %v %d %d %v", params, encoding, bitWidth, err)
+	}
+	for _, invalid := range [][]byte{nil, {99}, {compressedDataEncodingRaw, 8}, {compressedDataEncodingHuffman + 1, 12}, {0, 12, 0}} {
+		if _, _, err := parseCompressedDataParams(invalid); err == nil {
+			t.Fatalf("expected params %v to be rejected", invalid)
+		}
+	}
+}
+
+func TestInvalidTokenBitWidthRejected(t *testing.T) {
+	for _, bits := range []uint8{1, 8, 17, 32} {
+		if _, err := NewEncoder(WithTokenBitWidth(bits)).Encode([]string{"a"}); !errors.Is(err, ErrInvalidTokenBitWidth) {
+			t.Fatalf("Encode with width %d: expected ErrInvalidTokenBitWidth, got %v", bits, err)
+		}
+		if _, err := TrainModel([]string{"a"}, WithTokenBitWidth(bits)); !errors.Is(err, ErrInvalidTokenBitWidth) {
+			t.Fatalf("TrainModel with width %d: expected ErrInvalidTokenBitWidth, got %v", bits, err)
+		}
+	}
+}
+
+func TestAutoTokenBitWidth(t *testing.T) {
+	input := []string{"user_000001", "user_000002", "user_000003", "admin_001"}
+	archive := mustEncode(NewEncoder(WithAutoTokenBitWidth(), WithoutPassthrough()), input)
+	if want := tokenBitWidthFor(len(archive.TokenBoundaries) - 1); archive.tokenBitWidth() != want {
+		t.Fatalf("auto width: got %d want %d", archive.tokenBitWidth(), want)
+	}
+	if archive.tokenBitWidth() != minTokenBitWidth {
+		t.Fatalf("small dictionary should use %d-bit tokens, got %d", minTokenBitWidth, archive.tokenBitWidth())
+	}
+	verifyArchiveRoundTrip(t, archive, input)
+
+	if got := tokenBitWidthFor(513); got != 10 {
+		t.Fatalf("tokenBitWidthFor(513): got %d want 10", got)
+	}
+	if got := tokenBitWidthFor(65536); got != 16 {
+		t.Fatalf("tokenBitWidthFor(65536): got %d want 16", got)
+	}
+}
+
+// ============================================================================
+// Packed Token Storage Tests
+// ============================================================================
+
+func TestPackedTokenStorage(t *testing.T) {
+	input := []string{"user_000001", "user_000002", "admin_001", "", "user_000003"}
+	for _, bits := range []uint8{9, 12, 16} {
+		plain := mustEncode(NewEncoder(WithTokenBitWidth(bits), WithoutPassthrough()), input)
+		archive := mustEncode(NewEncoder(WithTokenBitWidth(bits), WithPackedTokenStorage(), WithoutPassthrough()), input)
+		if archive.packed == nil || archive.CompressedData != nil {
+			t.Fatalf("%d-bit: expected packed token storage", bits)
+		}
+		if !slices.Equal(archive.Tokens(), plain.CompressedData) {
+			t.Fatalf("%d-bit: packed tokens differ from unpacked stream", bits)
+		}
+		verifyArchiveRoundTrip(t, archive, input)
+
+		var plainBuf, packedBuf bytes.Buffer
+		if _, err := plain.WriteTo(&plainBuf); err != nil {
+			t.Fatalf("WriteTo plain: %v", err)
+		}
+		if _, err := archive.WriteTo(&packedBuf); err != nil {
+			t.Fatalf("WriteTo packed: %v", err)
+		}
+		if !bytes.Equal(plainBuf.Bytes(), packedBuf.Bytes()) {
+			t.Fatalf("%d-bit: packed archive serialized differently", bits)
+		}
+	}
+}
+
+func TestPackTokens(t *testing.T) {
+	input := makeSyntheticMixedRows(2000)
+	archive := mustEncode(NewEncoder(WithTokenBitWidth(12)), input)
+	tokens := slices.Clone(archive.CompressedData)
+
+	if err := archive.PackTokens(); err != nil {
+		t.Fatalf("PackTokens: %v", err)
+	}
+	if err := archive.PackTokens(); err != nil {
+		t.Fatalf("PackTokens again: %v", err)
+	}
+	if got, want := len(archive.packed.data)-packedTokenPadding, (len(tokens)*12+7)/8; got != want {
+		t.Fatalf("packed size: got %d bytes want %d", got, want)
+	}
+	if !slices.Equal(archive.Tokens(), tokens) {
+		t.Fatal("Tokens differ after packing")
+	}
+	verifyArchiveRoundTrip(t, archive, input)
+}
+
+func TestPackedTokenStorageEditing(t *testing.T) {
+	input := makeSyntheticMixedRows(300)
+	archive := mustEncode(NewEncoder(WithTokenBitWidth(12), WithPackedTokenStorage()), input)
+
+	shard := archive.Slice(100, 200)
+	if shard.packed == nil {
+		t.Fatal("slice of packed archive should stay packed")
+	}
+	verifyArchiveRoundTrip(t, shard, input[100:200])
+
+	if err := archive.Delete(5); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := archive.Compact(CompactOptions{PruneDictionary: true}); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if archive.packed == nil || archive.packed.bitWidth != archive.tokenBitWidth() {
+		t.Fatal("compacted archive should stay packed at the archive width")
+	}
+	want := append(slices.Clone(input[:5]), input[6:]...)
+	verifyArchiveRoundTrip(t, archive, want)
+
+	merged, err := Merge(archive, archive)
+	if err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	verifyArchiveRoundTrip(t, merged, append(slices.Clone(want), want...))
+}
+
+// ============================================================================
+// Compact Boundary Tests
+// ============================================================================
+
+func TestCompactBoundaries(t *testing.T) {
+	input := makeSyntheticMixedRows(500)
+	plain := mustEncode(NewEncoder(), input)
+	for name, opts := range map[string][]Option{
+		"compact":        {WithCompactBoundaries()},
+		"compact_packed": {WithCompactBoundaries(), WithPackedTokenStorage(), WithTokenBitWidth(12)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			archive := mustEncode(NewEncoder(opts...), input)
+			if archive.compactBoundaries == nil || archive.StringBoundaries != nil {
+				t.Fatal("expected compact boundaries")
+			}
+			if !slices.Equal(archive.Boundaries(), plain.StringBoundaries) {
+				t.Fatal("Boundaries differ from legacy string boundaries")
+			}
+			verifyArchiveRoundTrip(t, archive, input)
+
+			shard := archive.Slice(100, 200)
+			if shard.compactBoundaries == nil {
+				t.Fatal("slice of compact archive should keep compact boundaries")
+			}
+			verifyArchiveRoundTrip(t, shard, input[100:200])
+
+			if err := archive.Delete(0); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if err := archive.Compact(CompactOptions{}); err != nil {
+				t.Fatalf("Compact: %v", err)
+			}
+			if archive.compactBoundaries == nil {
+				t.Fatal("compacted archive should keep compact boundaries")
+			}
+			verifyArchiveRoundTrip(t, archive, input[1:])
+
+			merged, err := Merge(archive, shard)
+			if err != nil {
+				t.Fatalf("Merge: %v", err)
+			}
+			verifyArchiveRoundTrip(t, merged, append(slices.Clone(input[1:]), input[100:200]...))
+		})
+	}
+}
+
+// archiveResidentBytes approximates the in-memory footprint of an archive's
+// token stream, row index and dictionary on a 64-bit platform.
+func archiveResidentBytes(a *Archive) int {
+	size := len(a.CompressedData)*2 + len(a.StringBoundaries)*8 + len(a.compactBoundaries)*4
+	if a.packed != nil {
+		size += len(a.packed.data)
+	}
+	return size + len(a.Dictionary) + len(a.TokenBoundaries)*4
+}
+
+func TestCompactBoundariesSizes(t *testing.T) {
+	testFiles := []string{
+		"testdata/art_of_war.txt",
+		"testdata/en_mobydick.txt",
+		"testdata/logs_apache_2k.log",
+		"testdata/logs_hdfs_2k.log",
+		"testdata/zh_tao_te_ching_en.txt",
+	}
+
+	t.Logf("%-25s | %12s | %12s | %12s", "File", "Legacy", "Compact", "Compact+12b")
+	for _, testFile := range testFiles {
+		lines, err := loadTestDataLines(testFile)
+		if err != nil {
+			continue
+		}
+
+		legacy := mustEncode(NewEncoder(), lines)
+		compact := mustEncode(NewEncoder(WithCompactBoundaries()), lines)
+		packed := mustEncode(NewEncoder(WithCompactBoundaries(), WithPackedTokenStorage(), WithTokenBitWidth(12)), lines)
+		if archiveResidentBytes(compact) >= archiveResidentBytes(legacy) {
+			t.Fatalf("%s: compact boundaries did not reduce resident size", testFile)
+		}
+		t.Logf("%-25s | %12d | %12d | %12d", testFile[9:], archiveResidentBytes(legacy), archiveResidentBytes(compact), archiveResidentBytes(packed))
+	}
+}
+
+func TestCompactBoundariesMethod(t *testing.T) {
+	input := []string{"alpha", "", "beta", "gamma"}
+	archive := mustEncode(NewEncoder(), input)
+	legacy := slices.Clone(archive.StringBoundaries)
+
+	var before bytes.Buffer
+	if _, err := archive.WriteTo(&before); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if err := archive.CompactBoundaries(); err != nil {
+		t.Fatalf("CompactBoundaries: %v", err)
+	}
+	if err := archive.CompactBoundaries(); err != nil {
+		t.Fatalf("CompactBoundaries again: %v", err)
+	}
+	if !slices.Equal(archive.Boundaries(), legacy) {
+		t.Fatal("Boundaries changed after compaction")
+	}
+	var after bytes.Buffer
+	if _, err := archive.WriteTo(&after); err != nil {
+		t.Fatalf("WriteTo compact: %v", err)
+	}
+	if !bytes.Equal(before.Bytes(), after.Bytes()) {
+		t.Fatal("compact archive serialized differently")
+	}
+	verifyArchiveRoundTrip(t, archive, input)
+
+	archive.StringBoundaries = legacy
+	if _, err := archive.WriteTo(io.Discard); err == nil {
+		t.Fatal("expected error for archive with both boundary forms")
+	}
+}
+
+// ============================================================================
+// OnPair16 Fixed-Slot Decode Tests
+// ============================================================================
+
+func TestFixedSlotDecode(t *testing.T) {
+	lines, err := loadTestDataLines("testdata/logs_apache_2k.log")
+	if err != nil {
+		t.Skip("testdata not available")
+	}
+	archive := mustEncode(NewEncoder(WithMaxTokenLength(16)), lines)
+	if archive.fixedSlotTable() == nil {
+		t.Fatal("OnPair16 archive should have a fixed-slot table")
+	}
+	variable := *archive
+	variable.slots = nil
+
+	for i := range lines {
+		fixedLen, err := archive.DecodedLen(i)
+		if err != nil {
+			t.Fatalf("DecodedLen(%d): %v", i, err)
+		}
+		if want, _ := variable.DecodedLen(i); fixedLen != want {
+			t.Fatalf("DecodedLen(%d): got %d want %d", i, fixedLen, want)
+		}
+
+		// Sentinel bytes past the row must survive both decoders.
+		buffer := bytes.Repeat([]byte{0xAA}, fixedLen+fixedSlotSize)
+		n, err := archive.DecompressString(i, buffer[:fixedLen])
+		if err != nil {
+			t.Fatalf("DecompressString(%d): %v", i, err)
+		}
+		if string(buffer[:n]) != lines[i] {
+			t.Fatalf("DecompressString(%d): got %q want %q", i, buffer[:n], lines[i])
+		}
+		if !bytes.Equal(buffer[n:], bytes.Repeat([]byte{0xAA}, fixedSlotSize)) {
+			t.Fatalf("DecompressString(%d) wrote past the row", i)
+		}
+		row, err := archive.AppendRow(buffer[:0], i)
+		if err != nil {
+			t.Fatalf("AppendRow(%d): %v", i, err)
+		}
+		if string(row) != lines[i] || !bytes.Equal(buffer[n:], bytes.Repeat([]byte{0xAA}, fixedSlotSize)) {
+			t.Fatalf("AppendRow(%d) decoded %q or wrote past the row", i, row)
+		}
+	}
+	verifyArchiveRoundTrip(t, archive, lines)
+
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	loaded := &Archive{}
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if loaded.fixedSlotTable() == nil {
+		t.Fatal("ReadFrom should build the fixed-slot table")
+	}
+	verifyArchiveRoundTrip(t, loaded, lines)
+}
+
+func TestFixedSlotTableIsLazy(t *testing.T) {
+	input := []string{"alpha beta", "alpha gamma", "delta"}
+	archive := mustEncode(NewEncoder(WithMaxTokenLength(16), WithoutPassthrough()), input)
+	if archive.slots == nil || archive.slots.table != nil {
+		t.Fatal("the fixed-slot table should not be built before the first decode")
+	}
+	if _, err := archive.AppendRow(nil, 0); err != nil {
+		t.Fatalf("AppendRow: %v", err)
+	}
+	if archive.slots.table == nil {
+		t.Fatal("decoding should build the fixed-slot table")
+	}
+
+	// Concurrent first decodes build the table once.
+	shared := mustEncode(NewEncoder(WithMaxTokenLength(16), WithoutPassthrough()), input)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, want := range input {
+				if row, err := shared.AppendRow(nil, i); err != nil || string(row) != want {
+					t.Errorf("AppendRow(%d): got %q (%v) want %q", i, row, err, want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for name, opt := range map[string]Option{"packed": WithPackedTokenStorage(), "compact": WithCompactBoundaries()} {
+		compact := mustEncode(NewEncoder(WithMaxTokenLength(16), WithoutPassthrough(), opt), input)
+		verifyArchiveRoundTrip(t, compact, input)
+		if compact.slots.table != nil || compact.fixedSlotTable() != nil {
+			t.Fatalf("%s: compact layouts should not build a fixed-slot table", name)
+		}
+	}
+}
+
+func TestFixedSlotTableInvalidation(t *testing.T) {
+	input := []string{"alpha beta", "alpha gamma", "delta"}
+	archive := mustEncode(NewEncoder(WithMaxTokenLength(16), WithoutPassthrough()), input)
+	if archive.fixedSlotTable() == nil {
+		t.Fatal("expected fixed-slot table")
+	}
+	archive.Dictionary = slices.Clone(archive.Dictionary)
+	if archive.fixedSlotTable() != nil {
+		t.Fatal("replacing Dictionary should disable the fixed-slot table")
+	}
+	verifyArchiveRoundTrip(t, archive, input)
+
+	if newFixedSlots([]byte(strings.Repeat("x", 17)), []uint32{0, 17}) != nil {
+		t.Fatal("tokens longer than a slot should not build a table")
+	}
+}
+
+// ============================================================================
+// Validation Tests
+// ============================================================================
+
+func TestValidatedArchiveDecode(t *testing.T) {
+	input := makeSyntheticMixedRows(200)
+	archive := mustEncode(NewEncoder(WithoutPassthrough()), input)
+	archive.slots = nil
+	if !archive.isValidated() {
+		t.Fatal("encoded archive should be validated")
+	}
+	verifyArchiveRoundTrip(t, archive, input)
+
+	handBuilt := &Archive{
+		CompressedData:   archive.CompressedData,
+		StringBoundaries: archive.StringBoundaries,
+		Dictionary:       archive.Dictionary,
+		TokenBoundaries:  archive.TokenBoundaries,
+	}
+	if handBuilt.isValidated() {
+		t.Fatal("hand-built archive should not be validated")
+	}
+	verifyArchiveRoundTrip(t, handBuilt, input)
+
+	if !archive.Slice(10, 20).isValidated() {
+		t.Fatal("slice of a validated archive should be validated")
+	}
+	if _, err := archive.DecompressString(0, nil); !errors.Is(err, ErrShortBuffer) {
+		t.Fatalf("expected ErrShortBuffer from validated archive, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := handBuilt.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	loaded := &Archive{}
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if !loaded.isValidated() {
+		t.Fatal("ReadFrom should mark the archive validated")
+	}
+
+	// Replacing a field drops the archive back onto the checked path.
+	loaded.CompressedData = append([]uint16(nil), loaded.CompressedData...)
+	loaded.CompressedData[0] = uint16(len(loaded.TokenBoundaries))
+	if loaded.isValidated() {
+		t.Fatal("replacing CompressedData should reset validation")
+	}
+	if _, err := loaded.AppendRow(nil, 0); err == nil {
+		t.Fatal("expected invalid token error after replacing CompressedData")
+	}
+}
+
+func TestValidateReportsAllIssues(t *testing.T) {
+	input := []string{"alpha", "beta", "gamma", "delta"}
+	base := mustEncode(NewEncoder(WithoutPassthrough()), input)
+	if err := base.Validate(); err != nil {
+		t.Fatalf("Validate on encoded archive: %v", err)
+	}
+
+	archive := &Archive{
+		CompressedData:   slices.Clone(base.CompressedData),
+		StringBoundaries: slices.Clone(base.StringBoundaries),
+		Dictionary:       base.Dictionary,
+		TokenBoundaries:  base.TokenBoundaries,
+	}
+	badID := uint16(len(archive.TokenBoundaries))
+	archive.CompressedData[0] = badID
+	last := len(archive.CompressedData) - 1
+	archive.CompressedData[last] = badID + 1
+
+	err := archive.Validate()
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("expected *CorruptionError, got %v", err)
+	}
+	if len(corruption.Issues) != 2 || corruption.Truncated {
+		t.Fatalf("expected 2 issues, got %+v", corruption)
+	}
+	first, second := corruption.Issues[0], corruption.Issues[1]
+	if first.Stage != stageCompressedData || first.Row != 0 || first.Token != 0 || first.Value != int64(badID) {
+		t.Fatalf("unexpected first issue: %+v", first)
+	}
+	if second.Row != len(input)-1 || second.Token != last || second.Value != int64(badID+1) {
+		t.Fatalf("unexpected second issue: %+v", second)
+	}
+	if archive.isValidated() {
+		t.Fatal("corrupt archive must not be marked validated")
+	}
+
+	archive.CompressedData = slices.Repeat([]uint16{badID}, maxCorruptionIssues+10)
+	archive.StringBoundaries = []int{0, len(archive.CompressedData)}
+	if !errors.As(archive.Validate(), &corruption) || !corruption.Truncated || len(corruption.Issues) != maxCorruptionIssues {
+		t.Fatalf("expected truncated report with %d issues", maxCorruptionIssues)
+	}
+
+	handBuilt := &Archive{
+		CompressedData:   base.CompressedData,
+		StringBoundaries: base.StringBoundaries,
+		Dictionary:       base.Dictionary,
+		TokenBoundaries:  base.TokenBoundaries,
+	}
+	if err := handBuilt.Validate(); err != nil || !handBuilt.isValidated() {
+		t.Fatalf("Validate should mark a valid hand-built archive validated: %v", err)
+	}
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	input := []string{"alpha", "beta", "", "gamma"}
+	archive := mustEncode(NewEncoder(), input)
+	original := make([][]byte, len(input))
+	for i, row := range input {
+		original[i] = []byte(row)
+	}
+	if err := archive.VerifyRoundTrip(original); err != nil {
+		t.Fatalf("VerifyRoundTrip: %v", err)
+	}
+	if err := archive.VerifyRoundTrip(original[:2]); err == nil {
+		t.Fatal("expected row count mismatch error")
+	}
+
+	original[1] = []byte("BETA")
+	var corruption *CorruptionError
+	if err := archive.VerifyRoundTrip(original); !errors.As(err, &corruption) || corruption.Issues[0].Row != 1 {
+		t.Fatalf("expected mismatch on row 1, got %v", err)
+	}
+
+	if err := archive.Delete(1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := archive.VerifyRoundTrip(original); err != nil {
+		t.Fatalf("deleted rows should not be compared: %v", err)
+	}
+}
+
+// ============================================================================
+// Error Type Tests
+// ============================================================================
+
+func TestIndexOutOfRangeErrors(t *testing.T) {
+	archive := mustEncode(NewEncoder(), []string{"alpha", "beta"})
+	if _, err := archive.AppendRow(nil, 2); !errors.Is(err, ErrIndexOutOfRange) {
+		t.Fatalf("AppendRow: expected ErrIndexOutOfRange, got %v", err)
+	}
+	if _, err := archive.DecodedLen(-1); !errors.Is(err, ErrIndexOutOfRange) {
+		t.Fatalf("DecodedLen: expected ErrIndexOutOfRange, got %v", err)
+	}
+	if _, err := archive.DecompressString(5, make([]byte, 16)); !errors.Is(err, ErrIndexOutOfRange) {
+		t.Fatalf("DecompressString: expected ErrIndexOutOfRange, got %v", err)
+	}
+	if err := archive.Delete(2); !errors.Is(err, ErrIndexOutOfRange) {
+		t.Fatalf("Delete: expected ErrIndexOutOfRange, got %v", err)
+	}
+}
+
+func TestCorruptArchiveErrors(t *testing.T) {
+	base := mustEncode(NewEncoder(WithoutPassthrough()), []string{"alpha", "beta"})
+	archive := &Archive{
+		CompressedData:   slices.Clone(base.CompressedData),
+		StringBoundaries: base.StringBoundaries,
+		Dictionary:       base.Dictionary,
+		TokenBoundaries:  base.TokenBoundaries,
+	}
+	archive.CompressedData[0] = uint16(len(archive.TokenBoundaries))
+	if _, err := archive.AppendRow(nil, 0); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("AppendRow: expected ErrCorruptArchive, got %v", err)
+	}
+	if _, err := archive.WriteTo(io.Discard); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("WriteTo: expected ErrCorruptArchive, got %v", err)
+	}
+	if err := archive.Validate(); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("Validate: expected ErrCorruptArchive, got %v", err)
+	}
+}
+
+func TestReadFromErrorTypes(t *testing.T) {
+	archive := mustEncode(NewEncoder(), []string{"user_001", "admin_001"})
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	serialized := buf.Bytes()
+
+	badMagic := slices.Clone(serialized)
+	badMagic[0] = 'X'
+	if _, err := (&Archive{}).ReadFrom(bytes.NewReader(badMagic)); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("bad magic: expected ErrCorruptArchive, got %v", err)
+	}
+
+	badVersion := slices.Clone(serialized)
+	binary.LittleEndian.PutUint16(badVersion[4:], FormatVersion3+1)
+	if _, err := (&Archive{}).ReadFrom(bytes.NewReader(badVersion)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("bad version: expected ErrUnsupportedVersion, got %v", err)
+	}
+
+	var stageErr *StageError
+	_, err := (&Archive{}).ReadFrom(bytes.NewReader(serialized[:len(serialized)-1]))
+	if !errors.As(err, &stageErr) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated: expected *StageError wrapping io.ErrUnexpectedEOF, got %v", err)
+	}
+	if errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("truncated read should not be reported as corruption: %v", err)
+	}
+
+	// Corrupt the first stage's params so decoding fails.
+	badParams := slices.Clone(serialized)
+	nameLen := int(badParams[8])
+	paramsOffset := 8 + 1 + 2 + 4 + nameLen
+	badParams[paramsOffset] = 0xFF
+	_, err = (&Archive{}).ReadFrom(bytes.NewReader(badParams))
+	if !errors.As(err, &stageErr) || !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("bad params: expected corrupt *StageError, got %v", err)
+	}
+	if stageErr.Op != "decode" || stageErr.Stage != stageCompressedData || stageErr.Index != 0 {
+		t.Fatalf("unexpected stage error: %+v", stageErr)
+	}
+}
+
+// ============================================================================
+// Reader Limit Tests
+// ============================================================================
+
+func TestReadFromWithOptionsLimits(t *testing.T) {
+	input := makeSyntheticMixedRows(3000)
+	archive := mustEncode(NewEncoder(), input)
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	serialized := buf.Bytes()
+
+	loaded := &Archive{}
+	generous := ReaderOptions{
+		MaxTotalBytes:             int64(len(serialized)),
+		MaxRows:                   len(input),
+		MaxDictionaryBytes:        len(archive.Dictionary),
+		MaxDecompressedStageBytes: 1 << 20,
+	}
+	if _, err := loaded.ReadFromWithOptions(bytes.NewReader(serialized), generous); err != nil {
+		t.Fatalf("ReadFromWithOptions within limits: %v", err)
+	}
+	verifyArchiveRoundTrip(t, loaded, input)
+
+	for name, opts := range map[string]ReaderOptions{
+		"total_bytes": {MaxTotalBytes: int64(len(serialized)) - 1},
+		"rows":        {MaxRows: len(input) - 1},
+		"dictionary":  {MaxDictionaryBytes: len(archive.Dictionary) - 1},
+		"stage_bytes": {MaxDecompressedStageBytes: len(archive.CompressedData)*2 - 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := (&Archive{}).ReadFromWithOptions(bytes.NewReader(serialized), opts)
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("expected ErrLimitExceeded, got %v", err)
+			}
+			if errors.Is(err, ErrCorruptArchive) {
+				t.Fatalf("limit violation should not be reported as corruption: %v", err)
+			}
+			var stageErr *StageError
+			if !errors.As(err, &stageErr) {
+				t.Fatalf("expected *StageError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadFromWithOptionsFlateExpansion(t *testing.T) {
+	input := make([]string, 20000)
+	for i := range input {
+		input[i] = "x"
+	}
+	archive := mustEncode(NewEncoder(), input)
+	payload, params, err := encodeCompressedDataStage(archive, EncodingAuto, flate.BestCompression, archiveVersion)
+	if err != nil {
+		t.Fatalf("encodeCompressedDataStage: %v", err)
+	}
+	encoding, _, err := parseCompressedDataParams(params)
+	if err != nil || encoding != compressedDataEncodingFlate && encoding != compressedDataEncodingCodebookFlate {
+		t.Fatalf("expected a flate encoding for repetitive input, got %d (%v)", encoding, err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	opts := ReaderOptions{MaxDecompressedStageBytes: len(payload) * 2}
+	if opts.MaxDecompressedStageBytes >= len(input) {
+		t.Fatalf("flate payload unexpectedly large: %d bytes", len(payload))
+	}
+	_, err = (&Archive{}).ReadFromWithOptions(&buf, opts)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded for flate expansion, got %v", err)
+	}
+}
+
+// ============================================================================
+// Archive Reader Tests
+// ============================================================================
+
+// compressedDataEncodingOf returns the encoding and token bit width of the
+// compressed_data stage of a serialized archive, which must come first.
+func compressedDataEncodingOf(t *testing.T, blob []byte) (uint8, uint8) {
+	t.Helper()
+	r := bytes.NewReader(blob)
+	if _, _, err := readArchiveHeader(r); err != nil {
+		t.Fatalf("readArchiveHeader: %v", err)
+	}
+	header, _, err := readStageHeader(r)
+	if err != nil || header.name != stageCompressedData {
+		t.Fatalf("expected compressed_data first, got %q (%v)", header.name, err)
+	}
+	params := make([]byte, header.paramLen)
+	if _, err := io.ReadFull(r, params); err != nil {
+		t.Fatalf("read params: %v", err)
+	}
+	encoding, bitWidth, err := parseCompressedDataParams(params)
+	if err != nil {
+		t.Fatalf("parseCompressedDataParams(%v): %v", params, err)
+	}
+	return encoding, bitWidth
+}
+
+// writeRawTokenArchive serializes a with its compressed_data stage forced to
+// the raw packed encoding, so a Reader can fetch tokens lazily.
+func writeRawTokenArchive(t *testing.T, a *Archive) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if _, err := a.WriteTo(&encoded); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	r := bytes.NewReader(encoded.Bytes())
+	header, _, err := readArchiveHeader(r)
+	if err != nil {
+		t.Fatalf("readArchiveHeader: %v", err)
+	}
+
+	var out bytes.Buffer
+	out.Write(header.raw)
+	for range header.stageCount {
+		header, _, err := readStageHeader(r)
+		if err != nil {
+			t.Fatalf("readStageHeader: %v", err)
+		}
+		params := make([]byte, header.paramLen)
+		payload := make([]byte, header.dataLen)
+		if _, err := io.ReadFull(r, params); err != nil {
+			t.Fatalf("read params: %v", err)
+		}
+		if _, err := io.ReadFull(r, payload); err != nil {
+			t.Fatalf("read payload: %v", err)
+		}
+		if header.name == stageCompressedData {
+			payload, err = encodeCompressedDataStagePacked(a.tokenSlice(0, a.tokenCount()), a.wireTokenBitWidth())
+			if err != nil {
+				t.Fatalf("encodeCompressedDataStagePacked: %v", err)
+			}
+			params = compressedDataParams(compressedDataEncodingRaw, a.wireTokenBitWidth())
+		}
+		if _, err := writeStage(&out, header.name, params, payload); err != nil {
+			t.Fatalf("writeStage: %v", err)
+		}
+	}
+	return out.Bytes()
+}
+
+// countingReaderAt records the bytes read through it.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	bytes int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.bytes += int64(n)
+	return n, err
+}
+
+func TestReaderRawTokensLazy(t *testing.T) {
+	input := makeSyntheticMixedRows(2000)
+	for _, bitWidth := range []uint8{9, 12, 16} {
+		t.Run(fmt.Sprintf("width_%d", bitWidth), func(t *testing.T) {
+			archive := mustEncode(NewEncoder(WithTokenBitWidth(bitWidth)), input)
+			serialized := writeRawTokenArchive(t, archive)
+
+			src := &countingReaderAt{r: bytes.NewReader(serialized)}
+			rd, err := NewReader(src, int64(len(serialized)))
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+			if rd.tokenOffset < 0 {
+				t.Fatalf("expected lazy token access for raw compressed_data")
+			}
+			if rd.Rows() != len(input) {
+				t.Fatalf("Rows: got %d want %d", rd.Rows(), len(input))
+			}
+			tokenBytes := int64(packedByteSize(archive.tokenCount(), archive.tokenBitWidth()))
+			if opened := src.bytes; opened >= int64(len(serialized))-tokenBytes+8 {
+				t.Fatalf("NewReader read %d bytes, expected to skip the %d token bytes", opened, tokenBytes)
+			}
+
+			var row []byte
+			for i, want := range input {
+				before := src.bytes
+				row, err = rd.AppendRow(row[:0], i)
+				if err != nil {
+					t.Fatalf("AppendRow(%d): %v", i, err)
+				}
+				if string(row) != want {
+					t.Fatalf("row %d mismatch: got %q want %q", i, row, want)
+				}
+				start, end := archive.rowSpan(i)
+				if limit := int64((end-start)*int(bitWidth)/8 + 2); src.bytes-before > limit {
+					t.Fatalf("row %d read %d bytes, expected at most %d", i, src.bytes-before, limit)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderFallsBackToFullDecode(t *testing.T) {
+	input := make([]string, 5000)
+	for i := range input {
+		input[i] = "repeated row content"
+	}
+	archive := mustEncode(NewEncoder(), input)
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	rd, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if rd.tokenOffset >= 0 {
+		t.Fatalf("expected full decode for a non-raw compressed_data stage")
+	}
+	for i, want := range input {
+		row, err := rd.AppendRow(nil, i)
+		if err != nil {
+			t.Fatalf("AppendRow(%d): %v", i, err)
+		}
+		if string(row) != want {
+			t.Fatalf("row %d mismatch: got %q want %q", i, row, want)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	input := []string{"alpha", "beta", "gamma", "delta"}
+	archive := mustEncode(NewEncoder(WithoutPassthrough()), input)
+	if err := archive.Delete(1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	serialized := writeRawTokenArchive(t, archive)
+
+	rd, err := NewReader(bytes.NewReader(serialized), int64(len(serialized)))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if !rd.IsDeleted(1) {
+		t.Fatalf("expected row 1 to be deleted")
+	}
+	if _, err := rd.AppendRow(nil, 1); !errors.Is(err, ErrRowDeleted) {
+		t.Fatalf("expected ErrRowDeleted, got %v", err)
+	}
+	for _, index := range []int{-1, len(input)} {
+		if _, err := rd.AppendRow(nil, index); !errors.Is(err, ErrIndexOutOfRange) {
+			t.Fatalf("AppendRow(%d): expected ErrIndexOutOfRange, got %v", index, err)
+		}
+	}
+
+	// A token ID past the dictionary is reported when its row is read.
+	corrupted := bytes.Clone(serialized)
+	tokenStart := rd.tokenOffset + int64(2*archive.boundaryAt(2))
+	binary.LittleEndian.PutUint16(corrupted[tokenStart:], 0xFFFF)
+	rd, err = NewReader(bytes.NewReader(corrupted), int64(len(corrupted)))
+	if err != nil {
+		t.Fatalf("NewReader on corrupted tokens: %v", err)
+	}
+	if _, err := rd.AppendRow(nil, 2); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("expected ErrCorruptArchive, got %v", err)
+	}
+	if row, err := rd.AppendRow(nil, 0); err != nil || string(row) != input[0] {
+		t.Fatalf("row 0 should still decode: %q, %v", row, err)
+	}
+
+	if _, err := NewReader(bytes.NewReader(serialized), int64(len(serialized))-1); err == nil {
+		t.Fatalf("expected error for truncated archive")
+	}
+	if _, err := NewReader(bytes.NewReader([]byte("OPAR")), 4); err == nil {
+		t.Fatalf("expected error for short header")
+	}
+}
+
+func TestNewReaderWithOptionsLimits(t *testing.T) {
+	input := makeSyntheticMixedRows(3000)
+	archive := mustEncode(NewEncoder(), input)
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	serialized := buf.Bytes()
+	open := func(opts ReaderOptions) (*Reader, error) {
+		return NewReaderWithOptions(bytes.NewReader(serialized), int64(len(serialized)), opts)
+	}
+
+	rd, err := open(ReaderOptions{
+		MaxTotalBytes:             int64(len(serialized)),
+		MaxRows:                   len(input),
+		MaxDictionaryBytes:        len(archive.Dictionary),
+		MaxDecompressedStageBytes: 1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("NewReaderWithOptions within limits: %v", err)
+	}
+	if row, err := rd.AppendRow(nil, 5); err != nil || string(row) != input[5] {
+		t.Fatalf("row 5: got %q (%v) want %q", row, err, input[5])
+	}
+
+	for name, opts := range map[string]ReaderOptions{
+		"total_bytes": {MaxTotalBytes: int64(len(serialized)) - 1},
+		"rows":        {MaxRows: len(input) - 1},
+		"dictionary":  {MaxDictionaryBytes: len(archive.Dictionary) - 1},
+		"stage_bytes": {MaxDecompressedStageBytes: len(archive.CompressedData)*2 - 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := open(opts)
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("expected ErrLimitExceeded, got %v", err)
+			}
+			if errors.Is(err, ErrCorruptArchive) {
+				t.Fatalf("limit violation should not be reported as corruption: %v", err)
+			}
+		})
+	}
+}
+
+// ============================================================================
+// Streaming Writer Tests
+// ============================================================================
+
+func TestWriteToWithOptionsRawEncoding(t *testing.T) {
+	input := makeSyntheticMixedRows(3000)
+	cases := map[string][]Option{
+		"width_16": nil,
+		"width_12": {WithTokenBitWidth(12)},
+		"packed":   {WithTokenBitWidth(11), WithPackedTokenStorage(), WithCompactBoundaries()},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			archive := mustEncode(NewEncoder(opts...), input)
+			if err := archive.Delete(7); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+
+			var buf bytes.Buffer
+			n, err := archive.WriteToWithOptions(&buf, WriteOptions{Encoding: EncodingRaw})
+			if err != nil {
+				t.Fatalf("WriteToWithOptions: %v", err)
+			}
+			if n != int64(buf.Len()) {
+				t.Fatalf("reported %d bytes, wrote %d", n, buf.Len())
+			}
+			if want := writeRawTokenArchive(t, archive); !bytes.Equal(buf.Bytes(), want) {
+				t.Fatalf("streamed archive differs from raw-encoded archive")
+			}
+
+			loaded := &Archive{}
+			if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+				t.Fatalf("ReadFrom: %v", err)
+			}
+			if !loaded.IsDeleted(7) {
+				t.Fatalf("expected row 7 to stay deleted")
+			}
+			for i, want := range input {
+				if i == 7 {
+					continue
+				}
+				row, err := loaded.AppendRow(nil, i)
+				if err != nil || string(row) != want {
+					t.Fatalf("row %d: got %q (%v) want %q", i, row, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteToWithOptionsDefaultMatchesWriteTo(t *testing.T) {
+	archive := mustEncode(NewEncoder(WithTokenBitWidth(12)), makeSyntheticMixedRows(2000))
+	var viaWriteTo, viaOptions bytes.Buffer
+	if _, err := archive.WriteTo(&viaWriteTo); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if _, err := archive.WriteToWithOptions(&viaOptions, WriteOptions{}); err != nil {
+		t.Fatalf("WriteToWithOptions: %v", err)
+	}
+	if !bytes.Equal(viaWriteTo.Bytes(), viaOptions.Bytes()) {
+		t.Fatalf("default options should match WriteTo")
+	}
+}
+
+func TestWriteToWithOptionsStreamsWithoutBuffering(t *testing.T) {
+	const tokens = 1 << 22
+	archive := &Archive{
+		CompressedData:   make([]uint16, tokens),
+		StringBoundaries: make([]int, tokens/8+1),
+		Dictionary:       make([]byte, 256),
+		TokenBoundaries:  make([]uint32, 257),
+	}
+	for i := range archive.CompressedData {
+		archive.CompressedData[i] = uint16(i * 7 % 256)
+	}
+	for i := range archive.StringBoundaries {
+		archive.StringBoundaries[i] = i * 8
+	}
+	for i := range archive.Dictionary {
+		archive.Dictionary[i] = byte(i)
+		archive.TokenBoundaries[i+1] = uint32(i + 1)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	n, err := archive.WriteToWithOptions(io.Discard, WriteOptions{Encoding: EncodingRaw})
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatalf("WriteToWithOptions: %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(n)/8 {
+		t.Fatalf("allocated %d bytes to write a %d-byte archive", allocated, n)
+	}
+}
+
+func TestWriteToWithOptionsAutoDoesNotBufferCandidates(t *testing.T) {
+	const tokens = 1 << 23
+	archive := &Archive{
+		CompressedData:   make([]uint16, tokens),
+		StringBoundaries: make([]int, tokens/8+1),
+		Dictionary:       make([]byte, 256),
+		TokenBoundaries:  make([]uint32, 257),
+	}
+	for i := range archive.CompressedData {
+		archive.CompressedData[i] = uint16(i * 7 % 256)
+	}
+	for i := range archive.StringBoundaries {
+		archive.StringBoundaries[i] = i * 8
+	}
+	for i := range archive.Dictionary {
+		archive.Dictionary[i] = byte(i)
+		archive.TokenBoundaries[i+1] = uint32(i + 1)
+	}
+
+	packed := *archive
+	if err := packed.PackTokens(); err != nil {
+		t.Fatalf("PackTokens: %v", err)
+	}
+
+	// Every candidate is sized, but only flate writers, token counts, chunk
+	// buffers and flate payloads up to flateKeepBytes are allocated, whatever
+	// the size of the token stream.
+	for name, a := range map[string]*Archive{"unpacked": archive, "packed": &packed} {
+		for _, version := range []uint16{FormatVersion2, FormatVersion3} {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := a.WriteToWithOptions(io.Discard, WriteOptions{FlateLevel: flate.BestSpeed, FormatVersion: version})
+			runtime.ReadMemStats(&after)
+			if err != nil {
+				t.Fatalf("%s: WriteToWithOptions: %v", name, err)
+			}
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > tokens {
+				t.Fatalf("%s, version %d: allocated %d bytes to write a %d-byte token stream", name, version, allocated, 2*tokens)
+			}
+		}
+	}
+}
+
+func TestFlateStreamKeepsSmallPayloads(t *testing.T) {
+	archive := mustEncode(NewEncoder(WithoutPassthrough()), makeSyntheticMixedRows(3000))
+	src := rawTokenStream(archive, archive.tokenBitWidth())
+	fw, err := flate.NewWriter(io.Discard, flate.BestCompression)
+	if err != nil {
+		t.Fatalf("flate.NewWriter: %v", err)
+	}
+	var payloads [][]byte
+	for _, keep := range []int{0, flateKeepBytes} {
+		params := compressedDataParams(compressedDataEncodingFlate, archive.tokenBitWidth())
+		stage, err := flateStream(stageCompressedData, params, src, fw, keep)
+		if err != nil {
+			t.Fatalf("keep %d: %v", keep, err)
+		}
+		// A second write must give the same payload whether it was kept or
+		// is compressed again.
+		first, err := stage.bytes()
+		if err != nil {
+			t.Fatalf("keep %d: %v", keep, err)
+		}
+		second, err := stage.bytes()
+		if err != nil || !bytes.Equal(first, second) || len(first) != stage.size {
+			t.Fatalf("keep %d: payloads of %d and %d B for size %d (%v)", keep, len(first), len(second), stage.size, err)
+		}
+		payloads = append(payloads, first)
+	}
+	if !bytes.Equal(payloads[0], payloads[1]) {
+		t.Fatalf("recompressed payload %d B, kept payload %d B", len(payloads[0]), len(payloads[1]))
+	}
+}
+
+// shortWriter accepts up to limit bytes and then fails.
+type shortWriter struct {
+	limit int
+	n     int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.n+len(p) > w.limit {
+		accepted := w.limit - w.n
+		w.n = w.limit
+		return accepted, io.ErrShortWrite
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
+func TestWriteToWithOptionsWriterError(t *testing.T) {
+	archive := mustEncode(NewEncoder(), makeSyntheticMixedRows(3000))
+	for _, opts := range []WriteOptions{{}, {Encoding: EncodingRaw}} {
+		w := &shortWriter{limit: 100}
+		n, err := archive.WriteToWithOptions(w, opts)
+		if !errors.Is(err, io.ErrShortWrite) {
+			t.Fatalf("expected io.ErrShortWrite, got %v", err)
+		}
+		if n != int64(w.n) {
+			t.Fatalf("reported %d bytes, writer accepted %d", n, w.n)
+		}
+	}
+}
+
+func TestWriteToWithOptionsEncoding(t *testing.T) {
+	input := makeSyntheticMixedRows(3000)
+	for _, bitWidth := range []uint8{12, 16} {
+		archive := mustEncode(NewEncoder(WithTokenBitWidth(bitWidth)), input)
+		for _, encoding := range []TokenEncoding{EncodingRaw, EncodingFlate, EncodingCodebook, EncodingCodebookFlate, EncodingHuffman} {
+			t.Run(fmt.Sprintf("%s_%d", encoding, bitWidth), func(t *testing.T) {
+				var buf bytes.Buffer
+				if _, err := archive.WriteToWithOptions(&buf, WriteOptions{Encoding: encoding}); err != nil {
+					t.Fatalf("WriteToWithOptions: %v", err)
+				}
+				got, width := compressedDataEncodingOf(t, buf.Bytes())
+				if got != encoding.wire() || width != bitWidth {
+					t.Fatalf("got encoding %d width %d, want %d width %d", got, width, encoding.wire(), bitWidth)
+				}
+
+				loaded := &Archive{}
+				if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+					t.Fatalf("ReadFrom: %v", err)
+				}
+				verifyArchiveRoundTrip(t, loaded, input)
+			})
+		}
+	}
+}
+
+func TestWriteToWithOptionsFlateLevel(t *testing.T) {
+	archive := mustEncode(NewEncoder(), makeSyntheticMixedRows(3000))
+	sizes := make(map[int]int)
+	for _, level := range []int{flate.HuffmanOnly, flate.BestSpeed, flate.BestCompression} {
+		var buf bytes.Buffer
+		if _, err := archive.WriteToWithOptions(&buf, WriteOptions{Encoding: EncodingFlate, FlateLevel: level}); err != nil {
+			t.Fatalf("WriteToWithOptions(level %d): %v", level, err)
+		}
+		loaded := &Archive{}
+		if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("ReadFrom(level %d): %v", level, err)
+		}
+		sizes[level] = buf.Len()
+	}
+	if sizes[flate.BestCompression] > sizes[flate.BestSpeed] {
+		t.Fatalf("BestCompression (%d B) larger than BestSpeed (%d B)", sizes[flate.BestCompression], sizes[flate.BestSpeed])
+	}
+
+	var defaultLevel, best bytes.Buffer
+	if _, err := archive.WriteToWithOptions(&defaultLevel, WriteOptions{Encoding: EncodingFlate}); err != nil {
+		t.Fatalf("WriteToWithOptions: %v", err)
+	}
+	if _, err := archive.WriteToWithOptions(&best, WriteOptions{Encoding: EncodingFlate, FlateLevel: flate.BestCompression}); err != nil {
+		t.Fatalf("WriteToWithOptions: %v", err)
+	}
+	if !bytes.Equal(defaultLevel.Bytes(), best.Bytes()) {
+		t.Fatalf("zero FlateLevel should select flate.BestCompression")
+	}
+}
+
+func TestWriteToWithOptionsInvalid(t *testing.T) {
+	archive := mustEncode(NewEncoder(), []string{"a", "b"})
+	for _, opts := range []WriteOptions{
+		{Encoding: EncodingHuffman + 1},
+		{FlateLevel: flate.BestCompression + 1},
+		{FlateLevel: flate.HuffmanOnly - 1},
+	} {
+		var buf bytes.Buffer
+		if _, err := archive.WriteToWithOptions(&buf, opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("invalid options should not write anything: %+v", opts)
+		}
+	}
+}
+
+// ============================================================================
+// Format Version Tests
+// ============================================================================
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden archives in testdata")
+
+var goldenRows = []string{
+	"GET /index.html 200",
+	"GET /about.html 200",
+	"POST /login 302",
+	"GET /index.html 304",
+	"",
+	"GET /missing 404",
+}
+
+func TestArchiveGoldenFiles(t *testing.T) {
+	// Frozen files were written by earlier releases; they are only read,
+	// since the writer now picks a different layout for the same archive.
+	cases := []struct {
+		file    string
+		opts    WriteOptions
+		deleted int
+		parents bool
+		frozen  bool
+	}{
+		{"testdata/golden/v2.opar", WriteOptions{FormatVersion: FormatVersion2}, -1, false, false},
+		{"testdata/golden/v3.opar", WriteOptions{FormatVersion: FormatVersion3}, 2, false, true},
+		{"testdata/golden/v3_parents.opar", WriteOptions{FormatVersion: FormatVersion3}, 2, true, false},
+	}
+	for _, tc := range cases {
+		t.Run(filepath.Base(tc.file), func(t *testing.T) {
+			if !tc.frozen {
+				archive := mustEncode(NewEncoder(WithTokenBitWidth(12), WithoutPassthrough()), goldenRows)
+				if tc.deleted >= 0 {
+					if err := archive.Delete(tc.deleted); err != nil {
+						t.Fatalf("Delete: %v", err)
+					}
+				}
+				var buf bytes.Buffer
+				if _, err := archive.WriteToWithOptions(&buf, tc.opts); err != nil {
+					t.Fatalf("WriteToWithOptions: %v", err)
+				}
+				if *updateGolden {
+					if err := os.WriteFile(tc.file, buf.Bytes(), 0o644); err != nil {
+						t.Fatalf("write golden file: %v", err)
+					}
+				}
+				golden, err := os.ReadFile(tc.file)
+				if err != nil {
+					t.Fatalf("read golden file: %v", err)
+				}
+				if !bytes.Equal(buf.Bytes(), golden) {
+					t.Fatalf("serialized archive differs from %s; rerun with -update-golden if the format change is intended", tc.file)
+				}
+			}
+
+			golden, err := os.ReadFile(tc.file)
+			if err != nil {
+				t.Fatalf("read golden file: %v", err)
+			}
+			header, _, err := readArchiveHeader(bytes.NewReader(golden))
+			if err != nil {
+				t.Fatalf("readArchiveHeader: %v", err)
+			}
+			if parents := header.features&featureDictionaryParents != 0; parents != tc.parents {
+				t.Fatalf("dictionary parents feature = %v, want %v", parents, tc.parents)
+			}
+
+			loaded := &Archive{}
+			if _, err := loaded.ReadFrom(bytes.NewReader(golden)); err != nil {
+				t.Fatalf("ReadFrom: %v", err)
+			}
+			rd, err := NewReader(bytes.NewReader(golden), int64(len(golden)))
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+			for i, want := range goldenRows {
+				if i == tc.deleted {
+					if !loaded.IsDeleted(i) || !rd.IsDeleted(i) {
+						t.Fatalf("row %d should be deleted", i)
+					}
+					continue
+				}
+				row, err := loaded.AppendRow(nil, i)
+				if err != nil || string(row) != want {
+					t.Fatalf("row %d: got %q (%v) want %q", i, row, err, want)
+				}
+				row, err = rd.AppendRow(nil, i)
+				if err != nil || string(row) != want {
+					t.Fatalf("Reader row %d: got %q (%v) want %q", i, row, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatVersion3Header(t *testing.T) {
+	archive := mustEncode(NewEncoder(WithTokenBitWidth(12), WithoutPassthrough()), goldenRows)
+	if err := archive.Delete(1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := archive.WriteToWithOptions(&buf, WriteOptions{FormatVersion: FormatVersion3}); err != nil {
+		t.Fatalf("WriteToWithOptions: %v", err)
+	}
+
+	header, _, err := readArchiveHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("readArchiveHeader: %v", err)
+	}
+	if header.version != FormatVersion3 || header.rows != uint64(len(goldenRows)) || header.tokenBitWidth != 12 ||
+		header.features&featureTombstones == 0 || header.checksum != checksumWireCRC32C {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+	if want := len(header.raw); want != 4+2+2+archiveHeaderV3Len+2 {
+		t.Fatalf("header length %d", want)
+	}
+
+	rd, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if rd.Rows() != len(goldenRows) || !rd.IsDeleted(1) {
+		t.Fatalf("NewReader: rows %d, deleted %v", rd.Rows(), rd.IsDeleted(1))
+	}
+
+	var noChecksum bytes.Buffer
+	if _, err := archive.WriteToWithOptions(&noChecksum, WriteOptions{FormatVersion: FormatVersion3, Checksum: ChecksumNone}); err != nil {
+		t.Fatalf("WriteToWithOptions: %v", err)
+	}
+	if noChecksum.Len() != buf.Len()-archiveChecksumLen {
+		t.Fatalf("ChecksumNone: got %d bytes, want %d", noChecksum.Len(), buf.Len()-archiveChecksumLen)
+	}
+	loaded := &Archive{}
+	if _, err := loaded.ReadFrom(bytes.NewReader(noChecksum.Bytes())); err != nil {
+		t.Fatalf("ReadFrom without checksum: %v", err)
+	}
+}
+
+func TestFormatVersion3Rejects(t *testing.T) {
+	archive := mustEncode(NewEncoder(), goldenRows)
+	write := func(opts WriteOptions) []byte {
+		var buf bytes.Buffer
+		if _, err := archive.WriteToWithOptions(&buf, opts); err != nil {
+			t.Fatalf("WriteToWithOptions: %v", err)
+		}
+		return buf.Bytes()
+	}
+	serialized := write(WriteOptions{FormatVersion: FormatVersion3})
+	unchecked := write(WriteOptions{FormatVersion: FormatVersion3, Checksum: ChecksumNone})
+	const fieldsOffset = 8
+
+	cases := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"flipped_payload_byte", func() []byte {
+			b := bytes.Clone(serialized)
+			b[len(b)-archiveChecksumLen-1] ^= 0x01
+			return b
+		}(), ErrCorruptArchive},
+		{"truncated_checksum", serialized[:len(serialized)-1], io.ErrUnexpectedEOF},
+		{"unknown_feature", func() []byte {
+			b := bytes.Clone(unchecked)
+			b[fieldsOffset] |= 0x80
+			return b
+		}(), ErrUnsupportedVersion},
+		{"unknown_checksum", func() []byte {
+			b := bytes.Clone(unchecked)
+			b[fieldsOffset+13] = 9
+			return b
+		}(), ErrUnsupportedVersion},
+		{"row_count_mismatch", func() []byte {
+			b := bytes.Clone(unchecked)
+			binary.LittleEndian.PutUint64(b[fieldsOffset+4:], uint64(len(goldenRows)+1))
+			return b
+		}(), ErrCorruptArchive},
+		{"bit_width_mismatch", func() []byte {
+			b := bytes.Clone(unchecked)
+			b[fieldsOffset+12] = 12
+			return b
+		}(), ErrCorruptArchive},
+		{"tombstones_flag_without_stage", func() []byte {
+			b := bytes.Clone(unchecked)
+			b[fieldsOffset] |= byte(featureTombstones)
+			return b
+		}(), ErrCorruptArchive},
+		{"dictionary_parents_flag_mismatch", func() []byte {
+			b := bytes.Clone(unchecked)
+			b[fieldsOffset] ^= byte(featureDictionaryParents)
+			return b
+		}(), ErrCorruptArchive},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := (&Archive{}).ReadFrom(bytes.NewReader(tc.data)); !errors.Is(err, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+
+	mismatch := cases[len(cases)-1].data
+	if _, err := NewReader(bytes.NewReader(mismatch), int64(len(mismatch))); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("NewReader: expected ErrCorruptArchive for a dictionary parents flag mismatch, got %v", err)
+	}
+
+	_, err := (&Archive{}).ReadFromWithOptions(bytes.NewReader(serialized), ReaderOptions{MaxRows: len(goldenRows) - 1})
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded from the declared row count, got %v", err)
+	}
+}
+
+func TestWriteOptionsFormatVersionInvalid(t *testing.T) {
+	archive := mustEncode(NewEncoder(), goldenRows)
+	for _, opts := range []WriteOptions{
+		{FormatVersion: 1},
+		{FormatVersion: FormatVersion3 + 1},
+		{FormatVersion: FormatVersion2, Checksum: ChecksumCRC32C},
+		{Checksum: ChecksumCRC32C},
+		{FormatVersion: FormatVersion3, Checksum: ChecksumCRC32C + 1},
+	} {
+		if _, err := archive.WriteToWithOptions(io.Discard, opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
+
+// ============================================================================
+// Metadata Tests
+// ============================================================================
+
+func TestArchiveMetadataRoundTrip(t *testing.T) {
+	input := makeSyntheticMixedRows(500)
+	archive := mustEncode(NewEncoder(), input)
+	if archive.Metadata() != nil {
+		t.Fatalf("new archive should have no metadata")
+	}
+
+	metadata := map[string]string{
+		"source":         "logs/2024-06-01.log",
+		"schema_version": "3",
+		"model_id":       "apache-v7",
+		"empty":          "",
+	}
+	archive.SetMetadata(metadata)
+	metadata["source"] = "changed"
+	if got := archive.Metadata()["source"]; got != "logs/2024-06-01.log" {
+		t.Fatalf("SetMetadata should copy its input, got source %q", got)
+	}
+	archive.Metadata()["model_id"] = "changed"
+	if got := archive.Metadata()["model_id"]; got != "apache-v7" {
+		t.Fatalf("Metadata should return a copy, got model_id %q", got)
+	}
+	want := archive.Metadata()
+
+	for _, version := range []uint16{FormatVersion2, FormatVersion3} {
+		var buf bytes.Buffer
+		if _, err := archive.WriteToWithOptions(&buf, WriteOptions{FormatVersion: version}); err != nil {
+			t.Fatalf("WriteToWithOptions(v%d): %v", version, err)
+		}
+		loaded := &Archive{}
+		if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("ReadFrom(v%d): %v", version, err)
+		}
+		if !maps.Equal(loaded.Metadata(), want) {
+			t.Fatalf("v%d metadata: got %v want %v", version, loaded.Metadata(), want)
+		}
+		verifyArchiveRoundTrip(t, loaded, input)
+
+		rd, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("NewReader(v%d): %v", version, err)
+		}
+		if !maps.Equal(rd.Metadata(), want) {
+			t.Fatalf("v%d Reader metadata: got %v want %v", version, rd.Metadata(), want)
+		}
+	}
+
+	if got := archive.Slice(10, 20).Metadata(); !maps.Equal(got, want) {
+		t.Fatalf("Slice should carry metadata, got %v", got)
+	}
+	merged, err := Merge(archive, archive.Slice(0, 5))
+	if err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if merged.Metadata() != nil {
+		t.Fatalf("Merge result should have no metadata, got %v", merged.Metadata())
+	}
+
+	archive.SetMetadata(nil)
+	var withoutMetadata, plain bytes.Buffer
+	if _, err := archive.WriteTo(&withoutMetadata); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if _, err := mustEncode(NewEncoder(), input).WriteTo(&plain); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if !bytes.Equal(withoutMetadata.Bytes(), plain.Bytes()) {
+		t.Fatalf("clearing metadata should drop the metadata stage")
+	}
+}
+
+func TestDecodeMetadataStageRejectsCorruption(t *testing.T) {
+	stage, err := metadataStream(map[string]string{"a": "1", "b": "2"})
+	if err != nil {
+		t.Fatalf("metadataStream: %v", err)
+	}
+	valid, err := stage.bytes()
+	if err != nil {
+		t.Fatalf("encode metadata: %v", err)
+	}
+	params := []byte{stageMetadataParamEntries}
+
+	duplicate := bytes.Clone(valid)
+	duplicate[9] = 'a' // count, "a"="1", then key "b" -> "a"
+
+	cases := map[string]struct {
+		params  []byte
+		payload []byte
+	}{
+		"bad_params":     {[]byte{9}, valid},
+		"short":          {params, valid[:3]},
+		"huge_count":     {params, binary.LittleEndian.AppendUint32(nil, math.MaxUint32)},
+		"truncated":      {params, valid[:len(valid)-1]},
+		"trailing_bytes": {params, append(bytes.Clone(valid), 0)},
+		"duplicate_key":  {params, duplicate},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := decodeMetadataStage(&Archive{}, tc.params, tc.payload, defaultReadLimits); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+
+	var decoded Archive
+	if err := decodeMetadataStage(&decoded, params, valid, defaultReadLimits); err != nil {
+		t.Fatalf("decode valid metadata: %v", err)
+	}
+	if !maps.Equal(decoded.metadata, map[string]string{"a": "1", "b": "2"}) {
+		t.Fatalf("decoded metadata %v", decoded.metadata)
+	}
+}
+
+// ============================================================================
+// Stage Codec Tests
+// ============================================================================
+
+const testTimestampsStage = "test.row_timestamps"
+
+// timestampsCodec stores []int64 row timestamps as delta varints.
+type timestampsCodec struct{}
+
+func (timestampsCodec) EncodeStage(value any) ([]byte, []byte, error) {
+	timestamps, ok := value.([]int64)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected value type %T", value)
+	}
+	var payload []byte
+	prev := int64(0)
+	for _, ts := range timestamps {
+		payload = binary.AppendVarint(payload, ts-prev)
+		prev = ts
+	}
+	return []byte{1}, payload, nil
+}
+
+func (timestampsCodec) DecodeStage(params, payload []byte) (any, error) {
+	if len(params) != 1 || params[0] != 1 {
+		return nil, fmt.Errorf("unknown params %v", params)
+	}
+	var timestamps []int64
+	prev := int64(0)
+	for len(payload) > 0 {
+		delta, n := binary.Varint(payload)
+		if n <= 0 {
+			return nil, fmt.Errorf("bad varint")
+		}
+		prev += delta
+		timestamps = append(timestamps, prev)
+		payload = payload[n:]
+	}
+	return timestamps, nil
+}
+
+var registerTimestampsCodec = sync.OnceFunc(func() {
+	RegisterStageCodec(testTimestampsStage, timestampsCodec{})
+})
+
+func TestStageCodecRoundTrip(t *testing.T) {
+	registerTimestampsCodec()
+	input := []string{"GET /a", "GET /b", "POST /c"}
+	timestamps := []int64{1717200000, 1717200003, 1717199990}
+	archive := mustEncode(NewEncoder(), input)
+
+	if err := archive.SetStageValue("test.unregistered", 1); err == nil {
+		t.Fatalf("expected error for a stage without a codec")
+	}
+	if err := archive.SetStageValue(testTimestampsStage, timestamps); err != nil {
+		t.Fatalf("SetStageValue: %v", err)
+	}
+
+	for _, version := range []uint16{FormatVersion2, FormatVersion3} {
+		var buf bytes.Buffer
+		if _, err := archive.WriteToWithOptions(&buf, WriteOptions{FormatVersion: version}); err != nil {
+			t.Fatalf("WriteToWithOptions(v%d): %v", version, err)
+		}
+		loaded := &Archive{}
+		if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("ReadFrom(v%d): %v", version, err)
+		}
+		value, ok := loaded.StageValue(testTimestampsStage)
+		if !ok || !slices.Equal(value.([]int64), timestamps) {
+			t.Fatalf("v%d stage value: got %v (%v) want %v", version, value, ok, timestamps)
+		}
+		verifyArchiveRoundTrip(t, loaded, input)
+
+		rd, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("NewReader(v%d): %v", version, err)
+		}
+		if value, ok := rd.StageValue(testTimestampsStage); !ok || !slices.Equal(value.([]int64), timestamps) {
+			t.Fatalf("v%d Reader stage value: got %v (%v)", version, value, ok)
+		}
+	}
+
+	if _, ok := archive.Slice(0, 2).StageValue(testTimestampsStage); ok {
+		t.Fatalf("Slice should not carry stage values")
+	}
+	if err := archive.SetStageValue(testTimestampsStage, nil); err != nil {
+		t.Fatalf("SetStageValue(nil): %v", err)
+	}
+	if _, ok := archive.StageValue(testTimestampsStage); ok {
+		t.Fatalf("nil value should remove the stage")
+	}
+}
+
+func TestStageCodecErrors(t *testing.T) {
+	registerTimestampsCodec()
+	archive := mustEncode(NewEncoder(), []string{"a", "b"})
+
+	if err := archive.SetStageValue(testTimestampsStage, "not timestamps"); err != nil {
+		t.Fatalf("SetStageValue: %v", err)
+	}
+	if _, err := archive.WriteTo(io.Discard); err == nil || !strings.Contains(err.Error(), testTimestampsStage) {
+		t.Fatalf("expected encode error naming the stage, got %v", err)
+	}
+
+	if err := archive.SetStageValue(testTimestampsStage, nil); err != nil {
+		t.Fatalf("SetStageValue(nil): %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	serialized := bytes.Clone(buf.Bytes())
+	binary.LittleEndian.PutUint16(serialized[6:8], binary.LittleEndian.Uint16(serialized[6:8])+1)
+	var extra bytes.Buffer
+	if _, err := writeStage(&extra, testTimestampsStage, []byte{1}, []byte{0x80}); err != nil {
+		t.Fatalf("writeStage: %v", err)
+	}
+	serialized = append(serialized, extra.Bytes()...)
+
+	_, err := (&Archive{}).ReadFrom(bytes.NewReader(serialized))
+	var stageErr *StageError
+	if !errors.Is(err, ErrCorruptArchive) || !errors.As(err, &stageErr) || stageErr.Stage != testTimestampsStage {
+		t.Fatalf("expected corrupt StageError for %q, got %v", testTimestampsStage, err)
+	}
+}
+
+func TestRegisterStageCodecPanics(t *testing.T) {
+	registerTimestampsCodec()
+	cases := map[string]func(){
+		"empty_name": func() { RegisterStageCodec("", timestampsCodec{}) },
+		"long_name":  func() { RegisterStageCodec(strings.Repeat("x", 256), timestampsCodec{}) },
+		"reserved":   func() { RegisterStageCodec(stageDictionary, timestampsCodec{}) },
+		"metadata":   func() { RegisterStageCodec(stageMetadata, timestampsCodec{}) },
+		"duplicate":  func() { RegisterStageCodec(testTimestampsStage, timestampsCodec{}) },
+		"nil_codec":  func() { RegisterStageCodec("test.nil", nil) },
+	}
+	for name, register := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected panic")
+				}
+			}()
+			register()
+		})
+	}
+}
+
+// ============================================================================
+// Dictionary Stage Tests
+// ============================================================================
+
+func TestDictionaryParentsRoundTrip(t *testing.T) {
+	testFiles := []string{
+		"testdata/art_of_war.txt",
+		"testdata/logs_apache_2k.log",
+		"testdata/logs_hdfs_2k.log",
+		"testdata/zh_tao_te_ching_en.txt",
+	}
+	encoders := map[string][]Option{
+		"default":         nil,
+		"onpair16":        {WithMaxTokenLength(16)},
+		"frequency_order": {WithFrequencyOrderedTokens()},
+	}
+	for _, testFile := range testFiles {
+		lines, err := loadTestDataLines(testFile)
+		if err != nil {
+			t.Skipf("missing %s: %v", testFile, err)
+		}
+		for name, opts := range encoders {
+			t.Run(filepath.Base(testFile)+"/"+name, func(t *testing.T) {
+				archive := mustEncode(NewEncoder(append(slices.Clone(opts), WithoutPassthrough())...), lines)
+				payload := dictionaryParentsPayload(archive)
+				decoded, err := decodeDictionaryParents(payload, len(archive.Dictionary))
+				if err != nil {
+					t.Fatalf("decodeDictionaryParents: %v", err)
+				}
+				if !bytes.Equal(decoded, archive.Dictionary) {
+					t.Fatalf("decoded dictionary differs")
+				}
+				if len(payload) >= len(archive.Dictionary) {
+					t.Fatalf("parent-coded dictionary %d bytes, raw %d", len(payload), len(archive.Dictionary))
+				}
+
+				var buf bytes.Buffer
+				if _, err := archive.WriteToWithOptions(&buf, WriteOptions{FormatVersion: FormatVersion3}); err != nil {
+					t.Fatalf("WriteToWithOptions: %v", err)
+				}
+				header, _, err := readArchiveHeader(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("readArchiveHeader: %v", err)
+				}
+				if header.features&featureDictionaryParents == 0 {
+					t.Fatalf("expected parent-coded dictionary feature flag")
+				}
+				loaded := &Archive{}
+				if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+					t.Fatalf("ReadFrom: %v", err)
+				}
+				verifyArchiveRoundTrip(t, loaded, lines)
+				rd, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				if err != nil {
+					t.Fatalf("NewReader: %v", err)
+				}
+				for _, i := range []int{0, len(lines) / 2, len(lines) - 1} {
+					row, err := rd.AppendRow(nil, i)
+					if err != nil || string(row) != lines[i] {
+						t.Fatalf("Reader row %d: got %q (%v) want %q", i, row, err, lines[i])
+					}
+				}
+
+				// Version 2 keeps the raw dictionary every reader knows.
+				var v2 bytes.Buffer
+				if _, err := archive.WriteTo(&v2); err != nil {
+					t.Fatalf("WriteTo: %v", err)
+				}
+				if buf.Len() >= v2.Len() {
+					t.Fatalf("version 3 archive %d bytes, version 2 %d", buf.Len(), v2.Len())
+				}
+				t.Logf("dictionary %d -> %d bytes, archive v2 %d v3 %d",
+					len(archive.Dictionary), len(payload), v2.Len(), buf.Len())
+			})
+		}
+	}
+}
+
+func TestDecodeDictionaryParentsRejectsCorruption(t *testing.T) {
+	entries := func(values ...uint64) []byte {
+		var b []byte
+		for _, v := range values {
+			b = binary.AppendUvarint(b, v)
+		}
+		return b
+	}
+	// Three tokens: "a", "b", then "ab" as a pair of the first two.
+	valid := append(entries(3, 0, 0, 1), 'a')
+	valid = append(append(valid, entries(0, 1)...), 'b')
+	valid = append(valid, entries(2*(0+1), 1)...)
+	if got, err := decodeDictionaryParents(valid, 1<<10); err != nil || string(got) != "abab" {
+		t.Fatalf("valid payload: got %q (%v)", got, err)
+	}
+
+	// Each token doubles the previous one.
+	blowUp := append(entries(64, 0, 0, 2), 'a', 'b')
+	for id := uint64(1); id < 64; id++ {
+		blowUp = append(blowUp, entries(2*id, id-1)...)
+	}
+
+	cases := map[string]struct {
+		payload []byte
+		want    error
+	}{
+		"empty":              {nil, nil},
+		"truncated":          {valid[:len(valid)-1], nil},
+		"trailing_bytes":     {append(bytes.Clone(valid), 0), nil},
+		"huge_count":         {entries(math.MaxUint32, 0), nil},
+		"identity_too_long":  {entries(300, 300), nil},
+		"out_of_range":       {append(entries(1, 0, 2*5+1, 1), 'x'), nil},
+		"self_reference":     {entries(1, 0, 1, 0), nil},
+		"cycle":              {append(entries(2, 0, 2*(1+1), 0, 1, 1), 'x'), nil},
+		"truncated_literal":  {entries(1, 0, 0, 5), nil},
+		"exponential_growth": {blowUp, ErrLimitExceeded},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := decodeDictionaryParents(tc.payload, 1<<20)
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			if tc.want != nil && !errors.Is(err, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+
+	if err := decodeDictionaryStage(&Archive{}, []byte{stageDictionaryParamParents + 1}, valid, defaultReadLimits); err == nil {
+		t.Fatalf("expected error for unknown dictionary params")
+	}
+}
+
+// ============================================================================
+// Passthrough Tests
+// ============================================================================
+
+func TestPassthroughFallback(t *testing.T) {
+	rng := rand.New(rand.NewSource(47))
+	random := make([]string, 200)
+	for i := range random {
+		row := make([]byte, 1+rng.Intn(64))
+		rng.Read(row)
+		random[i] = string(row)
+	}
+	inputs := map[string][]string{
+		"random": random,
+		"tiny":   {"a", "bc", ""},
+	}
+	if lines, err := loadTestDataLines("testdata/art_of_war.txt"); err == nil {
+		inputs["art_of_war"] = lines
+	}
+
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			inputBytes := 0
+			for _, row := range input {
+				inputBytes += len(row)
+			}
+			onpair := mustEncode(NewEncoder(WithoutPassthrough()), input)
+			archive := mustEncode(NewEncoder(), input)
+			if !archive.IsPassthrough() || len(archive.raw) != inputBytes || archive.CompressedData != nil || archive.Dictionary != nil {
+				t.Fatalf("expected passthrough archive of %d raw bytes, got %d raw bytes, %d tokens", inputBytes, len(archive.raw), len(archive.TokenBoundaries)-1)
+			}
+			if got := archive.SpaceUsed(); got != inputBytes || got >= onpair.SpaceUsed() {
+				t.Fatalf("SpaceUsed %d, want %d and below OnPair's %d", got, inputBytes, onpair.SpaceUsed())
+			}
+			verifyArchiveRoundTrip(t, archive, input)
+
+			for _, opts := range []WriteOptions{
+				{},
+				{Encoding: EncodingRaw},
+				{FormatVersion: FormatVersion3},
+				{FormatVersion: FormatVersion3, Encoding: EncodingRaw},
+				{FormatVersion: FormatVersion3, Encoding: EncodingFlate},
+			} {
+				var buf bytes.Buffer
+				if _, err := archive.WriteToWithOptions(&buf, opts); err != nil {
+					t.Fatalf("WriteToWithOptions(%+v): %v", opts, err)
+				}
+				v3 := opts.FormatVersion == FormatVersion3
+				if !v3 {
+					// Releases before passthrough read 12-bit single-byte
+					// tokens with single-byte params.
+					if _, bitWidth := compressedDataEncodingOf(t, buf.Bytes()); bitWidth != tokenBitWidth12 {
+						t.Fatalf("version 2 passthrough written at %d bits", bitWidth)
+					}
+				}
+				loaded := &Archive{}
+				if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+					t.Fatalf("ReadFrom(%+v): %v", opts, err)
+				}
+				if !loaded.IsPassthrough() || loaded.SpaceUsed() != inputBytes {
+					t.Fatalf("after read with %+v: IsPassthrough %v, SpaceUsed %d, want %d", opts, loaded.IsPassthrough(), loaded.SpaceUsed(), inputBytes)
+				}
+				verifyArchiveRoundTrip(t, loaded, input)
+				rd, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				if err != nil {
+					t.Fatalf("NewReader(%+v): %v", opts, err)
+				}
+				for i, want := range input {
+					if row, err := rd.AppendRow(nil, i); err != nil || string(row) != want {
+						t.Fatalf("Reader row %d: got %q (%v) want %q", i, row, err, want)
+					}
+				}
+				if opts.Encoding == EncodingAuto {
+					var plain bytes.Buffer
+					if _, err := onpair.WriteToWithOptions(&plain, opts); err != nil {
+						t.Fatalf("WriteToWithOptions: %v", err)
+					}
+					t.Logf("version %d: input %d B, SpaceUsed %d -> %d B, serialized %d -> %d B",
+						opts.formatVersion(), inputBytes, onpair.SpaceUsed(), archive.SpaceUsed(), plain.Len(), buf.Len())
+				}
+			}
+		})
+	}
+}
+
+func TestPassthroughDefaultWriteToRoundTrip(t *testing.T) {
+	lines, err := loadTestDataLines("testdata/art_of_war.txt")
+	if err != nil {
+		t.Skipf("missing testdata: %v", err)
+	}
+	archive := mustEncode(NewEncoder(), lines)
+	if !archive.IsPassthrough() {
+		t.Fatalf("expected passthrough archive")
+	}
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	loaded := &Archive{}
+	if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if !loaded.IsPassthrough() || loaded.SpaceUsed() != archive.SpaceUsed() {
+		t.Fatalf("after WriteTo/ReadFrom: IsPassthrough %v, SpaceUsed %d, want %d", loaded.IsPassthrough(), loaded.SpaceUsed(), archive.SpaceUsed())
+	}
+	verifyArchiveRoundTrip(t, loaded, lines)
+
+	// A 16-bit OnPair archive without merged tokens stays one.
+	onpair := mustEncode(NewEncoder(WithoutPassthrough()), []string{"a", "bc"})
+	buf.Reset()
+	if _, err := onpair.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	loaded = &Archive{}
+	if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if loaded.IsPassthrough() || len(loaded.TokenBoundaries) != singleByteTokens+1 {
+		t.Fatalf("16-bit archive read back as passthrough %v with %d tokens", loaded.IsPassthrough(), len(loaded.TokenBoundaries)-1)
+	}
+}
+
+func TestPassthroughArchiveOperations(t *testing.T) {
+	input := []string{"alpha", "beta", "gamma", "delta", "epsilon"}
+	archive := mustEncode(NewEncoder(WithPackedTokenStorage(), WithCompactBoundaries()), input)
+	if !archive.IsPassthrough() {
+		t.Fatalf("expected passthrough archive")
+	}
+	verifyArchiveRoundTrip(t, archive, input)
+
+	if err := archive.Delete(1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	slice := archive.Slice(2, 5)
+	if !slice.IsPassthrough() {
+		t.Fatalf("Slice of a passthrough archive should stay passthrough")
+	}
+	verifyArchiveRoundTrip(t, slice, input[2:])
+
+	merged, err := Merge(archive, slice)
+	if err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	want := []string{"alpha", "gamma", "delta", "epsilon", "gamma", "delta", "epsilon"}
+	if !merged.IsPassthrough() {
+		t.Fatalf("Merge of passthrough archives should stay passthrough")
+	}
+	verifyArchiveRoundTrip(t, merged, want)
+
+	if err := archive.Compact(CompactOptions{PruneDictionary: true}); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if !archive.IsPassthrough() || archive.Rows() != len(input)-1 {
+		t.Fatalf("Compact: passthrough %v, %d rows", archive.IsPassthrough(), archive.Rows())
+	}
+	verifyArchiveRoundTrip(t, archive, []string{"alpha", "gamma", "delta", "epsilon"})
+	if _, err := archive.DecompressString(4-1, make([]byte, 3)); !errors.Is(err, ErrShortBuffer) {
+		t.Fatalf("DecompressString into a short buffer: %v", err)
+	}
+
+	lines := makeSyntheticIDRows(2000)
+	onpair := mustEncode(NewEncoder(), lines)
+	if onpair.IsPassthrough() {
+		t.Fatalf("compressible rows should not fall back to passthrough")
+	}
+	mixed, err := Merge(slice, onpair)
+	if err != nil {
+		t.Fatalf("Merge mixed: %v", err)
+	}
+	verifyArchiveRoundTrip(t, mixed, append(slices.Clone(input[2:]), lines...))
+
+	// A model keeps its dictionary so its archives merge without
+	// re-encoding, even on rows that would fall back to passthrough.
+	model, err := TrainModel(lines)
+	if err != nil {
+		t.Fatalf("TrainModel: %v", err)
+	}
+	encoded, err := model.Encode(input)
+	if err != nil {
+		t.Fatalf("Model.Encode: %v", err)
+	}
+	if encoded.IsPassthrough() {
+		t.Fatalf("Model.Encode should not fall back to passthrough")
+	}
+	verifyArchiveRoundTrip(t, encoded, input)
+}
+
+func TestPassthroughStageRejects(t *testing.T) {
+	archive := mustEncode(NewEncoder(), []string{"alpha", "beta", "gamma"})
+	var buf bytes.Buffer
+	if _, err := archive.WriteToWithOptions(&buf, WriteOptions{FormatVersion: FormatVersion3, Checksum: ChecksumNone}); err != nil {
+		t.Fatalf("WriteToWithOptions: %v", err)
+	}
+	serialized := buf.Bytes()
+	const fieldsOffset = 8
+	header, _, err := readArchiveHeader(bytes.NewReader(serialized))
+	if err != nil || header.features&featurePassthrough == 0 || header.tokenBitWidth != passthroughTokenBitWidth {
+		t.Fatalf("unexpected header %+v (%v)", header, err)
+	}
+
+	cases := map[string][]byte{
+		"flag_cleared": func() []byte {
+			b := bytes.Clone(serialized)
+			b[fieldsOffset] &^= byte(featurePassthrough)
+			return b
+		}(),
+		"token_width": func() []byte {
+			b := bytes.Clone(serialized)
+			b[fieldsOffset+12] = tokenBitWidth12
+			return b
+		}(),
+		"flag_on_onpair_archive": func() []byte {
+			var buf bytes.Buffer
+			onpair := mustEncode(NewEncoder(WithoutPassthrough()), []string{"alpha", "beta", "gamma"})
+			if _, err := onpair.WriteToWithOptions(&buf, WriteOptions{FormatVersion: FormatVersion3, Checksum: ChecksumNone}); err != nil {
+				t.Fatalf("WriteToWithOptions: %v", err)
+			}
+			b := buf.Bytes()
+			b[fieldsOffset] |= byte(featurePassthrough)
+			b[fieldsOffset+12] = passthroughTokenBitWidth
+			return b
+		}(),
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := (&Archive{}).ReadFrom(bytes.NewReader(data)); !errors.Is(err, ErrCorruptArchive) {
+				t.Fatalf("ReadFrom: expected ErrCorruptArchive, got %v", err)
+			}
+			if _, err := NewReader(bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrCorruptArchive) {
+				t.Fatalf("NewReader: expected ErrCorruptArchive, got %v", err)
+			}
+		})
+	}
+}
+
+// ============================================================================
+// Auto Tune Tests
+// ============================================================================
+
+func TestAutoTune(t *testing.T) {
+	testFiles := []string{
+		"testdata/art_of_war.txt",
+		"testdata/logs_apache_2k.log",
+		"testdata/logs_hdfs_2k.log",
+		"testdata/zh_tao_te_ching_en.txt",
+	}
+	for _, testFile := range testFiles {
+		lines, err := loadTestDataLines(testFile)
+		if err != nil {
+			t.Skipf("missing %s: %v", testFile, err)
+		}
+		t.Run(filepath.Base(testFile), func(t *testing.T) {
+			opts, report := AutoTune(lines, TuneBudget{})
+			if len(report.Results) == 0 || report.Best < 0 || report.Best >= len(report.Results) {
+				t.Fatalf("no candidate chosen: %+v", report)
+			}
+			if report.Results[0].Options != nil || report.Results[0].Config != (Config{}) {
+				t.Fatalf("first candidate should use the defaults, got %q", report.Results[0].Label)
+			}
+			best := report.Results[report.Best]
+			for _, result := range report.Results {
+				if result.Err != nil {
+					t.Fatalf("%s: %v", result.Label, result.Err)
+				}
+				if result.EstimatedBytes < best.EstimatedBytes {
+					t.Fatalf("%s estimates %d B, below the chosen %d B", result.Label, result.EstimatedBytes, best.EstimatedBytes)
+				}
+			}
+			if !strings.Contains(report.String(), "*  "+best.Label) {
+				t.Fatalf("report should mark the chosen candidate:\n%s", report)
+			}
+
+			tuned := mustEncode(NewEncoder(opts...), lines)
+			verifyArchiveRoundTrip(t, tuned, lines)
+			if defaults := mustEncode(NewEncoder(), lines); report.Results[0].Passthrough != defaults.IsPassthrough() {
+				t.Fatalf("default candidate passthrough %v, Encode passthrough %v", report.Results[0].Passthrough, defaults.IsPassthrough())
+			}
+			var tunedBuf, defaultBuf bytes.Buffer
+			if _, err := tuned.WriteTo(&tunedBuf); err != nil {
+				t.Fatalf("WriteTo: %v", err)
+			}
+			if _, err := mustEncode(NewEncoder(), lines).WriteTo(&defaultBuf); err != nil {
+				t.Fatalf("WriteTo: %v", err)
+			}
+			if tunedBuf.Len() > defaultBuf.Len() {
+				t.Fatalf("tuned archive %d B larger than default %d B", tunedBuf.Len(), defaultBuf.Len())
+			}
+			t.Logf("%s: estimated %d B, serialized %d B (default %d B)", best.Label, best.EstimatedBytes, tunedBuf.Len(), defaultBuf.Len())
+		})
+	}
+}
+
+func TestAutoTuneBudget(t *testing.T) {
+	lines := makeSyntheticMixedRows(2000)
+
+	opts, report := AutoTune(lines, TuneBudget{MaxCandidates: 1})
+	if len(report.Results) != 1 || report.Best != 0 || opts != nil {
+		t.Fatalf("MaxCandidates 1 should try only the defaults: %d results, best %d, options %v", len(report.Results), report.Best, opts)
+	}
+
+	_, report = AutoTune(lines, TuneBudget{SampleBytes: 16 << 10, HoldoutFraction: 0.5, MinDecodeMBps: math.MaxFloat64})
+	if report.HoldoutRows == 0 || report.HoldoutRows < report.TrainRows-1 || report.HoldoutRows > report.TrainRows+1 {
+		t.Fatalf("half of the sample should be held out: train %d, holdout %d", report.TrainRows, report.HoldoutRows)
+	}
+	if report.TrainRows+report.HoldoutRows >= len(lines) {
+		t.Fatalf("sample should be bounded by SampleBytes: %d of %d rows", report.TrainRows+report.HoldoutRows, len(lines))
+	}
+	for _, result := range report.Results {
+		if result.DecodeMBps > report.Results[report.Best].DecodeMBps {
+			t.Fatalf("with an unreachable decode floor the fastest candidate should win")
+		}
+	}
+
+	_, report = AutoTune(lines, TuneBudget{MaxDuration: time.Nanosecond})
+	if len(report.Results) != 1 {
+		t.Fatalf("an expired duration should stop after the first candidate, got %d", len(report.Results))
+	}
+
+	if opts, report := AutoTune(nil, TuneBudget{}); opts != nil || report.Best != -1 || len(report.Results) != 0 {
+		t.Fatalf("no rows: options %v, report %+v", opts, report)
+	}
+	opts, report = AutoTune([]string{"only row"}, TuneBudget{MaxCandidates: 2})
+	if report.Best < 0 || report.TrainRows != 1 || report.HoldoutRows != 1 {
+		t.Fatalf("single row: %+v", report)
+	}
+	verifyArchiveRoundTrip(t, mustEncode(NewEncoder(opts...), []string{"only row"}), []string{"only row"})
+}
+
+// ============================================================================
+// Ratio Estimate Tests
+// ============================================================================
+
+func TestEstimateRatioMatchesWriteTo(t *testing.T) {
+	testFiles := []string{
+		"testdata/art_of_war.txt",
+		"testdata/en_mobydick.txt",
+		"testdata/logs_apache_2k.log",
+		"testdata/logs_hdfs_2k.log",
+		"testdata/zh_tao_te_ching_en.txt",
+	}
+	encoders := map[string][]Option{
+		"default":  nil,
+		"width12":  {WithTokenBitWidth(12)},
+		"onpair16": {WithMaxTokenLength(16)},
+	}
+	for _, testFile := range testFiles {
+		lines, err := loadTestDataLines(testFile)
+		if err != nil {
+			t.Skipf("missing %s: %v", testFile, err)
+		}
+		inputBytes := 0
+		for _, line := range lines {
+			inputBytes += len(line)
+		}
+		for name, opts := range encoders {
+			t.Run(filepath.Base(testFile)+"/"+name, func(t *testing.T) {
+				estimate, err := EstimateRatio(lines, opts...)
+				if err != nil {
+					t.Fatalf("EstimateRatio: %v", err)
+				}
+				archive := mustEncode(NewEncoder(opts...), lines)
+				var buf bytes.Buffer
+				if _, err := archive.WriteTo(&buf); err != nil {
+					t.Fatalf("WriteTo: %v", err)
+				}
+				actual := float64(inputBytes) / float64(buf.Len())
+
+				if estimate.InputBytes != inputBytes || estimate.Passthrough != archive.IsPassthrough() {
+					t.Fatalf("estimate %+v, input %d B, passthrough %v", estimate, inputBytes, archive.IsPassthrough())
+				}
+				if !(estimate.Low <= estimate.Ratio && estimate.Ratio <= estimate.High) {
+					t.Fatalf("ratio %.3f outside its interval [%.3f, %.3f]", estimate.Ratio, estimate.Low, estimate.High)
+				}
+				if relErr := math.Abs(float64(estimate.EstimatedBytes-buf.Len())) / float64(buf.Len()); relErr > 0.2 {
+					t.Fatalf("estimated %d B, WriteTo %d B (%.1f%% off)", estimate.EstimatedBytes, buf.Len(), 100*relErr)
+				}
+				// Rows within both samples are estimated exactly.
+				if inputBytes <= estimateSampleBytes && estimate.EstimatedBytes != buf.Len() {
+					t.Fatalf("estimated %d B, WriteTo %d B", estimate.EstimatedBytes, buf.Len())
+				}
+				t.Logf("estimated %.3fx [%.3f, %.3f] (%d B), actual %.3fx (%d B)",
+					estimate.Ratio, estimate.Low, estimate.High, estimate.EstimatedBytes, actual, buf.Len())
+			})
+		}
+	}
+}
+
+func TestEstimateRatioEdgeCases(t *testing.T) {
+	if estimate, err := EstimateRatio(nil); err != nil || estimate != (RatioEstimate{}) {
+		t.Fatalf("no rows: %+v, %v", estimate, err)
+	}
+	if _, err := EstimateRatio([]string{"a"}, WithTokenBitWidth(7)); !errors.Is(err, ErrInvalidTokenBitWidth) {
+		t.Fatalf("expected ErrInvalidTokenBitWidth, got %v", err)
+	}
+
+	rows := []string{"", "", ""}
+	estimate, err := EstimateRatio(rows)
+	if err != nil || estimate.InputBytes != 0 || estimate.SampledRows != len(rows) {
+		t.Fatalf("empty rows: %+v, %v", estimate, err)
+	}
+
+	// Sampling is deterministic.
+	lines := makeSyntheticMixedRows(20000)
+	first, err := EstimateRatio(lines, WithoutPassthrough())
+	if err != nil {
+		t.Fatalf("EstimateRatio: %v", err)
+	}
+	second, _ := EstimateRatio(lines, WithoutPassthrough())
+	if first != second || first.SampledRows >= len(lines) || first.Passthrough {
+		t.Fatalf("estimates differ or sampled every row: %+v, %+v", first, second)
+	}
+}
+
+func TestEstimateRatioTrainsEncodeDictionary(t *testing.T) {
+	lines := makeSyntheticMixedRows(5000)
+	for name, opts := range map[string][]Option{
+		"uniform":  {WithTrainingSampleBytes(16 << 10)},
+		"template": {WithTrainingSampleBytes(16 << 10), WithTemplateStratifiedSampling(64)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			inputBytes := 0
+			for _, line := range lines {
+				inputBytes += len(line)
+			}
+			if inputBytes <= 16<<10 || inputBytes > estimateTemplatePoolBytes {
+				t.Fatalf("rows should exceed the training sample and fit the template pool: %d B", inputBytes)
+			}
+			// Only the training rows are flattened, but the dictionary is
+			// the one Encode trains on all rows.
+			enc := NewEncoder(opts...)
+			_, want, _ := enc.train(flattenStrings(lines))
+			_, got, _ := enc.estimateTrain(lines, inputBytes)
+			if len(want) <= singleByteTokens || !bytes.Equal(got, want) {
+				t.Fatalf("estimate dictionary %d B, Encode dictionary %d B", len(got), len(want))
+			}
+		})
+	}
+}
+
+// ============================================================================
+// Model Evaluation Tests
+// ============================================================================
+
+func TestModelEvaluateDrift(t *testing.T) {
+	apache, err := loadTestDataLines("testdata/logs_apache_2k.log")
+	if err != nil {
+		t.Skipf("missing testdata: %v", err)
+	}
+	hdfs, err := loadTestDataLines("testdata/logs_hdfs_2k.log")
+	if err != nil {
+		t.Skipf("missing testdata: %v", err)
+	}
+	// Interleave the rows so both halves span the same time range.
+	var train, rest []string
+	for i, line := range apache {
+		if i%2 == 0 {
+			train = append(train, line)
+		} else {
+			rest = append(rest, line)
+		}
+	}
+	// A training sample smaller than the training rows leaves rows to
+	// measure the training ratio on.
+	model, err := TrainModel(train, WithTokenBitWidth(12), WithTrainingSampleBytes(16<<10))
+	if err != nil {
+		t.Fatalf("TrainModel: %v", err)
+	}
+
+	same := model.Evaluate(rest)
+	drifted := model.Evaluate(hdfs)
+	for name, report := range map[string]EvalReport{"same": same, "drifted": drifted} {
+		if report.TrainingRatio <= 0 || report.TrainingBytesPerToken <= 1 || !report.TrainingHeldOut {
+			t.Fatalf("%s: training measurements missing: %+v", name, report)
+		}
+		if got := float64(report.Bytes) / float64(report.Tokens); report.BytesPerToken != got {
+			t.Fatalf("%s: BytesPerToken %.3f, want %.3f", name, report.BytesPerToken, got)
+		}
+		if report.FallbackFraction < 0 || report.FallbackFraction > 1 {
+			t.Fatalf("%s: FallbackFraction %.3f", name, report.FallbackFraction)
+		}
+		t.Logf("%s: %.2f bytes/token, %.1f%% fallback, ratio %.2fx vs %.2fx at training (%.2f)", name,
+			report.BytesPerToken, 100*report.FallbackFraction, report.Ratio, report.TrainingRatio, report.RatioChange)
+	}
+	if same.RatioChange < 0.8 || same.RatioChange > 1.25 {
+		t.Fatalf("rows like the training rows should keep the ratio, got change %.2f", same.RatioChange)
+	}
+	if drifted.RatioChange > 0.8*same.RatioChange || drifted.FallbackFraction <= same.FallbackFraction {
+		t.Fatalf("drifted rows should fit worse: same %+v, drifted %+v", same, drifted)
+	}
+
+	// Evaluate counts the tokens Encode produces.
+	archive, err := model.Encode(hdfs)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if archive.tokenCount() != drifted.Tokens || drifted.Rows != len(hdfs) {
+		t.Fatalf("Evaluate saw %d tokens in %d rows, Encode %d", drifted.Tokens, drifted.Rows, archive.tokenCount())
+	}
+}
+
+func TestModelEvaluateEdgeCases(t *testing.T) {
+	if report := NewModel().Evaluate([]string{"a"}); report != (EvalReport{}) {
+		t.Fatalf("untrained model should report zeros, got %+v", report)
+	}
+	rows := []string{"user_000001", "user_000002", "user_000003"}
+	model, err := TrainModel(rows)
+	if err != nil {
+		t.Fatalf("TrainModel: %v", err)
+	}
+	report := model.Evaluate(nil)
+	if report.Tokens != 0 || report.Ratio != 0 || report.RatioChange != 0 || report.TrainingRatio == 0 || report.TrainingHeldOut {
+		t.Fatalf("no rows: %+v", report)
+	}
+	report = model.Evaluate([]string{"user_000004"})
+	if report.Rows != 1 || report.Bytes != len("user_000004") || report.RatioChange <= 0 {
+		t.Fatalf("one row: %+v", report)
+	}
+
+	// Training rows without bytes leave nothing to compare against.
+	model, err = TrainModel([]string{"", ""})
+	if err != nil {
+		t.Fatalf("TrainModel: %v", err)
+	}
+	report = model.Evaluate([]string{"user_000004"})
+	if report.Tokens == 0 || report.TrainingRatio != 0 || report.RatioChange != 0 {
+		t.Fatalf("empty training rows: %+v", report)
+	}
+}
+
+// ============================================================================
+// Fuzz Tests
+// ============================================================================
+
+func FuzzOnPairCompression(f *testing.F) {
+	// Seed corpus with interesting test cases
+	f.Add("hello")
+	f.Add("user_000001")
+	f.Add("hello世界")
+	f.Add("🚀rocket")
+	f.Add("")
+	f.Add("a")
+	f.Add("abcdefghijklmnopqrstuvwxyz")
+	f.Add("tab\there")
+	f.Add("null\x00byte")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		// Create a slice with the input string repeated to enable pattern matching
+		strings := []string{input, input, input}
+
+		enc := NewEncoder()
+		archive := mustEncode(enc, strings)
+
+		// Verify decompression
+		buffer := make([]byte, len(input)*2+100) // Extra space for safety
+		for i, expected := range strings {
+			size, err := archive.DecompressString(i, buffer)
+			if err != nil {
+				t.Errorf("DecompressString failed: %v", err)
+				continue
+			}
+			actual := string(buffer[:size])
+			if actual != expected {
+				t.Errorf("String %d: expected %q, got %q", i, expected, actual)
+			}
+		}
+	})
+}
+
+func FuzzOnPair16Compression(f *testing.F) {
+	// Seed corpus with interesting test cases
+	f.Add("hello")
+	f.Add("user_001")
+	f.Add("hello世界")
+	f.Add("🚀")
+	f.Add("")
+	f.Add("x")
+	f.Add("1234567890abcdef") // Exactly 16 bytes
+
+	f.Fuzz(func(t *testing.T, input string) {
+		// Create a slice with the input string repeated
+		strings := []string{input, input, input}
+
+		enc := NewEncoder(WithMaxTokenLength(16))
+		archive := mustEncode(enc, strings)
+
+		// Verify decompression
+		buffer := make([]byte, len(input)*2+100) // Extra space for safety
+		for i, expected := range strings {
+			size, err := archive.DecompressString(i, buffer)
+			if err != nil {
+				t.Errorf("DecompressString failed: %v", err)
+				continue
+			}
+			actual := string(buffer[:size])
+			if actual != expected {
+				t.Errorf("String %d: expected %q, got %q", i, expected, actual)
+			}
+		}
+	})
+}
+
+func FuzzOnPairMultipleStrings(f *testing.F) {
+	// Seed with pairs of strings
+	f.Add("hello", "world")
+	f.Add("user_", "admin_")
+	f.Add("café", "naïve")
+
+	f.Fuzz(func(t *testing.T, s1, s2 string) {
+		// Create various combinations
+		strings := []string{s1, s2, s1, s2, s1 + s2, s2 + s1}
+
+		enc := NewEncoder()
+		archive := mustEncode(enc, strings)
+
+		// Verify decompression
+		maxLen := len(s1) + len(s2) + 100
+		buffer := make([]byte, maxLen)
+		for i, expected := range strings {
+			size, err := archive.DecompressString(i, buffer)
+			if err != nil {
+				t.Errorf("DecompressString failed: %v", err)
+				continue
+			}
+			actual := string(buffer[:size])
+			if actual != expected {
+				t.Errorf("String %d: expected %q, got %q", i, expected, actual)
+			}
+		}
+	})
+}
+
+func FuzzOnPairDecompressAllChecked(f *testing.F) {
+	f.Add("foo", "bar", "baz")
+
+	f.Fuzz(func(t *testing.T, s1, s2, s3 string) {
+		strings := []string{s1, s2, s3}
+
+		enc := NewEncoder()
+		archive := mustEncode(enc, strings)
+
+		// Calculate expected result
+		expected := s1 + s2 + s3
+		totalLen := len(expected)
+
+		// Decompress all
+		buffer := make([]byte, totalLen+100) // Extra space for safety
+		size, err := archive.DecompressAllChecked(buffer)
+		if err != nil {
+			t.Fatalf("DecompressAllChecked failed: %v", err)
+		}
+		actual := string(buffer[:size])
+
+		if actual != expected {
+			t.Errorf("DecompressAllChecked: expected %q, got %q", expected, actual)
+		}
+
+		if size != totalLen {
+			t.Errorf("DecompressAllChecked size: expected %d, got %d", totalLen, size)
+		}
+	})
+}
+
+// ============================================================================
+// Basic Benchmarks
+// ============================================================================
+
+func BenchmarkOnPairCompression(b *testing.B) {
+	strings := make([]string, 1000)
+	for i := 0; i < 1000; i++ {
+		strings[i] = "user_000001"
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enc := NewEncoder()
+		mustEncode(enc, strings)
+	}
+}
+
+func BenchmarkOnPair16Compression(b *testing.B) {
+	strings := make([]string, 1000)
+	for i := 0; i < 1000; i++ {
+		strings[i] = "user_000001"
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enc := NewEncoder(WithMaxTokenLength(16))
+		mustEncode(enc, strings)
+	}
+}
+
+func BenchmarkOnPairDecompression(b *testing.B) {
+	strings := make([]string, 1000)
+	for i := 0; i < 1000; i++ {
+		strings[i] = "user_000001"
+	}
+
+	enc := NewEncoder()
+	archive := mustEncode(enc, strings)
 	buffer := make([]byte, 256)
 
 	b.ResetTimer()
@@ -2544,6 +5744,147 @@ func BenchmarkOnPair16Decompression(b *testing.B) {
 	}
 }
 
+func BenchmarkOnPair16DecompressionVariable(b *testing.B) {
+	strings := make([]string, 1000)
+	for i := 0; i < 1000; i++ {
+		strings[i] = "user_000001"
+	}
+
+	enc := NewEncoder(WithMaxTokenLength(16))
+	archive := mustEncode(enc, strings)
+	archive.slots = nil
+	buffer := make([]byte, 256)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < len(strings); j++ {
+			if _, err := archive.DecompressString(j, buffer); err != nil {
+				b.Fatalf("DecompressString failed: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkOnPair16AppendRow(b *testing.B) {
+	lines, err := loadTestDataLines("testdata/logs_apache_2k.log")
+	if err != nil {
+		b.Skip("testdata not available")
+	}
+	fixed := mustEncode(NewEncoder(WithMaxTokenLength(16)), lines)
+	variable := *fixed
+	variable.slots = nil
+
+	for _, bc := range []struct {
+		name    string
+		archive *Archive
+	}{
+		{"fixed_slots", fixed},
+		{"variable", &variable},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			dst := make([]byte, 0, 4096)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range lines {
+					var err error
+					if dst, err = bc.archive.AppendRow(dst[:0], j); err != nil {
+						b.Fatalf("AppendRow failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkOnPair16DecompressString(b *testing.B) {
+	lines, err := loadTestDataLines("testdata/logs_apache_2k.log")
+	if err != nil {
+		b.Skip("testdata not available")
+	}
+	fixed := mustEncode(NewEncoder(WithMaxTokenLength(16)), lines)
+	variable := *fixed
+	variable.slots = nil
+
+	for _, bc := range []struct {
+		name    string
+		archive *Archive
+	}{
+		{"fixed_slots", fixed},
+		{"variable", &variable},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			buffer := make([]byte, 4096)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range lines {
+					if _, err := bc.archive.DecompressString(j, buffer); err != nil {
+						b.Fatalf("DecompressString failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAppendRowValidated(b *testing.B) {
+	lines, err := loadTestDataLines("testdata/logs_hdfs_2k.log")
+	if err != nil {
+		b.Skip("testdata not available")
+	}
+	validated := mustEncode(NewEncoder(), lines)
+	validated.slots = nil
+	checked := *validated
+	checked.validated = nil
+
+	for _, bc := range []struct {
+		name    string
+		archive *Archive
+	}{
+		{"validated", validated},
+		{"checked", &checked},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			dst := make([]byte, 0, 4096)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range lines {
+					var err error
+					if dst, err = bc.archive.AppendRow(dst[:0], j); err != nil {
+						b.Fatalf("AppendRow failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteToWithOptions(b *testing.B) {
+	lines, err := loadTestDataLines("testdata/logs_hdfs_2k.log")
+	if err != nil {
+		b.Skip("testdata not available")
+	}
+	archive := mustEncode(NewEncoder(), lines)
+
+	for _, bc := range []struct {
+		name string
+		opts WriteOptions
+	}{
+		{"candidate_search", WriteOptions{}},
+		{"raw", WriteOptions{Encoding: EncodingRaw}},
+		{"flate_best_speed", WriteOptions{Encoding: EncodingFlate, FlateLevel: flate.BestSpeed}},
+		{"huffman", WriteOptions{Encoding: EncodingHuffman}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := archive.WriteToWithOptions(io.Discard, bc.opts); err != nil {
+					b.Fatalf("WriteToWithOptions failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkOnPairLargeDatasetCompression(b *testing.B) {
 	strings := make([]string, 100000)
 	for i := 0; i < 100000; i++ {
@@ -2979,6 +6320,7 @@ func FuzzArchiveRoundTrip(f *testing.F) {
 			{name: "maxlen16", opts: []Option{WithMaxTokenLength(16)}},
 			{name: "maxid4095", opts: []Option{WithMaxTokenID(4095)}},
 			{name: "bitwidth12", opts: []Option{WithTokenBitWidth(12)}},
+			{name: "bitwidth10", opts: []Option{WithTokenBitWidth(10)}},
 		}
 
 		for _, tc := range cases {
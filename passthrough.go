@@ -0,0 +1,172 @@
+package onpair
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Passthrough archives store rows as is. When OnPair would need more space
+// than the input, as on tiny or high-entropy data, Encode instead returns an
+// archive that holds the concatenated row bytes and the row boundaries, with
+// no dictionary or token stream. Every Archive method works on it; helpers
+// that walk the token stream see each byte as its single-byte token.
+//
+// Version 3 archives store the bytes in a passthrough stage, flagged in the
+// header. Version 2 has no such stage, so WriteTo writes the rows as 12-bit
+// single-byte tokens with a 256-token dictionary, which releases that predate
+// passthrough archives read. ReadFrom turns any version 2 archive of that
+// shape back into a passthrough archive.
+//
+// Passthrough stage (params {stagePassthroughParamRaw}): the row bytes.
+// With params {stagePassthroughParamFlate} the bytes are flate-compressed.
+
+// newPassthroughArchive stores data as is. endPositions, as returned by
+// flattenStrings, double as the row boundaries. Both are owned by the result.
+func (e *Encoder) newPassthroughArchive(data []byte, endPositions []int) *Archive {
+	a := &Archive{
+		StringBoundaries: endPositions,
+		passthrough:      true,
+		raw:              data,
+	}
+	e.finishArchive(a)
+	return a
+}
+
+// IsPassthrough reports whether a stores its rows as is, without a
+// dictionary. Encode returns such archives when OnPair would expand the
+// input; see WithoutPassthrough.
+func (a *Archive) IsPassthrough() bool {
+	return a.passthrough
+}
+
+// wireTokenBitWidth returns the width a's tokens are written at in the
+// compressed_data stage. Passthrough bytes are widened to 12 bits, the
+// narrowest width releases that predate variable widths read.
+func (a *Archive) wireTokenBitWidth() uint8 {
+	if a.passthrough {
+		return tokenBitWidth12
+	}
+	return a.tokenBitWidth()
+}
+
+// rawRange returns bytes [lo, hi) of a passthrough archive.
+func (a *Archive) rawRange(lo, hi int) ([]byte, error) {
+	if lo < 0 || hi < lo || hi > len(a.raw) {
+		return nil, corruptf("passthrough range [%d, %d) out of range for %d bytes", lo, hi, len(a.raw))
+	}
+	return a.raw[lo:hi], nil
+}
+
+// singleByteDictionary returns the dictionary and token boundaries of the
+// 256 single-byte tokens, under which a token stream of bytes decodes to
+// those bytes.
+func singleByteDictionary() ([]byte, []uint32) {
+	dictionary := make([]byte, singleByteTokens)
+	tokenBoundaries := make([]uint32, singleByteTokens+1)
+	for i := range singleByteTokens {
+		dictionary[i] = byte(i)
+		tokenBoundaries[i+1] = uint32(i + 1)
+	}
+	return dictionary, tokenBoundaries
+}
+
+// isSingleByteDictionary reports whether dictionary and tokenBoundaries are
+// exactly those singleByteDictionary returns.
+func isSingleByteDictionary(dictionary []byte, tokenBoundaries []uint32) bool {
+	if len(dictionary) != singleByteTokens || len(tokenBoundaries) != singleByteTokens+1 {
+		return false
+	}
+	for i := range singleByteTokens {
+		if dictionary[i] != byte(i) || tokenBoundaries[i+1] != uint32(i+1) {
+			return false
+		}
+	}
+	return tokenBoundaries[0] == 0
+}
+
+// restoreLegacyPassthrough turns a, read from a version 2 archive, back into
+// a passthrough archive if it has the shape WriteTo gives passthrough
+// archives there: 12-bit tokens under the 256 single-byte tokens. a must be
+// validated, so its tokens are below 256.
+func restoreLegacyPassthrough(a *Archive) {
+	if a.passthrough || a.compressedTokenBitWidth != tokenBitWidth12 || !isSingleByteDictionary(a.Dictionary, a.TokenBoundaries) {
+		return
+	}
+	raw := make([]byte, len(a.CompressedData))
+	for i, tokenID := range a.CompressedData {
+		raw[i] = byte(tokenID)
+	}
+	a.raw = raw
+	a.passthrough = true
+	a.CompressedData = nil
+	a.Dictionary = nil
+	a.TokenBoundaries = nil
+	a.compressedTokenBitWidth = 0
+}
+
+// checkPassthrough records the structural problems of a passthrough
+// archive in c.
+func checkPassthrough(a *Archive, c *issueCollector) {
+	if a.CompressedData != nil || a.packed != nil {
+		c.add(stagePassthrough, -1, -1, 0, "passthrough archive has a token stream")
+	}
+	if len(a.Dictionary) != 0 || len(a.TokenBoundaries) != 0 {
+		c.add(stagePassthrough, -1, -1, int64(len(a.TokenBoundaries)), "passthrough archive has a dictionary")
+	}
+	if checkStringBoundaries(a, c) {
+		checkTombstones(a, c)
+	}
+}
+
+// passthroughStream returns the passthrough stage in the encoding closest to
+// the one requested: EncodingRaw and the non-flate encodings store the bytes
+// as is, the flate encodings compress them, and EncodingAuto keeps the
+// smaller of the two.
+func passthroughStream(a *Archive, encoding TokenEncoding, flateLevel int) (streamStage, error) {
+	if len(a.raw) > maxStagePayloadBytes {
+		return streamStage{}, fmt.Errorf("passthrough data too large: %d", len(a.raw))
+	}
+	raw := bytesStage(stagePassthrough, []byte{stagePassthroughParamRaw}, a.raw)
+	if encoding != EncodingAuto && encoding != EncodingFlate && encoding != EncodingCodebookFlate {
+		return raw, nil
+	}
+
+	fw, err := flate.NewWriter(io.Discard, flateLevel)
+	if err != nil {
+		return streamStage{}, err
+	}
+	compressed, err := flateStream(stagePassthrough, []byte{stagePassthroughParamFlate}, raw, fw, flateKeepBytes)
+	if err != nil {
+		return streamStage{}, err
+	}
+	if encoding == EncodingAuto && compressed.size >= raw.size {
+		return raw, nil
+	}
+	return compressed, nil
+}
+
+// decodePassthroughStage decodes the passthrough stage into dst.
+func decodePassthroughStage(dst *Archive, params []byte, payload []byte, limits readLimits) error {
+	if len(params) != 1 {
+		return fmt.Errorf("invalid passthrough params: %v", params)
+	}
+	switch params[0] {
+	case stagePassthroughParamRaw:
+		dst.raw = bytes.Clone(payload)
+		if dst.raw == nil {
+			dst.raw = []byte{}
+		}
+	case stagePassthroughParamFlate:
+		raw, err := decodeFlatePayload(payload, limits.stageBytes)
+		if err != nil {
+			return err
+		}
+		dst.raw = raw
+	default:
+		return fmt.Errorf("invalid passthrough params: %v", params)
+	}
+	dst.passthrough = true
+	return nil
+}
@@ -0,0 +1,358 @@
+package onpair
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// Reader gives random row access to a serialized archive held in an
+// io.ReaderAt, such as a blob in object storage. NewReader loads the
+// dictionary, row boundaries, tombstones, metadata and custom stages eagerly.
+// When the compressed_data stage is stored as raw packed tokens, or the
+// passthrough stage as raw bytes, each AppendRow reads only that row's bytes;
+// flate, codebook and Huffman streams are decoded in full up front.
+//
+// A Reader is safe for concurrent use if the underlying io.ReaderAt is.
+type Reader struct {
+	src     io.ReaderAt
+	archive *Archive // Everything but the token stream when lazy
+	limits  readLimits
+
+	// Lazy token access. tokenOffset is the absolute offset of the packed
+	// token bits, or of the row bytes of a passthrough archive, or -1 when
+	// the token stream was decoded into archive.
+	tokenOffset int64
+	tokenCount  int
+	bitWidth    uint8
+}
+
+// readerStage locates one stage within the serialized archive.
+type readerStage struct {
+	index   int
+	params  []byte
+	offset  int64
+	dataLen uint32
+}
+
+// NewReader reads the archive header and stage table from r, which holds
+// size bytes, and loads everything except raw token streams and raw
+// passthrough bytes. The checksum of a version 3 archive is not verified,
+// since that would read every byte; use ReadFrom to verify it.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	return NewReaderWithOptions(r, size, ReaderOptions{})
+}
+
+// NewReaderWithOptions is like NewReader but enforces the resource limits in
+// opts, as ReadFromWithOptions does; violations match ErrLimitExceeded.
+// MaxTotalBytes applies to size. A raw token stream or raw passthrough stage
+// read lazily is never held in memory, so MaxDecompressedStageBytes does not
+// apply to it.
+func NewReaderWithOptions(r io.ReaderAt, size int64, opts ReaderOptions) (*Reader, error) {
+	limits := opts.limits()
+	if size > limits.totalBytes {
+		return nil, limitExceeded("archive size", size, limits.totalBytes)
+	}
+	sr := io.NewSectionReader(r, 0, size)
+	header, total, err := readArchiveHeader(sr)
+	if err != nil {
+		return nil, err
+	}
+	if header.rows > uint64(limits.rows) {
+		return nil, limitExceeded("declared row count", int64(min(header.rows, math.MaxInt64)), int64(limits.rows))
+	}
+	stagesEnd := size - int64(header.checksumLen())
+
+	stages := make(map[string]readerStage, header.stageCount)
+	for i := 0; i < int(header.stageCount); i++ {
+		headerOffset := total
+		stageHeader, n, err := readStageHeader(sr)
+		total += n
+		if err != nil {
+			return nil, &StageError{Op: "read", Offset: headerOffset, Index: i, Err: err}
+		}
+		if _, ok := stages[stageHeader.name]; ok {
+			return nil, &StageError{Op: "read", Stage: stageHeader.name, Offset: headerOffset, Index: i, Err: corruptf("duplicate stage")}
+		}
+
+		params := make([]byte, stageHeader.paramLen)
+		paramsOffset := total
+		nParams, err := io.ReadFull(sr, params)
+		total += int64(nParams)
+		if err != nil {
+			return nil, &StageError{Op: "read params of", Stage: stageHeader.name, Offset: paramsOffset, Index: i, Err: err}
+		}
+		if int64(stageHeader.dataLen) > stagesEnd-total {
+			return nil, &StageError{Op: "read payload of", Stage: stageHeader.name, Offset: total, Index: i, Err: io.ErrUnexpectedEOF}
+		}
+		stages[stageHeader.name] = readerStage{index: i, params: params, offset: total, dataLen: stageHeader.dataLen}
+		total += int64(stageHeader.dataLen)
+		if _, err := sr.Seek(total, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, stageName := range header.requiredStages() {
+		if _, ok := stages[stageName]; !ok {
+			return nil, corruptf("missing required stage %q", stageName)
+		}
+	}
+	if _, ok := stages[stageCompressedData]; ok && header.features&featurePassthrough != 0 {
+		return nil, corruptf("passthrough archive has a %q stage", stageCompressedData)
+	}
+
+	rd := &Reader{
+		src:         r,
+		archive:     &Archive{compressedTokenBitWidth: tokenBitWidth16},
+		limits:      limits,
+		tokenOffset: -1,
+	}
+	decoders := []struct {
+		name   string
+		decode func(*Archive, []byte, []byte, readLimits) error
+	}{
+		{stageStringBoundaries, decodeStringBoundariesStage},
+		{stageDictionary, decodeDictionaryStage},
+		{stageTokenBoundaries, decodeTokenBoundariesStage},
+		{stageTombstones, decodeTombstonesStage},
+		{stageMetadata, decodeMetadataStage},
+	}
+	for _, d := range decoders {
+		stage, ok := stages[d.name]
+		if !ok {
+			continue
+		}
+		if err := rd.decodeStage(d.name, stage, d.decode); err != nil {
+			return nil, err
+		}
+	}
+	for name, stage := range stages {
+		codec := lookupStageCodec(name)
+		if codec == nil || slices.Contains(builtinStages, name) {
+			continue
+		}
+		decode := func(dst *Archive, params, payload []byte, _ readLimits) error {
+			return decodeCustomStage(dst, codec, name, params, payload)
+		}
+		if err := rd.decodeStage(name, stage, decode); err != nil {
+			return nil, err
+		}
+	}
+
+	if stage, ok := stages[stagePassthrough]; ok {
+		if slices.Equal(stage.params, []byte{stagePassthroughParamRaw}) {
+			rd.openPassthrough(stage)
+		} else if err := rd.decodeStage(stagePassthrough, stage, decodePassthroughStage); err != nil {
+			return nil, err
+		}
+	}
+	if stage, ok := stages[stageCompressedData]; ok {
+		encoding, bitWidth, err := parseCompressedDataParams(stage.params)
+		if err == nil && encoding == compressedDataEncodingRaw && stage.dataLen >= 4 {
+			err = rd.openRawTokens(stage, bitWidth)
+		} else {
+			err = rd.decodeStage(stageCompressedData, stage, decodeCompressedDataStage)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := rd.validate(); err != nil {
+		return nil, fmt.Errorf("invalid archive structure: %w", err)
+	}
+	if err := header.check(rd.archive, dictionaryParentsParams(stages[stageDictionary].params)); err != nil {
+		return nil, fmt.Errorf("invalid archive structure: %w", err)
+	}
+	rd.archive.slots = &lazySlots{}
+	return rd, nil
+}
+
+// decodeStage reads a stage payload in full and decodes it into the
+// reader's archive.
+func (rd *Reader) decodeStage(name string, stage readerStage, decode func(*Archive, []byte, []byte, readLimits) error) error {
+	if int(stage.dataLen) > rd.limits.stageBytes {
+		return &StageError{Op: "read", Stage: name, Offset: stage.offset, Index: stage.index, Err: limitExceeded("stage payload size", int64(stage.dataLen), int64(rd.limits.stageBytes))}
+	}
+	payload := make([]byte, stage.dataLen)
+	if err := readFullAt(rd.src, payload, stage.offset); err != nil {
+		return &StageError{Op: "read payload of", Stage: name, Offset: stage.offset, Index: stage.index, Err: err}
+	}
+	if err := decode(rd.archive, stage.params, payload, rd.limits); err != nil {
+		if !errors.Is(err, ErrLimitExceeded) {
+			err = corrupt(err)
+		}
+		return &StageError{Op: "decode", Stage: name, Offset: stage.offset, Index: stage.index, Err: err}
+	}
+	return nil
+}
+
+// openRawTokens records the location of a raw packed token stream without
+// reading it.
+func (rd *Reader) openRawTokens(stage readerStage, bitWidth uint8) error {
+	var countBuf [4]byte
+	if err := readFullAt(rd.src, countBuf[:], stage.offset); err != nil {
+		return &StageError{Op: "read payload of", Stage: stageCompressedData, Offset: stage.offset, Index: stage.index, Err: err}
+	}
+	count := binary.LittleEndian.Uint32(countBuf[:])
+	if count > uint32(maxCompressedTokenRead) {
+		return &StageError{Op: "decode", Stage: stageCompressedData, Offset: stage.offset, Index: stage.index, Err: corruptf("compressed token count too large: %d", count)}
+	}
+	if expected := 4 + packedByteSize(int(count), bitWidth); int(stage.dataLen) != expected {
+		return &StageError{Op: "decode", Stage: stageCompressedData, Offset: stage.offset, Index: stage.index, Err: corruptf("compressed_data length mismatch: payload=%d expected=%d", stage.dataLen, expected)}
+	}
+	rd.tokenOffset = stage.offset + 4
+	rd.tokenCount = int(count)
+	rd.bitWidth = bitWidth
+	rd.archive.compressedTokenBitWidth = bitWidth
+	return nil
+}
+
+// openPassthrough records the location of raw passthrough bytes without
+// reading them.
+func (rd *Reader) openPassthrough(stage readerStage) {
+	rd.tokenOffset = stage.offset
+	rd.tokenCount = int(stage.dataLen)
+	rd.bitWidth = passthroughTokenBitWidth
+	rd.archive.passthrough = true
+}
+
+// validate checks the loaded archive. Token IDs of a lazy token stream are
+// checked per row as they are read.
+func (rd *Reader) validate() error {
+	a := rd.archive
+	if rd.tokenOffset < 0 {
+		if err := validateArchiveStructure(a); err != nil {
+			return err
+		}
+		a.markValidated()
+		return nil
+	}
+
+	if a.boundaryCount() == 0 {
+		return corruptf("string boundaries must contain at least one entry")
+	}
+	if first := a.boundaryAt(0); first != 0 {
+		return corruptf("first string boundary must be 0: %d", first)
+	}
+	for i := 1; i < a.boundaryCount(); i++ {
+		if a.boundaryAt(i) < a.boundaryAt(i-1) {
+			return corruptf("string boundaries not monotonic at index %d", i)
+		}
+	}
+	if last := a.boundaryAt(a.boundaryCount() - 1); last > rd.tokenCount {
+		return corruptf("string boundary %d out of range for %d tokens", last, rd.tokenCount)
+	}
+	c := issueCollector{limit: 1}
+	if a.passthrough {
+		if len(a.Dictionary) != 0 || len(a.TokenBoundaries) != 0 {
+			return corruptf("passthrough archive has a dictionary")
+		}
+	} else {
+		checkTokenBoundaries(a, &c)
+	}
+	checkTombstones(a, &c)
+	return c.corruptionError(1)
+}
+
+// Rows returns the number of rows in the archive.
+func (rd *Reader) Rows() int {
+	return rd.archive.Rows()
+}
+
+// IsDeleted reports whether the row at index has been deleted.
+func (rd *Reader) IsDeleted(index int) bool {
+	return rd.archive.IsDeleted(index)
+}
+
+// Metadata returns a copy of the archive's metadata, or nil if it has none.
+func (rd *Reader) Metadata() map[string]string {
+	return rd.archive.Metadata()
+}
+
+// StageValue returns the decoded value of the custom stage name.
+func (rd *Reader) StageValue(name string) (any, bool) {
+	return rd.archive.StageValue(name)
+}
+
+// AppendRow appends the decoded row at index to dst. For raw token streams
+// it reads only the row's token bytes from the underlying io.ReaderAt.
+func (rd *Reader) AppendRow(dst []byte, index int) ([]byte, error) {
+	a := rd.archive
+	if rd.tokenOffset < 0 {
+		return a.AppendRow(dst, index)
+	}
+	if index < 0 || index >= a.Rows() {
+		return dst, fmt.Errorf("%w: %d", ErrIndexOutOfRange, index)
+	}
+	if a.IsDeleted(index) {
+		return dst, fmt.Errorf("%w: %d", ErrRowDeleted, index)
+	}
+
+	start, end := a.rowSpan(index)
+	if a.passthrough {
+		return rd.appendRaw(dst, start, end)
+	}
+	tokens, err := rd.readTokens(start, end)
+	if err != nil {
+		return dst, err
+	}
+	row := Archive{
+		CompressedData:  tokens,
+		Dictionary:      a.Dictionary,
+		TokenBoundaries: a.TokenBoundaries,
+		slots:           a.slots,
+	}
+	return row.appendTokenRange(dst, 0, len(tokens))
+}
+
+// appendRaw appends bytes [lo, hi) of lazily read passthrough bytes to dst.
+func (rd *Reader) appendRaw(dst []byte, lo, hi int) ([]byte, error) {
+	n := len(dst)
+	dst = slices.Grow(dst, hi-lo)[:n+hi-lo]
+	if err := readFullAt(rd.src, dst[n:], rd.tokenOffset+int64(lo)); err != nil {
+		return dst[:n], fmt.Errorf("read passthrough bytes [%d, %d): %w", lo, hi, err)
+	}
+	return dst, nil
+}
+
+// readTokens reads and unpacks tokens [lo, hi) of a raw token stream.
+func (rd *Reader) readTokens(lo, hi int) ([]uint16, error) {
+	if lo == hi {
+		return nil, nil
+	}
+	width := int(rd.bitWidth)
+	firstBit := lo * width
+	byteLo := firstBit / 8
+	byteHi := (hi*width + 7) / 8
+	buf := make([]byte, byteHi-byteLo+packedTokenPadding)
+	if err := readFullAt(rd.src, buf[:byteHi-byteLo], rd.tokenOffset+int64(byteLo)); err != nil {
+		return nil, fmt.Errorf("read tokens [%d, %d): %w", lo, hi, err)
+	}
+
+	mask := maxTokenIDForBitWidth(rd.bitWidth)
+	tokens := make([]uint16, hi-lo)
+	for i := range tokens {
+		bit := firstBit%8 + i*width
+		b := buf[bit>>3:]
+		word := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		tokens[i] = uint16(word>>(uint(bit)&7)) & mask
+	}
+	return tokens, nil
+}
+
+// readFullAt fills buf from r at off. An io.EOF alongside a full read is not
+// an error, as io.ReaderAt permits.
+func readFullAt(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
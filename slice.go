@@ -0,0 +1,86 @@
+package onpair
+
+import "fmt"
+
+// Slice returns an archive holding rows [lo, hi) of a. The result shares the
+// dictionary and the underlying token storage or passthrough bytes with a;
+// only the row boundaries are rebased, in a's boundary representation, so
+// slicing never re-encodes. The shared slices are capped at their length, so
+// appending to the result's fields copies instead of overwriting a.
+// Tombstones within the range and the metadata are carried over.
+//
+// Slice panics if lo or hi is out of range, like slicing a Go slice.
+func (a *Archive) Slice(lo, hi int) *Archive {
+	rows := a.Rows()
+	if lo < 0 || hi < lo || hi > rows {
+		panic(fmt.Sprintf("onpair: slice bounds out of range [%d:%d] with %d rows", lo, hi, rows))
+	}
+
+	stringBoundaries := make([]int, hi-lo+1)
+	base := 0
+	if rows > 0 {
+		base = a.boundaryAt(lo)
+		for i := range stringBoundaries {
+			stringBoundaries[i] = a.boundaryAt(lo+i) - base
+		}
+	}
+
+	out := &Archive{
+		StringBoundaries:        stringBoundaries,
+		Dictionary:              a.Dictionary[:len(a.Dictionary):len(a.Dictionary)],
+		TokenBoundaries:         a.TokenBoundaries[:len(a.TokenBoundaries):len(a.TokenBoundaries)],
+		compressedTokenBitWidth: a.compressedTokenBitWidth,
+		slots:                   a.slots,
+		metadata:                a.metadata,
+		config:                  a.config,
+	}
+	end := base + stringBoundaries[len(stringBoundaries)-1]
+	if a.compactBoundaries != nil {
+		out.compactBoundaries = compactBoundaries(stringBoundaries)
+		out.StringBoundaries = nil
+	}
+	switch {
+	case a.passthrough:
+		out.passthrough = true
+		out.raw = a.raw[base:end:end]
+	case a.packed != nil:
+		out.packed = a.packed.slice(base, end)
+	default:
+		out.CompressedData = a.CompressedData[base:end:end]
+	}
+	for i := lo; i < hi; i++ {
+		if !a.IsDeleted(i) {
+			continue
+		}
+		if out.tombstones == nil {
+			out.tombstones = make([]uint64, tombstoneWords(hi-lo))
+		}
+		out.tombstones[(i-lo)/64] |= 1 << (uint(i-lo) % 64)
+	}
+	if a.isValidated() {
+		out.markValidated()
+	}
+	return out
+}
+
+// Split partitions a into n archives of consecutive rows whose row counts
+// differ by at most one. Each part is a Slice of a. Split returns nil if
+// n < 1.
+func (a *Archive) Split(n int) []*Archive {
+	if n < 1 {
+		return nil
+	}
+
+	rows := a.Rows()
+	parts := make([]*Archive, n)
+	lo := 0
+	for i := range parts {
+		hi := lo + rows/n
+		if i < rows%n {
+			hi++
+		}
+		parts[i] = a.Slice(lo, hi)
+		lo = hi
+	}
+	return parts
+}
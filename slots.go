@@ -0,0 +1,138 @@
+package onpair
+
+import (
+	"slices"
+	"sync"
+)
+
+// fixedSlotSize is the slot width of the OnPair16 decode table. OnPair16
+// dictionaries cap tokens at 16 bytes, so every token fits in one slot.
+const fixedSlotSize = 16
+
+// fixedSlots is the OnPair16 decode layout: each token stored in its own
+// zero-padded 16-byte slot next to its length. Decoders copy whole slots
+// with a single fixed-size move and advance by the token length, instead of
+// looking up and appending a variable-length dictionary range per token.
+type fixedSlots struct {
+	slots [][fixedSlotSize]byte
+	lens  []uint8
+
+	// Source dictionary, used to detect archives whose Dictionary or
+	// TokenBoundaries were replaced after the table was built.
+	dictionary      []byte
+	tokenBoundaries []uint32
+}
+
+// newFixedSlots builds the fixed-slot table for a dictionary, or returns nil
+// if any token is longer than fixedSlotSize or the boundaries are invalid.
+func newFixedSlots(dictionary []byte, tokenBoundaries []uint32) *fixedSlots {
+	if len(tokenBoundaries) < 2 {
+		return nil
+	}
+	tokenCount := len(tokenBoundaries) - 1
+	s := &fixedSlots{
+		slots:           make([][fixedSlotSize]byte, tokenCount),
+		lens:            make([]uint8, tokenCount),
+		dictionary:      dictionary,
+		tokenBoundaries: tokenBoundaries,
+	}
+	for tokenID := range tokenCount {
+		start := tokenBoundaries[tokenID]
+		end := tokenBoundaries[tokenID+1]
+		if end < start || end > uint32(len(dictionary)) || end-start > fixedSlotSize {
+			return nil
+		}
+		copy(s.slots[tokenID][:], dictionary[start:end])
+		s.lens[tokenID] = uint8(end - start)
+	}
+	return s
+}
+
+// lazySlots holds an archive's fixed-slot table, built on first decode so
+// archives that are never decoded do not pay for it. Slices of an archive
+// share it along with the dictionary.
+type lazySlots struct {
+	once  sync.Once
+	table *fixedSlots
+}
+
+// fixedSlotTable returns the archive's fixed-slot table, building it on first
+// use. It returns nil if the archive has none, uses a compact in-memory
+// layout (the table costs about 17 bytes per token, which would eat into
+// those savings), or the table no longer matches the dictionary.
+func (a *Archive) fixedSlotTable() *fixedSlots {
+	l := a.slots
+	if l == nil || a.packed != nil || a.compactBoundaries != nil || a.passthrough {
+		return nil
+	}
+	l.once.Do(func() { l.table = newFixedSlots(a.Dictionary, a.TokenBoundaries) })
+	s := l.table
+	if s == nil || !sameBacking(s.dictionary, a.Dictionary) || !sameBacking(s.tokenBoundaries, a.TokenBoundaries) {
+		return nil
+	}
+	return s
+}
+
+// sameBacking reports whether x and y are the same slice: equal length over
+// the same underlying array.
+func sameBacking[T any](x, y []T) bool {
+	return len(x) == len(y) && (len(x) == 0 || &x[0] == &y[0])
+}
+
+// decodedLen returns the decoded length of tokens. It reports false if a
+// token ID is outside the table, leaving the error to the checked decode
+// path.
+func (s *fixedSlots) decodedLen(tokens []uint16) (int, bool) {
+	lens := s.lens
+	n := 0
+	for _, tokenID := range tokens {
+		if int(tokenID) >= len(lens) {
+			return 0, false
+		}
+		n += int(lens[tokenID])
+	}
+	return n, true
+}
+
+// decode writes tokens into out and returns the decoded length. Whole slots
+// are copied while they fit inside out; the remaining tokens are copied
+// exactly, so nothing past out is written. It reports false if a token ID is
+// invalid or out is too short.
+func (s *fixedSlots) decode(out []byte, tokens []uint16) (int, bool) {
+	slots, lens := s.slots, s.lens
+	offset := 0
+	i := 0
+	for ; i < len(tokens) && offset <= len(out)-fixedSlotSize; i++ {
+		tokenID := tokens[i]
+		if int(tokenID) >= len(lens) {
+			return 0, false
+		}
+		*(*[fixedSlotSize]byte)(out[offset:]) = slots[tokenID]
+		offset += int(lens[tokenID])
+	}
+	for ; i < len(tokens); i++ {
+		tokenID := tokens[i]
+		if int(tokenID) >= len(lens) {
+			return 0, false
+		}
+		n := int(lens[tokenID])
+		if offset+n > len(out) {
+			return 0, false
+		}
+		copy(out[offset:offset+n], slots[tokenID][:n])
+		offset += n
+	}
+	return offset, true
+}
+
+// appendTokens appends the decoded tokens to dst. It reports false, leaving
+// dst unchanged, if a token ID is invalid.
+func (s *fixedSlots) appendTokens(dst []byte, tokens []uint16) ([]byte, bool) {
+	n, ok := s.decodedLen(tokens)
+	if !ok {
+		return dst, false
+	}
+	dst = slices.Grow(dst, n)
+	s.decode(dst[len(dst):len(dst)+n], tokens)
+	return dst[:len(dst)+n], true
+}
@@ -0,0 +1,329 @@
+package onpair
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// TuneBudget bounds the work AutoTune does.
+type TuneBudget struct {
+	SampleBytes     int           // Row bytes to tune on, split into training and holdout rows (0 = 4 MiB).
+	HoldoutFraction float64       // Fraction of sampled rows held out for measuring (0 = 0.2).
+	MaxCandidates   int           // Candidate option sets to try, defaults first (0 = all).
+	MaxDuration     time.Duration // Stop trying further candidates after this long (0 = no limit).
+	MinDecodeMBps   float64       // Skip candidates decoding the holdout slower than this (0 = no floor).
+}
+
+const (
+	defaultTuneSampleBytes     = 4 << 20
+	defaultTuneHoldoutFraction = 0.2
+	tuneDecodeMinDuration      = 10 * time.Millisecond
+)
+
+// Options is an option set chosen by AutoTune, for NewEncoder or TrainModel.
+type Options []Option
+
+// TuneResult is one candidate option set measured by AutoTune.
+type TuneResult struct {
+	Label           string  // Short description of the candidate.
+	Options         Options // The candidate's options.
+	Config          Config  // The candidate's options applied to a zero Config.
+	DictionaryBytes int     // Trained dictionary size, 0 for passthrough.
+	Passthrough     bool    // The encoder stored the rows as is.
+	SerializedBytes int     // WriteTo size of the encoded holdout rows.
+	EstimatedBytes  int     // WriteTo size extrapolated to all rows.
+	Ratio           float64 // Row bytes per estimated serialized byte.
+	DecodeMBps      float64 // AppendAll throughput over the holdout rows.
+	Err             error   // Non-nil if the candidate could not be trained or measured.
+}
+
+// Report compares the candidates AutoTune tried.
+type Report struct {
+	RowBytes     int // Total bytes of all rows passed to AutoTune.
+	TrainRows    int
+	HoldoutRows  int
+	HoldoutBytes int
+	Results      []TuneResult // In trial order; Results[0] uses the default options.
+	Best         int          // Index of the chosen result, or -1 if none was measured.
+}
+
+// tuneCandidate is one point of the AutoTune search grid.
+type tuneCandidate struct {
+	threshold uint16
+	maxLen    int
+	bitWidth  uint8
+	template  bool
+}
+
+func (c tuneCandidate) options() Options {
+	var opts Options
+	if c.threshold != 0 {
+		opts = append(opts, WithThreshold(c.threshold))
+	}
+	if c.maxLen != 0 {
+		opts = append(opts, WithMaxTokenLength(c.maxLen))
+	}
+	if c.bitWidth != 0 {
+		opts = append(opts, WithTokenBitWidth(c.bitWidth))
+	}
+	if c.template {
+		opts = append(opts, WithTemplateStratifiedSampling(defaultTemplateMaxClusters))
+	}
+	return opts
+}
+
+func (c tuneCandidate) label() string {
+	threshold, maxLen, bitWidth, sampling := "auto", "-", "16", "uniform"
+	if c.threshold != 0 {
+		threshold = fmt.Sprint(c.threshold)
+	}
+	if c.maxLen != 0 {
+		maxLen = fmt.Sprint(c.maxLen)
+	}
+	if c.bitWidth != 0 {
+		bitWidth = fmt.Sprint(c.bitWidth)
+	}
+	if c.template {
+		sampling = "template"
+	}
+	return fmt.Sprintf("threshold=%s maxlen=%s width=%s sampling=%s", threshold, maxLen, bitWidth, sampling)
+}
+
+// tuneCandidates returns the search grid, defaults first. Template sampling
+// only differs from uniform sampling when the training rows exceed the
+// training sample size.
+func tuneCandidates(trainBytes int) []tuneCandidate {
+	samplings := []bool{false}
+	if trainBytes > maxTrainingSampleBytes {
+		samplings = append(samplings, true)
+	}
+	var candidates []tuneCandidate
+	for _, template := range samplings {
+		for _, bitWidth := range []uint8{0, tokenBitWidth12} {
+			for _, maxLen := range []int{0, 16} {
+				for _, threshold := range []uint16{0, 4, 16, 64, 256, 1024} {
+					candidates = append(candidates, tuneCandidate{threshold, maxLen, bitWidth, template})
+				}
+			}
+		}
+	}
+	return candidates
+}
+
+// AutoTune picks encoder options for rows, such as one column of a table.
+// For each candidate option set (threshold, maximum token length, token bit
+// width and sampling mode) it trains on a sample of rows as
+// NewEncoder(options...).Encode does, including its choice to fall back to
+// passthrough, encodes the held-out rows with the result, and measures their
+// serialized size and decode speed. The serialized size is extrapolated to
+// all rows, counting the dictionary once. The returned options give the
+// smallest estimate among the candidates that decode at least
+// budget.MinDecodeMBps, or the fastest candidate if none does.
+//
+// Sampling is deterministic, but decode speeds are measured and vary from run
+// to run. With no rows AutoTune returns nil options, the defaults.
+func AutoTune(rows []string, budget TuneBudget) (Options, Report) {
+	report := Report{Best: -1}
+	train, holdout := tuneSplit(rows, budget)
+	if len(holdout) == 0 {
+		return nil, report
+	}
+	trainBytes := 0
+	for _, row := range train {
+		trainBytes += len(row)
+	}
+	for _, row := range rows {
+		report.RowBytes += len(row)
+	}
+	report.TrainRows = len(train)
+	report.HoldoutRows = len(holdout)
+	for _, row := range holdout {
+		report.HoldoutBytes += len(row)
+	}
+
+	start := time.Now()
+	for i, candidate := range tuneCandidates(trainBytes) {
+		if budget.MaxCandidates > 0 && i >= budget.MaxCandidates {
+			break
+		}
+		if budget.MaxDuration > 0 && i > 0 && time.Since(start) > budget.MaxDuration {
+			break
+		}
+		result := measureCandidate(candidate, train, holdout, report.HoldoutBytes, report.RowBytes)
+		report.Results = append(report.Results, result)
+	}
+
+	fastest := -1
+	for i, r := range report.Results {
+		if r.Err != nil {
+			continue
+		}
+		if fastest < 0 || r.DecodeMBps > report.Results[fastest].DecodeMBps {
+			fastest = i
+		}
+		if r.DecodeMBps < budget.MinDecodeMBps {
+			continue
+		}
+		if report.Best < 0 || r.EstimatedBytes < report.Results[report.Best].EstimatedBytes {
+			report.Best = i
+		}
+	}
+	if report.Best < 0 {
+		report.Best = fastest
+	}
+	if report.Best < 0 {
+		return nil, report
+	}
+	return report.Results[report.Best].Options, report
+}
+
+// tuneSplit samples up to budget.SampleBytes of rows in a deterministic
+// shuffled order and splits them into training and holdout rows. A single
+// row serves as both.
+func tuneSplit(rows []string, budget TuneBudget) (train, holdout []string) {
+	sampleBytes := budget.SampleBytes
+	if sampleBytes <= 0 {
+		sampleBytes = defaultTuneSampleBytes
+	}
+	fraction := budget.HoldoutFraction
+	if fraction <= 0 || fraction >= 1 {
+		fraction = defaultTuneHoldoutFraction
+	}
+
+	var sample []string
+	size := 0
+	for _, idx := range shuffleIndices(len(rows), trainingShuffleSeed) {
+		if size >= sampleBytes && len(sample) > 0 {
+			break
+		}
+		sample = append(sample, rows[idx])
+		size += len(rows[idx])
+	}
+	if len(sample) <= 1 {
+		return sample, sample
+	}
+
+	holdoutEvery := int(1 / fraction)
+	if holdoutEvery < 2 {
+		holdoutEvery = 2
+	}
+	for i, row := range sample {
+		if i%holdoutEvery == holdoutEvery-1 {
+			holdout = append(holdout, row)
+		} else {
+			train = append(train, row)
+		}
+	}
+	if len(holdout) == 0 {
+		holdout = append(holdout, train[len(train)-1])
+		train = train[:len(train)-1]
+	}
+	return train, holdout
+}
+
+// measureCandidate trains on the training rows with the candidate's options,
+// as Encode would, and measures the holdout rows encoded with the trained
+// dictionary, or stored as is if Encode would fall back to passthrough on
+// the training rows.
+func measureCandidate(candidate tuneCandidate, train, holdout []string, holdoutBytes, rowBytes int) TuneResult {
+	result := TuneResult{Label: candidate.label(), Options: candidate.options()}
+	for _, opt := range result.Options {
+		opt(&result.Config)
+	}
+	enc := NewEncoder(result.Options...)
+	if err := validateConfig(enc.config); err != nil {
+		result.Err = err
+		return result
+	}
+
+	model := &Model{config: enc.config}
+	trainData, trainEnds := flattenStrings(train)
+	model.matcher, model.dictionary, model.tokenBoundaries = enc.train(trainData, trainEnds)
+	trained := model.newArchive(enc.compress(trainData, trainEnds, model.matcher))
+
+	// The fixed cost of an empty archive, mostly the dictionary, is paid
+	// once; the rest scales with the row bytes.
+	holdoutData, holdoutEnds := flattenStrings(holdout)
+	var archive, empty *Archive
+	if enc.fallsBack(trained, len(trainData)) {
+		result.Passthrough = true
+		archive = enc.newPassthroughArchive(holdoutData, holdoutEnds)
+		empty = enc.newPassthroughArchive(flattenStrings(nil))
+	} else {
+		result.DictionaryBytes = len(model.dictionary)
+		archive = model.newArchive(enc.compress(holdoutData, holdoutEnds, model.matcher))
+		empty = model.newArchive(nil, []int{0})
+	}
+	serializedSize := func(a *Archive) (int, error) {
+		cw := &countingWriter{w: io.Discard}
+		_, err := a.WriteTo(cw)
+		return int(cw.n), err
+	}
+	fixed, err := serializedSize(empty)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	serialized, err := serializedSize(archive)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.SerializedBytes = serialized
+	result.EstimatedBytes = fixed
+	if holdoutBytes > 0 {
+		result.EstimatedBytes += int(float64(serialized-fixed) * float64(rowBytes) / float64(holdoutBytes))
+	}
+	if result.EstimatedBytes > 0 {
+		result.Ratio = float64(rowBytes) / float64(result.EstimatedBytes)
+	}
+
+	buf := make([]byte, 0, holdoutBytes)
+	decoded := 0
+	start := time.Now()
+	for decoded == 0 || time.Since(start) < tuneDecodeMinDuration {
+		buf, err = archive.AppendAll(buf[:0])
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		decoded += len(buf)
+		if len(buf) == 0 {
+			break
+		}
+	}
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		result.DecodeMBps = float64(decoded) / elapsed / 1e6
+	}
+	return result
+}
+
+// String formats the report as a comparison table, marking the chosen
+// candidate with an asterisk.
+func (r Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "rows %d B, train rows %d, holdout rows %d (%d B)\n", r.RowBytes, r.TrainRows, r.HoldoutRows, r.HoldoutBytes)
+	tw := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tcandidate\tdictionary\tholdout\testimated\tratio\tdecode MB/s")
+	for i, result := range r.Results {
+		mark := ""
+		if i == r.Best {
+			mark = "*"
+		}
+		if result.Err != nil {
+			fmt.Fprintf(tw, "%s\t%s\terror: %v\t\t\t\t\n", mark, result.Label, result.Err)
+			continue
+		}
+		dictionary := fmt.Sprint(result.DictionaryBytes)
+		if result.Passthrough {
+			dictionary = "passthrough"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%.2fx\t%.0f\n", mark, result.Label,
+			dictionary, result.SerializedBytes, result.EstimatedBytes, result.Ratio, result.DecodeMBps)
+	}
+	tw.Flush()
+	return sb.String()
+}
@@ -0,0 +1,363 @@
+package onpair
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// maxCorruptionIssues caps the issues collected by Validate so a badly
+// damaged archive does not produce one issue per token.
+const maxCorruptionIssues = 1000
+
+// CorruptionIssue describes one structural problem found in an archive.
+type CorruptionIssue struct {
+	Stage   string // Wire stage holding the bad data, e.g. "compressed_data"
+	Row     int    // Affected row, or -1 if the issue is not tied to a row
+	Token   int    // Position in the token stream, or -1
+	Value   int64  // Offending value
+	Message string
+}
+
+func (i CorruptionIssue) String() string {
+	var b strings.Builder
+	if i.Stage != "" {
+		fmt.Fprintf(&b, "stage %s ", i.Stage)
+	}
+	if i.Row >= 0 {
+		fmt.Fprintf(&b, "row %d ", i.Row)
+	}
+	if i.Token >= 0 {
+		fmt.Fprintf(&b, "token %d ", i.Token)
+	}
+	if b.Len() > 0 {
+		b.WriteString("- ")
+	}
+	b.WriteString(i.Message)
+	return b.String()
+}
+
+// CorruptionError lists the structural problems found in an archive.
+// Truncated is set when more problems exist than Issues holds.
+type CorruptionError struct {
+	Issues    []CorruptionIssue
+	Truncated bool
+}
+
+// Is reports whether target is ErrCorruptArchive.
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruptArchive
+}
+
+func (e *CorruptionError) Error() string {
+	if len(e.Issues) == 0 {
+		return "corrupt archive"
+	}
+	msg := e.Issues[0].Message
+	switch {
+	case e.Truncated:
+		return fmt.Sprintf("%s (and more than %d other issues)", msg, len(e.Issues)-1)
+	case len(e.Issues) > 1:
+		return fmt.Sprintf("%s (and %d other issues)", msg, len(e.Issues)-1)
+	}
+	return msg
+}
+
+// Validate checks the archive's structure: boundary monotonicity and ranges,
+// token IDs against the dictionary and token bit-width, storage consistency
+// and the tombstone bitmap. It returns a *CorruptionError listing every
+// problem found, or nil. A nil result marks the archive validated, so its
+// decoders skip per-token checks.
+func (a *Archive) Validate() error {
+	c := issueCollector{limit: maxCorruptionIssues + 1}
+	checkArchive(a, &c)
+	if err := c.corruptionError(maxCorruptionIssues); err != nil {
+		return err
+	}
+	a.markValidated()
+	return nil
+}
+
+// VerifyRoundTrip validates the archive and checks that every live row
+// decodes to the matching entry of original, which must hold one entry per
+// row. Deleted rows are not compared. Mismatches are reported as a
+// *CorruptionError.
+func (a *Archive) VerifyRoundTrip(original [][]byte) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	if len(original) != a.Rows() {
+		return fmt.Errorf("archive has %d rows, original has %d", a.Rows(), len(original))
+	}
+
+	c := issueCollector{limit: maxCorruptionIssues + 1}
+	var row []byte
+	for i := range original {
+		if a.IsDeleted(i) {
+			continue
+		}
+		var err error
+		row, err = a.AppendRow(row[:0], i)
+		if err != nil {
+			c.add("", i, -1, 0, "decode row %d: %v", i, err)
+		} else if !bytes.Equal(row, original[i]) {
+			c.add("", i, -1, int64(len(row)), "row %d decodes to %d bytes that differ from the %d original bytes", i, len(row), len(original[i]))
+		}
+		if c.done() {
+			break
+		}
+	}
+	return c.corruptionError(maxCorruptionIssues)
+}
+
+// issueCollector gathers corruption issues, stopping once limit is reached.
+type issueCollector struct {
+	issues []CorruptionIssue
+	limit  int
+}
+
+func (c *issueCollector) add(stage string, row, token int, value int64, format string, args ...any) {
+	if c.done() {
+		return
+	}
+	c.issues = append(c.issues, CorruptionIssue{
+		Stage:   stage,
+		Row:     row,
+		Token:   token,
+		Value:   value,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// done reports whether the collector is full.
+func (c *issueCollector) done() bool {
+	return len(c.issues) >= c.limit
+}
+
+// corruptionError returns the collected issues as a *CorruptionError
+// holding at most maxIssues of them, or nil if there are none. Collect with
+// a limit above maxIssues to detect truncation.
+func (c *issueCollector) corruptionError(maxIssues int) error {
+	if len(c.issues) == 0 {
+		return nil
+	}
+	if len(c.issues) > maxIssues {
+		return &CorruptionError{Issues: c.issues[:maxIssues], Truncated: true}
+	}
+	return &CorruptionError{Issues: c.issues}
+}
+
+// checkArchive records every structural problem of a in c.
+func checkArchive(a *Archive, c *issueCollector) {
+	if a.passthrough {
+		checkPassthrough(a, c)
+		return
+	}
+	if a.raw != nil {
+		c.add(stagePassthrough, -1, -1, int64(len(a.raw)), "archive has passthrough bytes but is not a passthrough archive")
+	}
+	if a.compressedTokenBitWidth != 0 && !validTokenBitWidth(a.compressedTokenBitWidth) {
+		c.add(stageCompressedData, -1, -1, int64(a.compressedTokenBitWidth), "invalid token bit-width: %d", a.compressedTokenBitWidth)
+	}
+	if a.packed != nil {
+		if a.CompressedData != nil {
+			c.add(stageCompressedData, -1, -1, 0, "archive has both packed and unpacked token storage")
+		}
+		if a.packed.bitWidth != a.tokenBitWidth() {
+			c.add(stageCompressedData, -1, -1, int64(a.packed.bitWidth), "packed token width %d does not match archive width %d", a.packed.bitWidth, a.tokenBitWidth())
+		}
+	}
+	boundariesOK := checkStringBoundaries(a, c)
+	checkTokenBoundaries(a, c)
+	if boundariesOK {
+		checkTombstones(a, c)
+	}
+	checkTokens(a, c, boundariesOK)
+}
+
+// checkStringBoundaries reports whether the row boundaries are usable to
+// attribute tokens to rows.
+func checkStringBoundaries(a *Archive, c *issueCollector) bool {
+	if a.compactBoundaries != nil && a.StringBoundaries != nil {
+		c.add(stageStringBoundaries, -1, -1, 0, "archive has both compact and legacy string boundaries")
+		return false
+	}
+	count := a.boundaryCount()
+	if count == 0 {
+		c.add(stageStringBoundaries, -1, -1, 0, "string boundaries must contain at least one entry")
+		return false
+	}
+
+	before := len(c.issues)
+	if first := a.boundaryAt(0); first != 0 {
+		c.add(stageStringBoundaries, 0, -1, int64(first), "first string boundary must be 0: %d", first)
+	}
+	for i := 1; i < count && !c.done(); i++ {
+		if a.boundaryAt(i) < a.boundaryAt(i-1) {
+			c.add(stageStringBoundaries, i-1, -1, int64(a.boundaryAt(i)), "string boundaries not monotonic at index %d", i)
+		}
+	}
+	if last := a.boundaryAt(count - 1); last > a.tokenCount() {
+		c.add(stageStringBoundaries, count-2, -1, int64(last), "string boundary %d out of range for %d tokens", last, a.tokenCount())
+	}
+	return len(c.issues) == before
+}
+
+func checkTokenBoundaries(a *Archive, c *issueCollector) {
+	if len(a.TokenBoundaries) == 0 {
+		c.add(stageTokenBoundaries, -1, -1, 0, "token boundaries must contain at least one entry")
+		return
+	}
+	if first := a.TokenBoundaries[0]; first != 0 {
+		c.add(stageTokenBoundaries, -1, -1, int64(first), "first token boundary must be 0: %d", first)
+	}
+	for i := 1; i < len(a.TokenBoundaries) && !c.done(); i++ {
+		if a.TokenBoundaries[i] < a.TokenBoundaries[i-1] {
+			c.add(stageTokenBoundaries, -1, -1, int64(a.TokenBoundaries[i]), "token boundaries not monotonic at index %d", i)
+		}
+	}
+	if last := a.TokenBoundaries[len(a.TokenBoundaries)-1]; int(last) > len(a.Dictionary) {
+		c.add(stageTokenBoundaries, -1, -1, int64(last), "token boundary %d out of range for dictionary size %d", last, len(a.Dictionary))
+	}
+}
+
+func checkTombstones(a *Archive, c *issueCollector) {
+	if a.tombstones == nil {
+		return
+	}
+	rows := a.Rows()
+	if len(a.tombstones) != tombstoneWords(rows) {
+		c.add(stageTombstones, -1, -1, int64(len(a.tombstones)), "tombstone bitmap covers %d words, expected %d for %d rows", len(a.tombstones), tombstoneWords(rows), rows)
+		return
+	}
+	if rows%64 != 0 && a.tombstones[len(a.tombstones)-1]>>(uint(rows)%64) != 0 {
+		c.add(stageTombstones, -1, -1, int64(rows), "tombstone bitmap marks rows beyond row count %d", rows)
+	}
+}
+
+// checkTokens checks every token ID against the token bit-width and the
+// dictionary. Issues carry the owning row when the row boundaries are valid.
+func checkTokens(a *Archive, c *issueCollector, boundariesOK bool) {
+	bitWidth := a.tokenBitWidth()
+	widthLimit := maxTokenIDForBitWidth(bitWidth)
+	tokenLimit := len(a.TokenBoundaries) - 1
+	rows := a.Rows()
+	row := 0
+	for i := 0; i < a.tokenCount() && !c.done(); i++ {
+		tokenID := a.tokenAt(i)
+		if tokenID <= widthLimit && int(tokenID) < tokenLimit {
+			continue
+		}
+
+		issueRow := -1
+		if boundariesOK {
+			for row < rows && a.boundaryAt(row+1) <= i {
+				row++
+			}
+			if row < rows {
+				issueRow = row
+			}
+		}
+		if tokenID > widthLimit {
+			c.add(stageCompressedData, issueRow, i, int64(tokenID), "compressed token out of %d-bit range at index %d: %d", bitWidth, i, tokenID)
+		} else {
+			c.add(stageCompressedData, issueRow, i, int64(tokenID), "compressed token out of range at index %d: %d", i, tokenID)
+		}
+	}
+}
+
+// archiveShape records the storage an archive was validated against. An
+// archive counts as validated only while its fields still refer to the same
+// slices, so replacing CompressedData, Dictionary or any boundary slice
+// drops it back onto the checked decode path. Mutating those slices in place
+// after validation is not detected.
+type archiveShape struct {
+	compressedData    []uint16
+	packed            *packedTokens
+	stringBoundaries  []int
+	compactBoundaries []uint32
+	dictionary        []byte
+	tokenBoundaries   []uint32
+	raw               []byte
+}
+
+// markValidated records that a passed validateArchiveStructure in its
+// current shape.
+func (a *Archive) markValidated() {
+	a.validated = &archiveShape{
+		compressedData:    a.CompressedData,
+		packed:            a.packed,
+		stringBoundaries:  a.StringBoundaries,
+		compactBoundaries: a.compactBoundaries,
+		dictionary:        a.Dictionary,
+		tokenBoundaries:   a.TokenBoundaries,
+		raw:               a.raw,
+	}
+}
+
+// isValidated reports whether a was validated and still has the shape it was
+// validated in. Decoders then skip per-token range checks.
+func (a *Archive) isValidated() bool {
+	v := a.validated
+	return v != nil &&
+		v.packed == a.packed &&
+		sameBacking(v.compressedData, a.CompressedData) &&
+		sameBacking(v.stringBoundaries, a.StringBoundaries) &&
+		sameBacking(v.compactBoundaries, a.compactBoundaries) &&
+		sameBacking(v.dictionary, a.Dictionary) &&
+		sameBacking(v.tokenBoundaries, a.TokenBoundaries) &&
+		sameBacking(v.raw, a.raw)
+}
+
+// decodedLenUnchecked returns the decoded length of tokens [lo, hi) of a
+// validated archive.
+func (a *Archive) decodedLenUnchecked(lo, hi int) int {
+	tokenBounds := a.TokenBoundaries
+	n := 0
+	if a.packed == nil {
+		for _, tokenID := range a.CompressedData[lo:hi] {
+			n += int(tokenBounds[tokenID+1] - tokenBounds[tokenID])
+		}
+		return n
+	}
+	for pos := lo; pos < hi; pos++ {
+		tokenID := a.packed.at(pos)
+		n += int(tokenBounds[tokenID+1] - tokenBounds[tokenID])
+	}
+	return n
+}
+
+// appendTokensUnchecked appends tokens [lo, hi) of a validated archive to
+// dst.
+func (a *Archive) appendTokensUnchecked(dst []byte, lo, hi int) []byte {
+	tokenBounds := a.TokenBoundaries
+	dictionary := a.Dictionary
+	if a.packed == nil {
+		for _, tokenID := range a.CompressedData[lo:hi] {
+			dst = append(dst, dictionary[tokenBounds[tokenID]:tokenBounds[tokenID+1]]...)
+		}
+		return dst
+	}
+	for pos := lo; pos < hi; pos++ {
+		tokenID := a.packed.at(pos)
+		dst = append(dst, dictionary[tokenBounds[tokenID]:tokenBounds[tokenID+1]]...)
+	}
+	return dst
+}
+
+// copyTokensUnchecked decodes tokens [lo, hi) of a validated archive into
+// buffer at offset and returns the new offset. It reports false if buffer is
+// too short, leaving the error to the checked path.
+func (a *Archive) copyTokensUnchecked(buffer []byte, offset, lo, hi int) (int, bool) {
+	tokenBounds := a.TokenBoundaries
+	dictionary := a.Dictionary
+	for pos := lo; pos < hi; pos++ {
+		tokenID := a.tokenAt(pos)
+		tokenBytes := dictionary[tokenBounds[tokenID]:tokenBounds[tokenID+1]]
+		if offset+len(tokenBytes) > len(buffer) {
+			return 0, false
+		}
+		offset += copy(buffer[offset:], tokenBytes)
+	}
+	return offset, true
+}
@@ -0,0 +1,686 @@
+package onpair
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"maps"
+	"slices"
+)
+
+// TokenEncoding selects how WriteToWithOptions stores the token stream.
+type TokenEncoding uint8
+
+const (
+	// EncodingAuto sizes every encoding the format version allows and
+	// writes the smallest. Only the best size so far is kept; the winner is
+	// encoded a second time while it is written.
+	EncodingAuto TokenEncoding = iota
+	// EncodingRaw stores tokens bit-packed at the archive's token width. It
+	// is the cheapest to write, needs a single pass over the tokens, and
+	// lets a Reader fetch individual rows.
+	EncodingRaw
+	// EncodingFlate stores the raw stream compressed with flate.
+	EncodingFlate
+	// EncodingCodebook stores the 255 most frequent tokens as single bytes
+	// and escapes the rest.
+	EncodingCodebook
+	// EncodingCodebookFlate stores the codebook stream compressed with flate.
+	EncodingCodebookFlate
+	// EncodingHuffman stores tokens with a canonical Huffman code. Releases
+	// that predate it cannot read it, so EncodingAuto only tries it when
+	// writing FormatVersion3.
+	EncodingHuffman
+)
+
+var tokenEncodingNames = [...]string{
+	EncodingAuto:          "auto",
+	EncodingRaw:           "raw",
+	EncodingFlate:         "flate",
+	EncodingCodebook:      "codebook",
+	EncodingCodebookFlate: "codebook+flate",
+	EncodingHuffman:       "huffman",
+}
+
+func (e TokenEncoding) String() string {
+	if int(e) < len(tokenEncodingNames) {
+		return tokenEncodingNames[e]
+	}
+	return fmt.Sprintf("TokenEncoding(%d)", uint8(e))
+}
+
+// wire returns the compressed_data encoding of a concrete TokenEncoding.
+func (e TokenEncoding) wire() uint8 {
+	return uint8(e - 1)
+}
+
+// WriteOptions configures WriteToWithOptions. The zero value matches WriteTo.
+type WriteOptions struct {
+	// Encoding pins the token stream encoding. The default, EncodingAuto,
+	// tries every encoding and keeps the smallest, which is the slowest
+	// option; EncodingRaw is the fastest. Flate payloads of up to 4 MiB are
+	// held in memory between sizing and writing; larger ones are compressed
+	// twice.
+	Encoding TokenEncoding
+
+	// FlateLevel is the compress/flate level used by the flate encodings,
+	// from flate.HuffmanOnly to flate.BestCompression. Zero selects
+	// flate.BestCompression; use EncodingRaw to skip compression entirely.
+	FlateLevel int
+
+	// FormatVersion selects the wire format. Zero selects FormatVersion2,
+	// which releases that predate version 3 read as long as the archive uses
+	// 12- or 16-bit tokens and no newer encoding is pinned; passthrough
+	// archives are written as 12-bit tokens. FormatVersion3 adds a header
+	// carrying the row count, token bit width and feature flags, and a
+	// checksum, and stores passthrough archives as is.
+	FormatVersion uint16
+
+	// Checksum selects the archive checksum. Only version 3 archives carry
+	// one.
+	Checksum ChecksumAlgorithm
+}
+
+// formatVersion returns the effective format version.
+func (o WriteOptions) formatVersion() uint16 {
+	if o.FormatVersion == 0 {
+		return archiveVersion
+	}
+	return o.FormatVersion
+}
+
+// checksum returns the wire ID of the effective checksum algorithm.
+func (o WriteOptions) checksum() uint8 {
+	if o.formatVersion() == FormatVersion3 && o.Checksum != ChecksumNone {
+		return checksumWireCRC32C
+	}
+	return checksumWireNone
+}
+
+// flateLevel returns the effective flate level.
+func (o WriteOptions) flateLevel() int {
+	if o.FlateLevel == 0 {
+		return flate.BestCompression
+	}
+	return o.FlateLevel
+}
+
+func (o WriteOptions) validate() error {
+	if o.Encoding > EncodingHuffman {
+		return fmt.Errorf("invalid token encoding: %d", uint8(o.Encoding))
+	}
+	if o.FlateLevel < flate.HuffmanOnly || o.FlateLevel > flate.BestCompression {
+		return fmt.Errorf("invalid flate level: %d", o.FlateLevel)
+	}
+	switch version := o.formatVersion(); {
+	case version != FormatVersion2 && version != FormatVersion3:
+		return fmt.Errorf("%w: cannot write format version %d", ErrUnsupportedVersion, version)
+	case o.Checksum > ChecksumCRC32C:
+		return fmt.Errorf("invalid checksum algorithm: %d", uint8(o.Checksum))
+	case o.Checksum == ChecksumCRC32C && version == FormatVersion2:
+		return fmt.Errorf("format version %d does not support checksums", version)
+	}
+	return nil
+}
+
+const (
+	// streamBufferSize is the write buffer placed in front of the
+	// destination writer.
+	streamBufferSize = 64 << 10
+
+	// streamChunkTokens is the number of tokens packed per write. It is a
+	// multiple of 8, so every chunk ends on a byte boundary at any width.
+	streamChunkTokens = 8 << 10
+)
+
+// streamStage is a stage whose payload size is known before it is written.
+// write must emit exactly size bytes.
+type streamStage struct {
+	name   string
+	params []byte
+	size   int
+	write  func(w io.Writer) error
+}
+
+// bytesStage wraps an already encoded payload.
+func bytesStage(name string, params []byte, payload []byte) streamStage {
+	return streamStage{
+		name:   name,
+		params: params,
+		size:   len(payload),
+		write: func(w io.Writer) error {
+			_, err := writeBytes(w, payload)
+			return err
+		},
+	}
+}
+
+// bytes encodes the stage payload into memory.
+func (s streamStage) bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(s.size)
+	if err := s.write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// countingWriter counts the bytes that reached the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// flateKeepBytes caps the compressed size of a flate stage payload that is
+// kept in memory once sized; larger payloads are compressed again as they
+// are written.
+const flateKeepBytes = 4 << 20
+
+// cappedBuffer counts the bytes written to it and keeps them until they
+// exceed limit.
+type cappedBuffer struct {
+	buf     []byte
+	n       int
+	limit   int
+	dropped bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.n += len(p)
+	if !b.dropped {
+		if len(b.buf)+len(p) > b.limit {
+			b.buf, b.dropped = nil, true
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// WriteToWithOptions serializes the archive like WriteTo, using opts to pick
+// the token stream encoding. Stages are encoded and written one at a time,
+// straight from the archive: a non-raw compressed_data stage is sized in a
+// first pass and encoded again while it is written, except that flate
+// payloads of up to 4 MiB are kept from the first pass. The wire format is
+// unchanged.
+//
+// An encoding error after the header has been written leaves a partial
+// archive in w.
+func (a *Archive) WriteToWithOptions(w io.Writer, opts WriteOptions) (int64, error) {
+	if err := opts.validate(); err != nil {
+		return 0, err
+	}
+	if err := validateArchiveStructure(a); err != nil {
+		return 0, fmt.Errorf("invalid archive: %w", err)
+	}
+
+	var stages []func() (streamStage, error)
+	if a.passthrough && opts.formatVersion() == FormatVersion3 {
+		stages = []func() (streamStage, error){
+			func() (streamStage, error) { return passthroughStream(a, opts.Encoding, opts.flateLevel()) },
+			func() (streamStage, error) { return stringBoundariesStream(a) },
+		}
+	} else {
+		// Version 2 has no passthrough stage; passthrough bytes are written
+		// as 12-bit single-byte tokens, which releases that predate the
+		// stage decode.
+		dictionary, tokenBoundaries := a.Dictionary, a.TokenBoundaries
+		if a.passthrough {
+			dictionary, tokenBoundaries = singleByteDictionary()
+		}
+		stages = []func() (streamStage, error){
+			func() (streamStage, error) { return compressedDataStream(a, opts) },
+			func() (streamStage, error) { return stringBoundariesStream(a) },
+			func() (streamStage, error) { return dictionaryStream(dictionary) },
+			func() (streamStage, error) { return tokenBoundariesStream(tokenBoundaries) },
+		}
+	}
+	if a.tombstones != nil {
+		stages = append(stages, func() (streamStage, error) { return tombstonesStream(a), nil })
+	}
+	if a.metadata != nil {
+		stages = append(stages, func() (streamStage, error) { return metadataStream(a.metadata) })
+	}
+	for _, name := range slices.Sorted(maps.Keys(a.stageValues)) {
+		stages = append(stages, func() (streamStage, error) { return customStream(name, a.stageValues[name]) })
+	}
+	if len(stages) > maxArchiveStages {
+		return 0, fmt.Errorf("too many stages: %d exceeds %d", len(stages), maxArchiveStages)
+	}
+
+	header := newArchiveHeader(a, opts.formatVersion(), opts.checksum(), len(stages))
+	// Version 3 readers know the parent-coded dictionary, flagged in the
+	// header; version 2 archives keep the raw dictionary every reader knows.
+	if header.version == FormatVersion3 && !a.passthrough {
+		if dictionary, ok := dictionaryParentsStream(a); ok {
+			header.features |= featureDictionaryParents
+			stages[2] = func() (streamStage, error) { return dictionary, nil }
+		}
+	}
+	cw := &countingWriter{w: w}
+	var dst io.Writer = cw
+	var sum hash.Hash32
+	if header.checksum == checksumWireCRC32C {
+		sum = crc32.New(crc32cTable)
+		dst = io.MultiWriter(cw, sum)
+	}
+	bw := bufio.NewWriterSize(dst, streamBufferSize)
+	if _, err := bw.Write(header.appendTo(nil)); err != nil {
+		return cw.n, err
+	}
+
+	for _, next := range stages {
+		stage, err := next()
+		if err != nil {
+			return cw.n, err
+		}
+		if err := writeStreamStage(bw, stage); err != nil {
+			return cw.n, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	if sum != nil {
+		if _, err := writeBytes(cw, binary.LittleEndian.AppendUint32(nil, sum.Sum32())); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// writeStreamStage frames and writes one stage.
+func writeStreamStage(w io.Writer, stage streamStage) error {
+	if len(stage.name) == 0 || len(stage.name) > 255 {
+		return fmt.Errorf("invalid stage name length: %d", len(stage.name))
+	}
+	if len(stage.params) > int(^uint16(0)) {
+		return fmt.Errorf("stage params too large for %q: %d", stage.name, len(stage.params))
+	}
+	if stage.size > maxStagePayloadBytes {
+		return fmt.Errorf("stage payload too large for %q: %d", stage.name, stage.size)
+	}
+
+	var header [7]byte
+	header[0] = uint8(len(stage.name))
+	binary.LittleEndian.PutUint16(header[1:3], uint16(len(stage.params)))
+	binary.LittleEndian.PutUint32(header[3:7], uint32(stage.size))
+	if _, err := writeBytes(w, header[:]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, stage.name); err != nil {
+		return err
+	}
+	if _, err := writeBytes(w, stage.params); err != nil {
+		return err
+	}
+
+	cw := &countingWriter{w: w}
+	if err := stage.write(cw); err != nil {
+		return err
+	}
+	if cw.n != int64(stage.size) {
+		return fmt.Errorf("stage %q wrote %d bytes, declared %d", stage.name, cw.n, stage.size)
+	}
+	return nil
+}
+
+// compressedDataStream returns the compressed_data stage in the encoding
+// opts selects.
+func compressedDataStream(a *Archive, opts WriteOptions) (streamStage, error) {
+	return tokenStreamStage(a, opts.Encoding, opts.flateLevel(), opts.formatVersion())
+}
+
+// tokenStreamStage returns the compressed_data stage in encoding, or in the
+// smallest encoding for EncodingAuto. Readers of version 2 that predate the
+// Huffman encoding reject it, so EncodingAuto only tries it for version 3
+// archives.
+//
+// Candidates are sized one at a time and only the smallest is kept: raw,
+// codebook and Huffman sizes follow from the token counts, and flate
+// payloads are compressed through one flate writer, kept if they fit
+// flateKeepBytes. The winner is encoded again as the stage is written
+// unless its payload was kept.
+func tokenStreamStage(a *Archive, encoding TokenEncoding, flateLevel int, version uint16) (streamStage, error) {
+	count := a.tokenCount()
+	if count > maxCompressedTokenRead {
+		return streamStage{}, fmt.Errorf("compressed token count too large: %d", count)
+	}
+	want := func(e TokenEncoding) bool {
+		if e == EncodingHuffman && encoding == EncodingAuto {
+			return version == FormatVersion3
+		}
+		return encoding == EncodingAuto || encoding == e
+	}
+
+	bitWidth := a.wireTokenBitWidth()
+	var best streamStage
+	found := false
+	consider := func(stage streamStage) {
+		if !found || stage.size < best.size {
+			best, found = stage, true
+		}
+	}
+
+	var fw *flate.Writer
+	flateWriter := func() (*flate.Writer, error) {
+		if fw != nil {
+			return fw, nil
+		}
+		var err error
+		fw, err = flate.NewWriter(io.Discard, flateLevel)
+		return fw, err
+	}
+
+	raw := rawTokenStream(a, bitWidth)
+	if want(EncodingRaw) {
+		consider(raw)
+	}
+	if want(EncodingFlate) {
+		w, err := flateWriter()
+		if err != nil {
+			return streamStage{}, err
+		}
+		stage, err := flateTokenStream(raw, compressedDataEncodingFlate, bitWidth, w)
+		if err != nil {
+			return streamStage{}, err
+		}
+		consider(stage)
+	}
+
+	if want(EncodingCodebook) || want(EncodingCodebookFlate) {
+		codebook, err := codebookTokenStream(a, bitWidth)
+		switch {
+		case err != nil && encoding != EncodingAuto:
+			return streamStage{}, fmt.Errorf("%s encoding unavailable: %w", encoding, err)
+		case err == nil:
+			if want(EncodingCodebook) {
+				consider(codebook)
+			}
+			if want(EncodingCodebookFlate) {
+				w, err := flateWriter()
+				if err != nil {
+					return streamStage{}, err
+				}
+				stage, err := flateTokenStream(codebook, compressedDataEncodingCodebookFlate, bitWidth, w)
+				if err != nil {
+					return streamStage{}, err
+				}
+				consider(stage)
+			}
+		}
+	}
+
+	if want(EncodingHuffman) {
+		huffman, err := huffmanTokenStream(a, bitWidth)
+		switch {
+		case err != nil && encoding != EncodingAuto:
+			return streamStage{}, fmt.Errorf("%s encoding unavailable: %w", encoding, err)
+		case err == nil:
+			consider(huffman)
+		}
+	}
+	return best, nil
+}
+
+// rawTokenStream returns the raw compressed_data stage: the token count,
+// then the tokens packed at bitWidth as they are written.
+func rawTokenStream(a *Archive, bitWidth uint8) streamStage {
+	count := a.tokenCount()
+	return streamStage{
+		name:   stageCompressedData,
+		params: compressedDataParams(compressedDataEncodingRaw, bitWidth),
+		size:   4 + packedByteSize(count, bitWidth),
+		write: func(w io.Writer) error {
+			buf := make([]byte, 4, packedByteSize(streamChunkTokens, bitWidth))
+			binary.LittleEndian.PutUint32(buf, uint32(count))
+			if _, err := writeBytes(w, buf); err != nil {
+				return err
+			}
+			return a.forEachTokenChunk(func(base int, tokens []uint16) error {
+				chunk, err := appendPackedTokens(buf[:0], tokens, bitWidth, base)
+				if err != nil {
+					return err
+				}
+				_, err = writeBytes(w, chunk)
+				return err
+			})
+		},
+	}
+}
+
+// flateTokenStream returns src compressed with flate, as the compressed_data
+// encoding given.
+func flateTokenStream(src streamStage, encoding, bitWidth uint8, fw *flate.Writer) (streamStage, error) {
+	return flateStream(stageCompressedData, compressedDataParams(encoding, bitWidth), src, fw, flateKeepBytes)
+}
+
+// flateStream returns the payload of src compressed with flate, as a stage
+// with the given name and params. src is compressed once to size it; the
+// payload is kept if it fits in keep bytes and compressed again as the stage
+// is written otherwise. fw is reset for each pass, so candidates can share
+// one flate writer.
+func flateStream(name string, params []byte, src streamStage, fw *flate.Writer, keep int) (streamStage, error) {
+	compress := func(w io.Writer) error {
+		fw.Reset(w)
+		if err := src.write(fw); err != nil {
+			_ = fw.Close()
+			return err
+		}
+		return fw.Close()
+	}
+	sized := &cappedBuffer{limit: keep}
+	if err := compress(sized); err != nil {
+		return streamStage{}, err
+	}
+	if !sized.dropped {
+		return bytesStage(name, params, sized.buf), nil
+	}
+	return streamStage{
+		name:   name,
+		params: params,
+		size:   sized.n,
+		write:  compress,
+	}, nil
+}
+
+// streamTokenCounts counts each token ID of the archive's token stream,
+// failing if one does not fit bitWidth.
+func streamTokenCounts(a *Archive, bitWidth uint8) ([]uint32, error) {
+	if count := a.tokenCount(); count > maxCompressedTokenRead {
+		return nil, fmt.Errorf("compressed token count too large: %d", count)
+	}
+	counts := make([]uint32, maxTokenID+1)
+	widthLimit := maxTokenIDForBitWidth(bitWidth)
+	err := a.forEachTokenChunk(func(base int, tokens []uint16) error {
+		for i, tokenID := range tokens {
+			if tokenID > widthLimit {
+				return fmt.Errorf("compressed token out of %d-bit range at index %d: %d", bitWidth, base+i, tokenID)
+			}
+			counts[tokenID]++
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// stringBoundariesStream returns the delta-encoded string_boundaries stage.
+func stringBoundariesStream(a *Archive) (streamStage, error) {
+	count := a.boundaryCount()
+	if count > maxBoundaryCountRead {
+		return streamStage{}, fmt.Errorf("string boundary count too large: %d", count)
+	}
+	params := []byte{stageStringBoundariesParamDelta}
+	if count == 0 {
+		return bytesStage(stageStringBoundaries, params, binary.LittleEndian.AppendUint32(nil, 0)), nil
+	}
+
+	first := a.boundaryAt(0)
+	if first < 0 {
+		return streamStage{}, fmt.Errorf("first string boundary is negative: %d", first)
+	}
+	if uint64(first) > maxStringBoundaryValue {
+		return streamStage{}, fmt.Errorf("first string boundary exceeds max supported value: %d", first)
+	}
+	deltaLen := 0
+	for i := 1; i < count; i++ {
+		delta := a.boundaryAt(i) - a.boundaryAt(i-1)
+		if delta < 0 {
+			return streamStage{}, fmt.Errorf("string boundaries not monotonic at index %d", i)
+		}
+		deltaLen += uvarintLen(uint64(delta))
+	}
+
+	return streamStage{
+		name:   stageStringBoundaries,
+		params: params,
+		size:   4 + 8 + 4 + deltaLen,
+		write: func(w io.Writer) error {
+			buf := make([]byte, 0, streamBufferSize)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(count))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(first))
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(deltaLen))
+			return writeUvarintDeltas(w, buf, count, func(i int) uint64 {
+				return uint64(a.boundaryAt(i) - a.boundaryAt(i-1))
+			})
+		},
+	}, nil
+}
+
+// dictionaryStream returns the dictionary stage, written straight from
+// dictionary.
+func dictionaryStream(dictionary []byte) (streamStage, error) {
+	if len(dictionary) > maxStagePayloadBytes {
+		return streamStage{}, fmt.Errorf("dictionary too large: %d", len(dictionary))
+	}
+	return streamStage{
+		name: stageDictionary,
+		size: 4 + len(dictionary),
+		write: func(w io.Writer) error {
+			if _, err := writeBytes(w, binary.LittleEndian.AppendUint32(nil, uint32(len(dictionary)))); err != nil {
+				return err
+			}
+			_, err := writeBytes(w, dictionary)
+			return err
+		},
+	}, nil
+}
+
+// tokenBoundariesStream returns the smaller of the raw and delta
+// token_boundaries stages, preferring raw on a tie.
+func tokenBoundariesStream(bounds []uint32) (streamStage, error) {
+	if len(bounds) > maxTokenBoundsRead {
+		return streamStage{}, fmt.Errorf("token boundary count too large: %d", len(bounds))
+	}
+	delta, err := tokenBoundariesDeltaStream(bounds)
+	if err != nil {
+		return streamStage{}, err
+	}
+	if raw := tokenBoundariesRawStream(bounds); raw.size <= delta.size {
+		return raw, nil
+	}
+	return delta, nil
+}
+
+func tokenBoundariesRawStream(bounds []uint32) streamStage {
+	return streamStage{
+		name:   stageTokenBoundaries,
+		params: []byte{stageTokenBoundariesParamWidth},
+		size:   4 + 4*len(bounds),
+		write: func(w io.Writer) error {
+			buf := make([]byte, 0, streamBufferSize)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(bounds)))
+			for _, bound := range bounds {
+				if len(buf)+4 > cap(buf) {
+					if _, err := writeBytes(w, buf); err != nil {
+						return err
+					}
+					buf = buf[:0]
+				}
+				buf = binary.LittleEndian.AppendUint32(buf, bound)
+			}
+			_, err := writeBytes(w, buf)
+			return err
+		},
+	}
+}
+
+func tokenBoundariesDeltaStream(bounds []uint32) (streamStage, error) {
+	params := []byte{stageTokenBoundariesParamDelta}
+	if len(bounds) == 0 {
+		return bytesStage(stageTokenBoundaries, params, binary.LittleEndian.AppendUint32(nil, 0)), nil
+	}
+	deltaLen := 0
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] < bounds[i-1] {
+			return streamStage{}, fmt.Errorf("token boundaries not monotonic at index %d", i)
+		}
+		deltaLen += uvarintLen(uint64(bounds[i] - bounds[i-1]))
+	}
+
+	return streamStage{
+		name:   stageTokenBoundaries,
+		params: params,
+		size:   4 + 4 + 4 + deltaLen,
+		write: func(w io.Writer) error {
+			buf := make([]byte, 0, streamBufferSize)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(bounds)))
+			buf = binary.LittleEndian.AppendUint32(buf, bounds[0])
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(deltaLen))
+			return writeUvarintDeltas(w, buf, len(bounds), func(i int) uint64 {
+				return uint64(bounds[i] - bounds[i-1])
+			})
+		},
+	}, nil
+}
+
+// tombstonesStream returns the tombstones stage. The bitmap is one bit per
+// row, so it is encoded in memory.
+func tombstonesStream(a *Archive) streamStage {
+	rows := a.Rows()
+	payload := make([]byte, 4+(rows+7)/8)
+	binary.LittleEndian.PutUint32(payload[:4], uint32(rows))
+	bitmap := payload[4:]
+	for i := range bitmap {
+		word := a.tombstones[i/8]
+		bitmap[i] = byte(word >> (uint(i%8) * 8))
+	}
+	return bytesStage(stageTombstones, []byte{stageTombstonesParamBitmap}, payload)
+}
+
+// writeUvarintDeltas appends delta(i) for i in [1, count) as uvarints to buf,
+// flushing buf to w whenever it fills.
+func writeUvarintDeltas(w io.Writer, buf []byte, count int, delta func(i int) uint64) error {
+	for i := 1; i < count; i++ {
+		if len(buf)+binary.MaxVarintLen64 > cap(buf) {
+			if _, err := writeBytes(w, buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		buf = binary.AppendUvarint(buf, delta(i))
+	}
+	_, err := writeBytes(w, buf)
+	return err
+}
+
+// uvarintLen returns the encoded length of v as a uvarint.
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}